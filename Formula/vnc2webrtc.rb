@@ -8,6 +8,15 @@ class Vnc2webrtc < Formula
   depends_on "go" => :build
   depends_on "libvncserver"
   depends_on "libvpx"
+  depends_on "opus"
+
+  on_linux do
+    depends_on "alsa-lib"
+    depends_on "libx11"
+    depends_on "libxdamage"
+    depends_on "libxext"
+    depends_on "pulseaudio"
+  end
 
   def install
     system "go", "build"
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+)
+
+var defaultAudioFormat = AudioFormat{
+	SampleRate: 48000,
+	Channels:   2,
+}
+
+type AudioFormat struct {
+	SampleRate int
+	Channels   int
+}
+
+// AudioProvider captures interleaved signed 16-bit samples.
+type AudioProvider interface {
+	io.Closer
+	AudioFormat() AudioFormat
+	// ReadAudio fills pcm, blocking until enough samples were captured.
+	ReadAudio(pcm []int16) error
+}
+
+type AudioProviderFactory interface {
+	NewAudioProvider() (AudioProvider, error)
+}
+
+// FrameAudioProvider is implemented by frame providers that carry the
+// desktop audio too, like QEMU's VNC server.
+type FrameAudioProvider interface {
+	AudioProvider() (AudioProvider, error)
+}
+
+type frameProviderAudio struct{}
+
+func (frameProviderAudio) NewAudioProvider() (AudioProvider, error) {
+	return nil, errors.New("audio comes from the frame provider")
+}
+
+// FrameProviderAudio has peers take the audio from their frame provider,
+// which must implement FrameAudioProvider.
+var FrameProviderAudio AudioProviderFactory = frameProviderAudio{}
+
+type PulseAudioProviderFactory struct {
+	// Device is the source to record, empty for the monitor of the default
+	// sink, which is what the desktop is playing.
+	Device string
+	Format AudioFormat
+}
+
+var _ AudioProviderFactory = (*PulseAudioProviderFactory)(nil)
+
+func (f *PulseAudioProviderFactory) NewAudioProvider() (AudioProvider, error) {
+	return NewPulseAudioProvider(f.Device, f.Format)
+}
+
+type ALSAAudioProviderFactory struct {
+	// Device is the PCM to capture, empty for "default".
+	Device string
+	Format AudioFormat
+}
+
+var _ AudioProviderFactory = (*ALSAAudioProviderFactory)(nil)
+
+func (f *ALSAAudioProviderFactory) NewAudioProvider() (AudioProvider, error) {
+	return NewALSAAudioProvider(f.Device, f.Format)
+}
+
+func (p *Peer) newAudioProvider() (AudioProvider, error) {
+	if p.options.Audio != FrameProviderAudio {
+		return p.options.Audio.NewAudioProvider()
+	}
+
+	source, ok := p.frameProvider.(FrameAudioProvider)
+	if !ok {
+		return nil, errors.New("the frame provider doesn't carry audio")
+	}
+	return source.AudioProvider()
+}
+
+// writeAudioSamples encodes audio as it's captured until the provider is
+// closed. Every sample lasts opusFrameDuration, the RTP timestamps count
+// captured samples and only keep up with the wall clock as long as the
+// capture does.
+func (p *Peer) writeAudioSamples() error {
+	encoder, err := NewOpusEncoder(p.audioProvider.AudioFormat(), p.options.AudioEncoder)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+
+	pcm := make([]int16, encoder.FrameSamples())
+	for {
+		if err := p.audioProvider.ReadAudio(pcm); err != nil {
+			if errors.Is(err, io.EOF) {
+				log.Print("audio ended")
+				return nil
+			}
+			return err
+		}
+
+		packet, err := encoder.Encode(pcm)
+		if err != nil {
+			return err
+		}
+
+		if err := p.audioTrack.WriteSample(media.Sample{Data: packet, Duration: opusFrameDuration}); err != nil {
+			return err
+		}
+	}
+}
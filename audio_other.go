@@ -0,0 +1,15 @@
+//go:build !linux || nocapture
+
+package main
+
+import (
+	"errors"
+)
+
+func NewPulseAudioProvider(device string, format AudioFormat) (AudioProvider, error) {
+	return nil, errors.New("PulseAudio capture is only supported on Linux, without the nocapture tag")
+}
+
+func NewALSAAudioProvider(device string, format AudioFormat) (AudioProvider, error) {
+	return nil, errors.New("ALSA capture is only supported on Linux, without the nocapture tag")
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+// fakeAudioFrameProvider carries audio like QEMU's VNC server.
+type fakeAudioFrameProvider struct {
+	fakeFailingProvider
+	audio AudioProvider
+}
+
+func (p *fakeAudioFrameProvider) AudioProvider() (AudioProvider, error) {
+	return p.audio, nil
+}
+
+type fakeAudioProviderFactory struct {
+	provider AudioProvider
+}
+
+func (f *fakeAudioProviderFactory) NewAudioProvider() (AudioProvider, error) {
+	return f.provider, nil
+}
+
+func TestPeerNewAudioProvider(t *testing.T) {
+	fromFrames := newVNCAudio(defaultAudioFormat)
+	defer fromFrames.Close()
+	fromFactory := newVNCAudio(defaultAudioFormat)
+	defer fromFactory.Close()
+
+	withAudio := &fakeAudioFrameProvider{audio: fromFrames}
+	withoutAudio := &fakeFailingProvider{}
+
+	tests := []struct {
+		name          string
+		audio         AudioProviderFactory
+		frameProvider FrameProvider
+		want          AudioProvider
+	}{
+		{"factory", &fakeAudioProviderFactory{fromFactory}, withAudio, fromFactory},
+		{"frame provider", FrameProviderAudio, withAudio, fromFrames},
+		{"frame provider without audio", FrameProviderAudio, withoutAudio, nil},
+	}
+
+	for _, test := range tests {
+		peer := Peer{
+			frameProvider: test.frameProvider,
+			options:       PeerOptions{Audio: test.audio},
+		}
+
+		got, err := peer.newAudioProvider()
+		if test.want == nil {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got another audio provider", test.name)
+		}
+	}
+
+	// FrameProviderAudio is only a marker, it doesn't capture anything
+	if _, err := FrameProviderAudio.NewAudioProvider(); err == nil {
+		t.Error("FrameProviderAudio.NewAudioProvider succeeded")
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wavFormatPCM        = 1
+	wavFormatExtensible = 0xFFFE
+	// wavMaxFmtSize is the size of WAVE_FORMAT_EXTENSIBLE, whatever follows
+	// it is skipped
+	wavMaxFmtSize = 40
+)
+
+type AudioFileOptions struct {
+	// Path is a WAV file, or raw signed 16-bit little endian samples in
+	// Format when it has any other extension.
+	Path   string
+	Format AudioFormat
+	Loop   bool
+}
+
+// AudioFileProvider plays a file back at the pace it would be captured, for
+// testing without a sound server. Sample rates Opus doesn't take are
+// linearly resampled to 48 kHz.
+type AudioFileProvider struct {
+	mutex   sync.Mutex
+	file    *os.File
+	data    *io.SectionReader
+	reader  *bufio.Reader
+	format  AudioFormat
+	output  AudioFormat
+	loop    bool
+	start   time.Time
+	frames  int64
+	step    float64
+	offset  float64
+	prev    []int16
+	next    []int16
+	buffer  []byte
+	started bool
+}
+
+var _ AudioProvider = (*AudioFileProvider)(nil)
+
+func NewAudioFileProvider(options AudioFileOptions) (*AudioFileProvider, error) {
+	file, err := os.Open(options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	format := options.Format
+	var data *io.SectionReader
+	if strings.EqualFold(filepath.Ext(options.Path), ".wav") {
+		format, data, err = readWAVHeader(file)
+	} else {
+		var info os.FileInfo
+		if info, err = file.Stat(); err == nil {
+			data = io.NewSectionReader(file, 0, info.Size())
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", options.Path, err)
+	}
+	if format.SampleRate <= 0 || format.Channels < 1 || format.Channels > opusMaxChannels {
+		file.Close()
+		return nil, fmt.Errorf("%s: unsupported audio format: %+v", options.Path, format)
+	}
+
+	output := format
+	supported := false
+	for _, rate := range opusSampleRates {
+		supported = supported || format.SampleRate == rate
+	}
+	if !supported {
+		output.SampleRate = opusClockRate
+	}
+
+	provider := AudioFileProvider{
+		file:   file,
+		data:   data,
+		reader: bufio.NewReader(data),
+		format: format,
+		output: output,
+		loop:   options.Loop,
+		step:   float64(format.SampleRate) / float64(output.SampleRate),
+		prev:   make([]int16, format.Channels),
+		next:   make([]int16, format.Channels),
+		buffer: make([]byte, 2*format.Channels),
+	}
+	return &provider, nil
+}
+
+func readWAVHeader(file *os.File) (AudioFormat, *io.SectionReader, error) {
+	var format AudioFormat
+
+	var riff [12]byte
+	if _, err := io.ReadFull(file, riff[:]); err != nil {
+		return format, nil, err
+	}
+	if string(riff[0:4]) != "RIFF" || string(riff[8:12]) != "WAVE" {
+		return format, nil, errors.New("not a WAV file")
+	}
+
+	offset := int64(len(riff))
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(file, header[:]); err != nil {
+			return format, nil, fmt.Errorf("no data chunk: %w", err)
+		}
+		offset += int64(len(header))
+		size := int64(binary.LittleEndian.Uint32(header[4:8]))
+
+		skip := size
+		switch string(header[0:4]) {
+		case "fmt ":
+			if size < 16 {
+				return format, nil, errors.New("invalid fmt chunk")
+			}
+			n := size
+			if n > wavMaxFmtSize {
+				n = wavMaxFmtSize
+			}
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(file, chunk); err != nil {
+				return format, nil, err
+			}
+			skip -= n
+
+			tag := binary.LittleEndian.Uint16(chunk[0:2])
+			if tag == wavFormatExtensible && len(chunk) >= 26 {
+				tag = binary.LittleEndian.Uint16(chunk[24:26])
+			}
+			bits := binary.LittleEndian.Uint16(chunk[14:16])
+			if tag != wavFormatPCM || bits != 16 {
+				return format, nil, fmt.Errorf("only 16-bit PCM is supported, got format %d with %d bits", tag, bits)
+			}
+
+			format.Channels = int(binary.LittleEndian.Uint16(chunk[2:4]))
+			format.SampleRate = int(binary.LittleEndian.Uint32(chunk[4:8]))
+
+		case "data":
+			if format.SampleRate == 0 {
+				return format, nil, errors.New("data chunk before fmt chunk")
+			}
+			return format, io.NewSectionReader(file, offset, size), nil
+		}
+
+		// chunks are padded to even sizes
+		if _, err := file.Seek(skip+size&1, io.SeekCurrent); err != nil {
+			return format, nil, err
+		}
+		offset += size + size&1
+	}
+}
+
+func (p *AudioFileProvider) AudioFormat() AudioFormat {
+	return p.output
+}
+
+// readFrame reads the samples of every channel at one instant, starting
+// over at the end of the file when looping.
+func (p *AudioFileProvider) readFrame(frame []int16) error {
+	rewound := false
+	for {
+		_, err := io.ReadFull(p.reader, p.buffer)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		if !p.loop || rewound {
+			return io.EOF
+		}
+
+		if _, err := p.data.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		p.reader.Reset(p.data)
+		rewound = true
+	}
+
+	for i := range frame {
+		frame[i] = int16(binary.LittleEndian.Uint16(p.buffer[2*i:]))
+	}
+	return nil
+}
+
+func (p *AudioFileProvider) ReadAudio(pcm []int16) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if !p.started {
+		if err := p.readFrame(p.prev); err != nil {
+			return err
+		}
+		if err := p.readFrame(p.next); err != nil {
+			return err
+		}
+		p.start = time.Now()
+		p.started = true
+	}
+
+	channels := p.format.Channels
+	for i := 0; i+channels <= len(pcm); i += channels {
+		for p.offset >= 1 {
+			copy(p.prev, p.next)
+			if err := p.readFrame(p.next); err != nil {
+				return err
+			}
+			p.offset--
+		}
+
+		for c := 0; c < channels; c++ {
+			prev, next := float64(p.prev[c]), float64(p.next[c])
+			pcm[i+c] = int16(prev + (next-prev)*p.offset)
+		}
+		p.offset += p.step
+	}
+
+	// blocks until the last sample would have been captured
+	p.frames += int64(len(pcm) / channels)
+	due := p.start.Add(time.Duration(p.frames * int64(time.Second) / int64(p.output.SampleRate)))
+	time.Sleep(time.Until(due))
+
+	return nil
+}
+
+func (p *AudioFileProvider) Close() error {
+	return p.file.Close()
+}
+
+type AudioFileProviderFactory struct {
+	Options AudioFileOptions
+}
+
+var _ AudioProviderFactory = (*AudioFileProviderFactory)(nil)
+
+func (f *AudioFileProviderFactory) NewAudioProvider() (AudioProvider, error) {
+	return NewAudioFileProvider(f.Options)
+}
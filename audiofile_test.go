@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// wavChunk encodes a RIFF chunk, padded to an even size.
+func wavChunk(id string, data []byte) []byte {
+	chunk := make([]byte, 8, 8+len(data)+1)
+	copy(chunk, id)
+	binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+	chunk = append(chunk, data...)
+	if len(data)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+// wavFmt is the 16 byte PCM fmt chunk, with room for extensions.
+func wavFmt(tag uint16, format AudioFormat, bits uint16, size int) []byte {
+	data := make([]byte, size)
+	binary.LittleEndian.PutUint16(data[0:], tag)
+	binary.LittleEndian.PutUint16(data[2:], uint16(format.Channels))
+	binary.LittleEndian.PutUint32(data[4:], uint32(format.SampleRate))
+	binary.LittleEndian.PutUint16(data[14:], bits)
+	return data
+}
+
+// pcmBytes encodes samples as signed 16-bit little endian.
+func pcmBytes(samples ...int16) []byte {
+	data := make([]byte, 2*len(samples))
+	for i, sample := range samples {
+		binary.LittleEndian.PutUint16(data[2*i:], uint16(sample))
+	}
+	return data
+}
+
+func writeAudioFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func writeWAV(t *testing.T, chunks ...[]byte) string {
+	t.Helper()
+
+	var body []byte
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	header := make([]byte, 12)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+len(body)))
+	copy(header[8:], "WAVE")
+	return writeAudioFile(t, "audio.wav", append(header, body...))
+}
+
+func TestReadWAVHeader(t *testing.T) {
+	stereo := AudioFormat{SampleRate: 44100, Channels: 2}
+	samples := pcmBytes(1, -1, 2, -2)
+
+	extensible := wavFmt(wavFormatExtensible, stereo, 16, 40)
+	binary.LittleEndian.PutUint16(extensible[24:], wavFormatPCM)
+	extensibleFloat := wavFmt(wavFormatExtensible, stereo, 32, 40)
+	binary.LittleEndian.PutUint16(extensibleFloat[24:], 3)
+
+	// only the first 40 bytes are read, the data is skipped with the rest
+	hugeFmt := wavChunk("fmt ", wavFmt(wavFormatPCM, stereo, 16, 40))
+	binary.LittleEndian.PutUint32(hugeFmt[4:], 0xFFFFFFF0)
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		err    string
+	}{
+		{
+			name:   "pcm",
+			chunks: [][]byte{wavChunk("fmt ", wavFmt(wavFormatPCM, stereo, 16, 16)), wavChunk("data", samples)},
+		},
+		{
+			name:   "extensible",
+			chunks: [][]byte{wavChunk("fmt ", extensible), wavChunk("data", samples)},
+		},
+		{
+			// an odd fmt chunk and an odd unknown chunk, both padded
+			name: "odd chunks",
+			chunks: [][]byte{
+				wavChunk("fmt ", wavFmt(wavFormatPCM, stereo, 16, 17)),
+				wavChunk("LIST", []byte("abc")),
+				wavChunk("data", samples),
+			},
+		},
+		{
+			// the extension past WAVE_FORMAT_EXTENSIBLE is skipped
+			name:   "long fmt",
+			chunks: [][]byte{wavChunk("fmt ", wavFmt(wavFormatPCM, stereo, 16, 101)), wavChunk("data", samples)},
+		},
+		{
+			name:   "huge fmt",
+			chunks: [][]byte{hugeFmt, wavChunk("data", samples)},
+			err:    "no data chunk",
+		},
+		{
+			name:   "short fmt",
+			chunks: [][]byte{wavChunk("fmt ", make([]byte, 14)), wavChunk("data", samples)},
+			err:    "invalid fmt chunk",
+		},
+		{
+			name:   "8 bits",
+			chunks: [][]byte{wavChunk("fmt ", wavFmt(wavFormatPCM, stereo, 8, 16)), wavChunk("data", samples)},
+			err:    "only 16-bit PCM",
+		},
+		{
+			name:   "extensible float",
+			chunks: [][]byte{wavChunk("fmt ", extensibleFloat), wavChunk("data", samples)},
+			err:    "only 16-bit PCM",
+		},
+		{
+			name:   "data first",
+			chunks: [][]byte{wavChunk("data", samples), wavChunk("fmt ", wavFmt(wavFormatPCM, stereo, 16, 16))},
+			err:    "data chunk before fmt chunk",
+		},
+		{
+			name:   "no data",
+			chunks: [][]byte{wavChunk("fmt ", wavFmt(wavFormatPCM, stereo, 16, 16))},
+			err:    "no data chunk",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, err := os.Open(writeWAV(t, test.chunks...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			format, data, err := readWAVHeader(file)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if format != stereo {
+				t.Errorf("format = %+v, want %+v", format, stereo)
+			}
+			got, err := io.ReadAll(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(samples) {
+				t.Errorf("data = %v, want %v", got, samples)
+			}
+		})
+	}
+
+	path := writeAudioFile(t, "audio.wav", []byte("RIFF\x04\x00\x00\x00AVI "))
+	if _, err := NewAudioFileProvider(AudioFileOptions{Path: path}); err == nil || !strings.Contains(err.Error(), "not a WAV file") {
+		t.Errorf("AVI file error = %v, want not a WAV file", err)
+	}
+}
+
+func TestAudioFileProvider(t *testing.T) {
+	ramp := func(n int, step int16) []int16 {
+		samples := make([]int16, n)
+		for i := range samples {
+			samples[i] = int16(i) * step
+		}
+		return samples
+	}
+
+	tests := []struct {
+		name    string
+		format  AudioFormat
+		samples []int16
+		loop    bool
+		output  AudioFormat
+		want    []int16
+	}{
+		{
+			name:    "stereo",
+			format:  AudioFormat{SampleRate: 8000, Channels: 2},
+			samples: []int16{1, -1, 2, -2, 3, -3, 4, -4},
+			output:  AudioFormat{SampleRate: 8000, Channels: 2},
+			want:    []int16{1, -1, 2, -2, 3, -3},
+		},
+		{
+			name:    "loop",
+			format:  AudioFormat{SampleRate: 8000, Channels: 1},
+			samples: []int16{10, 20, 30, 40},
+			loop:    true,
+			output:  AudioFormat{SampleRate: 8000, Channels: 1},
+			want:    []int16{10, 20, 30, 40, 10, 20, 30, 40, 10},
+		},
+		{
+			// 32 kHz isn't an Opus rate, every output sample is 2/3 of an
+			// input one further
+			name:    "resampled",
+			format:  AudioFormat{SampleRate: 32000, Channels: 1},
+			samples: ramp(16, 300),
+			output:  AudioFormat{SampleRate: 48000, Channels: 1},
+			want:    ramp(21, 200),
+		},
+		{
+			name:    "resampled stereo",
+			format:  AudioFormat{SampleRate: 24000 * 3 / 2, Channels: 2},
+			samples: []int16{0, 0, 300, -300, 600, -600, 900, -900},
+			output:  AudioFormat{SampleRate: 48000, Channels: 2},
+			want:    []int16{0, 0, 225, -225, 450, -450, 675, -675},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := writeAudioFile(t, "audio.raw", pcmBytes(test.samples...))
+			provider, err := NewAudioFileProvider(AudioFileOptions{Path: path, Format: test.format, Loop: test.loop})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer provider.Close()
+
+			if format := provider.AudioFormat(); format != test.output {
+				t.Errorf("AudioFormat = %+v, want %+v", format, test.output)
+			}
+
+			pcm := make([]int16, len(test.want))
+			if err := provider.ReadAudio(pcm); err != nil {
+				t.Fatal(err)
+			}
+			for i := range pcm {
+				if d := int(pcm[i]) - int(test.want[i]); d < -1 || d > 1 {
+					t.Fatalf("pcm = %v, want %v", pcm, test.want)
+				}
+			}
+
+			if !test.loop {
+				if err := provider.ReadAudio(pcm); !errors.Is(err, io.EOF) {
+					t.Errorf("ReadAudio past the end = %v, want io.EOF", err)
+				}
+			}
+		})
+	}
+}
+
+func TestAudioFileProviderWAV(t *testing.T) {
+	format := AudioFormat{SampleRate: 16000, Channels: 1}
+	path := writeWAV(t,
+		wavChunk("fmt ", wavFmt(wavFormatPCM, format, 16, 16)),
+		wavChunk("data", pcmBytes(5, 6, 7)),
+		// chunks after the data aren't samples
+		wavChunk("LIST", []byte("trailer")),
+	)
+
+	// the format comes from the header
+	provider, err := NewAudioFileProvider(AudioFileOptions{Path: path, Format: AudioFormat{SampleRate: 8000, Channels: 2}, Loop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	if got := provider.AudioFormat(); got != format {
+		t.Errorf("AudioFormat = %+v, want %+v", got, format)
+	}
+	pcm := make([]int16, 7)
+	if err := provider.ReadAudio(pcm); err != nil {
+		t.Fatal(err)
+	}
+	want := []int16{5, 6, 7, 5, 6, 7, 5}
+	for i := range pcm {
+		if pcm[i] != want[i] {
+			t.Fatalf("pcm = %v, want %v", pcm, want)
+		}
+	}
+}
+
+func TestAudioFileProviderUnsupported(t *testing.T) {
+	path := writeAudioFile(t, "audio.raw", pcmBytes(0, 0))
+
+	for _, format := range []AudioFormat{
+		{SampleRate: 0, Channels: 1},
+		{SampleRate: 48000, Channels: 0},
+		{SampleRate: 48000, Channels: 3},
+	} {
+		if provider, err := NewAudioFileProvider(AudioFileOptions{Path: path, Format: format}); err == nil {
+			provider.Close()
+			t.Errorf("format %+v accepted", format)
+		}
+	}
+}
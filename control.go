@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type ControlMessage struct {
+	Type string `json:"type"`
+}
+
+type CropMessage struct {
+	Type   string `json:"type"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type MaskMessage struct {
+	Type      string `json:"type"`
+	ID        string `json:"id"`
+	X         int    `json:"x"`
+	Y         int    `json:"y"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Style     string `json:"style"`
+	BlockSize int    `json:"blockSize"`
+}
+
+// OverlayMessage replaces the overlay options, except for the logo which
+// can only be set on the command line.
+type OverlayMessage struct {
+	Type      string   `json:"type"`
+	Hostname  bool     `json:"hostname"`
+	Timestamp bool     `json:"timestamp"`
+	SessionID string   `json:"sessionId"`
+	Text      string   `json:"text"`
+	Position  string   `json:"position"`
+	FontSize  float64  `json:"fontSize"`
+	Opacity   *float64 `json:"opacity"`
+}
+
+func (p *Peer) onControlMessage(msg webrtc.DataChannelMessage) {
+	if err := p.handleControlMessage(msg.Data); err != nil {
+		log.Print(err)
+	}
+}
+
+func (p *Peer) handleControlMessage(data []byte) error {
+	var message ControlMessage
+	if err := json.Unmarshal(data, &message); err != nil {
+		return err
+	}
+
+	switch message.Type {
+	case "crop":
+		var crop CropMessage
+		if err := json.Unmarshal(data, &crop); err != nil {
+			return err
+		}
+
+		p.options.Crop.SetRect(image.Rect(crop.X, crop.Y, crop.X+crop.Width, crop.Y+crop.Height))
+		return nil
+
+	case "mask":
+		var mask MaskMessage
+		if err := json.Unmarshal(data, &mask); err != nil {
+			return err
+		}
+		if mask.ID == "" {
+			return errors.New("mask without id")
+		}
+
+		m := Mask{
+			Rect:      image.Rect(mask.X, mask.Y, mask.X+mask.Width, mask.Y+mask.Height),
+			Color:     color.RGBA{0, 0, 0, 255},
+			BlockSize: mask.BlockSize,
+		}
+		if mask.Style != "" {
+			if err := m.Style.Set(mask.Style); err != nil {
+				return err
+			}
+		}
+
+		p.options.Masks.Put(mask.ID, m)
+		return nil
+
+	case "unmask":
+		var mask MaskMessage
+		if err := json.Unmarshal(data, &mask); err != nil {
+			return err
+		}
+
+		// without an id every mask is removed
+		if mask.ID == "" {
+			p.options.Masks.Clear()
+		} else {
+			p.options.Masks.Remove(mask.ID)
+		}
+		return nil
+
+	case "overlay":
+		var overlay OverlayMessage
+		if err := json.Unmarshal(data, &overlay); err != nil {
+			return err
+		}
+
+		options := p.options.Overlay.Options()
+		options.Hostname = overlay.Hostname
+		options.Timestamp = overlay.Timestamp
+		options.SessionID = overlay.SessionID
+		options.Text = overlay.Text
+		options.FontSize = overlay.FontSize
+		options.Opacity = overlay.Opacity
+		if overlay.Position != "" {
+			if err := options.Position.Set(overlay.Position); err != nil {
+				return err
+			}
+		}
+
+		p.options.Overlay.SetOptions(options)
+		return nil
+
+	default:
+		return fmt.Errorf("unknown control message: %s", message.Type)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// Crop selects the region of the frames that gets streamed, and can be
+// changed while frames are flowing.
+type Crop struct {
+	mutex sync.Mutex
+	rect  image.Rectangle
+}
+
+func (c *Crop) Rect() image.Rectangle {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.rect
+}
+
+// SetRect changes the region, an empty one streams the whole frame.
+func (c *Crop) SetRect(rect image.Rectangle) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.rect = rect.Canon()
+}
+
+func (c *Crop) Apply(frame *image.RGBA) *image.RGBA {
+	rect := c.Rect()
+	if rect.Empty() {
+		return frame
+	}
+
+	rect = rect.Add(frame.Rect.Min).Intersect(frame.Rect)
+	if rect.Empty() {
+		return frame
+	}
+
+	return frame.SubImage(rect).(*image.RGBA)
+}
+
+func (c *Crop) String() string {
+	rect := c.Rect()
+	if rect.Empty() {
+		return ""
+	}
+
+	return fmt.Sprintf("%dx%d+%d+%d", rect.Dx(), rect.Dy(), rect.Min.X, rect.Min.Y)
+}
+
+// Set parses an X11 style geometry, WIDTHxHEIGHT+X+Y.
+func (c *Crop) Set(s string) error {
+	var w, h, x, y int
+	if _, err := fmt.Sscanf(s, "%dx%d+%d+%d", &w, &h, &x, &y); err != nil {
+		return fmt.Errorf("invalid geometry %q: %w", s, err)
+	}
+	if w <= 0 || h <= 0 || x < 0 || y < 0 {
+		return fmt.Errorf("invalid geometry %q", s)
+	}
+
+	c.SetRect(image.Rect(x, y, x+w, y+h))
+	return nil
+}
+
+type EvenSizeMode int
+
+const (
+	EvenSizeNone EvenSizeMode = iota
+	EvenSizeCrop
+	EvenSizePad
+)
+
+func (m EvenSizeMode) String() string {
+	switch m {
+	case EvenSizeNone:
+		return "none"
+	case EvenSizeCrop:
+		return "crop"
+	case EvenSizePad:
+		return "pad"
+	default:
+		return fmt.Sprintf("EvenSizeMode(%d)", int(m))
+	}
+}
+
+func (m *EvenSizeMode) Set(s string) error {
+	switch s {
+	case "none":
+		*m = EvenSizeNone
+	case "crop":
+		*m = EvenSizeCrop
+	case "pad":
+		*m = EvenSizePad
+	default:
+		return fmt.Errorf("unknown even size mode: %s", s)
+	}
+
+	return nil
+}
+
+// Apply makes both dimensions of frame even, either dropping or duplicating
+// its last column and row. Frames that are already even are returned as is.
+func (m EvenSizeMode) Apply(frame *image.RGBA) *image.RGBA {
+	size := frame.Rect.Size()
+	if m == EvenSizeNone || size.X%2 == 0 && size.Y%2 == 0 {
+		return frame
+	}
+
+	if m == EvenSizeCrop {
+		rect := frame.Rect
+		rect.Max.X -= size.X % 2
+		rect.Max.Y -= size.Y % 2
+		if rect.Empty() {
+			return frame
+		}
+
+		return frame.SubImage(rect).(*image.RGBA)
+	}
+
+	padded := image.NewRGBA(image.Rect(0, 0, size.X+size.X%2, size.Y+size.Y%2))
+	for y := 0; y < padded.Rect.Dy(); y++ {
+		sy := y
+		if sy >= size.Y {
+			sy = size.Y - 1
+		}
+
+		src := frame.Pix[frame.PixOffset(frame.Rect.Min.X, frame.Rect.Min.Y+sy):][:4*size.X]
+		dst := padded.Pix[y*padded.Stride:][:padded.Stride]
+		copy(dst, src)
+		if size.X%2 != 0 {
+			copy(dst[4*size.X:], src[4*(size.X-1):])
+		}
+	}
+
+	return padded
+}
+
+// SizeMessage tells the remote the size of the frame content, which padded
+// frames hide behind their duplicated last column and row.
+type SizeMessage struct {
+	Type   string `json:"type"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type sizeSender struct {
+	channel *webrtc.DataChannel
+	last    image.Point
+}
+
+func (s *sizeSender) send(size image.Point) error {
+	if s.channel == nil || s.channel.ReadyState() != webrtc.DataChannelStateOpen {
+		s.last = image.Point{}
+		return nil
+	}
+	if size == s.last {
+		return nil
+	}
+
+	data, err := json.Marshal(SizeMessage{
+		Type:   "size",
+		Width:  size.X,
+		Height: size.Y,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := s.channel.SendText(string(data)); err != nil {
+		return err
+	}
+
+	s.last = size
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"image"
+	"testing"
+)
+
+// numberedRGBA fills each pixel with its coordinates, so tests can tell
+// which source pixel ended up where.
+func numberedRGBA(rect image.Rectangle) *image.RGBA {
+	img := image.NewRGBA(rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = uint8(x), uint8(y), 0, 255
+		}
+	}
+	return img
+}
+
+func TestEvenSizeMode(t *testing.T) {
+	tests := []struct {
+		mode EvenSizeMode
+		size image.Point
+		want image.Point
+	}{
+		{EvenSizeNone, image.Pt(1366, 767), image.Pt(1366, 767)},
+		{EvenSizeNone, image.Pt(1025, 768), image.Pt(1025, 768)},
+		{EvenSizeCrop, image.Pt(1366, 768), image.Pt(1366, 768)},
+		{EvenSizeCrop, image.Pt(1366, 767), image.Pt(1366, 766)},
+		{EvenSizeCrop, image.Pt(1025, 768), image.Pt(1024, 768)},
+		{EvenSizeCrop, image.Pt(1025, 767), image.Pt(1024, 766)},
+		{EvenSizeCrop, image.Pt(1, 1), image.Pt(1, 1)},
+		{EvenSizePad, image.Pt(1366, 768), image.Pt(1366, 768)},
+		{EvenSizePad, image.Pt(1366, 767), image.Pt(1366, 768)},
+		{EvenSizePad, image.Pt(1025, 768), image.Pt(1026, 768)},
+		{EvenSizePad, image.Pt(1025, 767), image.Pt(1026, 768)},
+		{EvenSizePad, image.Pt(1, 1), image.Pt(2, 2)},
+	}
+
+	for _, test := range tests {
+		frame := numberedRGBA(image.Rectangle{Max: test.size})
+		got := test.mode.Apply(frame)
+
+		if size := got.Rect.Size(); size != test.want {
+			t.Errorf("%v %v: size = %v, want %v", test.mode, test.size, size, test.want)
+			continue
+		}
+		if test.want == test.size && got != frame {
+			t.Errorf("%v %v: even frames should be returned as is", test.mode, test.size)
+		}
+	}
+}
+
+func TestEvenSizeModeCropSubImage(t *testing.T) {
+	frame := numberedRGBA(image.Rect(0, 0, 8, 8)).SubImage(image.Rect(3, 2, 6, 5)).(*image.RGBA)
+
+	got := EvenSizeCrop.Apply(frame)
+	if got.Rect != image.Rect(3, 2, 5, 4) {
+		t.Fatalf("Rect = %v, want %v", got.Rect, image.Rect(3, 2, 5, 4))
+	}
+	if c := got.RGBAAt(4, 3); c.R != 4 || c.G != 3 {
+		t.Errorf("pixel (4, 3) = %v", c)
+	}
+}
+
+func TestEvenSizeModePad(t *testing.T) {
+	// the last column and row are duplicated, from a sub-image to check
+	// the source offsets
+	frame := numberedRGBA(image.Rect(0, 0, 8, 8)).SubImage(image.Rect(3, 2, 6, 5)).(*image.RGBA)
+
+	got := EvenSizePad.Apply(frame)
+	if got.Rect != image.Rect(0, 0, 4, 4) {
+		t.Fatalf("Rect = %v, want %v", got.Rect, image.Rect(0, 0, 4, 4))
+	}
+
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			sx, sy := 3+x, 2+y
+			if sx > 5 {
+				sx = 5
+			}
+			if sy > 4 {
+				sy = 4
+			}
+
+			if c := got.RGBAAt(x, y); c.R != uint8(sx) || c.G != uint8(sy) || c.A != 255 {
+				t.Errorf("pixel (%d, %d) = %v, want the source pixel (%d, %d)", x, y, c, sx, sy)
+			}
+		}
+	}
+}
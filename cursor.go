@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"math"
+
+	"github.com/pion/webrtc/v3"
+)
+
+type CursorMode int
+
+const (
+	CursorModeNone CursorMode = iota
+	CursorModeComposite
+	CursorModeChannel
+)
+
+func (m CursorMode) String() string {
+	switch m {
+	case CursorModeNone:
+		return "none"
+	case CursorModeComposite:
+		return "composite"
+	case CursorModeChannel:
+		return "channel"
+	default:
+		return fmt.Sprintf("CursorMode(%d)", int(m))
+	}
+}
+
+func (m *CursorMode) Set(s string) error {
+	switch s {
+	case "none":
+		*m = CursorModeNone
+	case "composite":
+		*m = CursorModeComposite
+	case "channel":
+		*m = CursorModeChannel
+	default:
+		return fmt.Errorf("unknown cursor mode: %s", s)
+	}
+
+	return nil
+}
+
+func drawCursor(frame *image.RGBA, cursor *Cursor) {
+	origin := frame.Rect.Min.Add(cursor.Position).Sub(cursor.Hotspot)
+	rect := cursor.Image.Rect.Add(origin)
+	draw.Draw(frame, rect, cursor.Image, cursor.Image.Rect.Min, draw.Over)
+}
+
+type CursorMessage struct {
+	Type string `json:"type"`
+	// X and Y locate the hotspot in stream coordinates.
+	X     int     `json:"x"`
+	Y     int     `json:"y"`
+	Scale float64 `json:"scale"`
+	HotX  int     `json:"hotX"`
+	HotY  int     `json:"hotY"`
+	// Image is a PNG data URL, only sent when the cursor shape changes.
+	Image string `json:"image,omitempty"`
+}
+
+type cursorSender struct {
+	channel *webrtc.DataChannel
+	serial  uint
+	last    CursorMessage
+}
+
+// send tells the remote where the cursor is within region of the desktop,
+// which is streamed scaled by scale.
+func (s *cursorSender) send(cursor *Cursor, region image.Rectangle, scale float64) error {
+	if s.channel == nil || s.channel.ReadyState() != webrtc.DataChannelStateOpen {
+		s.serial = 0
+		return nil
+	}
+
+	position := cursor.Position.Sub(region.Min)
+	message := CursorMessage{
+		Type:  "cursor",
+		X:     int(math.Round(float64(position.X) * scale)),
+		Y:     int(math.Round(float64(position.Y) * scale)),
+		Scale: scale,
+		HotX:  cursor.Hotspot.X,
+		HotY:  cursor.Hotspot.Y,
+	}
+
+	if cursor.Serial != s.serial {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, cursor.Image); err != nil {
+			return err
+		}
+		message.Image = "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+	} else if message == s.last {
+		return nil
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	if err := s.channel.SendText(string(data)); err != nil {
+		return err
+	}
+
+	s.serial = cursor.Serial
+	message.Image = ""
+	s.last = message
+	return nil
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type FileOptions struct {
+	// Path is a Y4M file, a directory of PNG images or a dump of raw RGBA
+	// frames, told apart by its extension.
+	Path string
+	// Size is the frame size of raw dumps.
+	Size image.Point
+	// FrameRate applies to PNG directories and raw dumps, Y4M files carry
+	// their own.
+	FrameRate float64
+	Loop      bool
+	// Realtime paces frames at the file frame rate, otherwise every call to
+	// Frame moves to the next frame.
+	Realtime bool
+	// ColorSpace is how Y4M files were converted from RGB.
+	ColorSpace ColorSpace
+}
+
+type fileFrameReader interface {
+	io.Closer
+	// ReadFrame returns the next frame, which is only valid until the next
+	// call, or io.EOF after the last one.
+	ReadFrame() (*image.RGBA, error)
+	// SkipFrame moves past the next frame without decoding it, or returns
+	// io.EOF after the last one.
+	SkipFrame() error
+	Rewind() error
+	FrameRate() float64
+}
+
+// FileFrameProvider plays frames back from a file, for demos and for
+// comparing encoder settings on the same content.
+type FileFrameProvider struct {
+	mutex   sync.Mutex
+	reader  fileFrameReader
+	options FileOptions
+	start   time.Time
+	index   uint64
+	ended   bool
+	current *image.RGBA
+	frames  FramePool
+}
+
+var _ FrameProvider = (*FileFrameProvider)(nil)
+var _ FrameSerialProvider = (*FileFrameProvider)(nil)
+var _ FrameRecycler = (*FileFrameProvider)(nil)
+
+func NewFileFrameProvider(options FileOptions) (*FileFrameProvider, error) {
+	if options.FrameRate <= 0 {
+		options.FrameRate = frameRate
+	}
+
+	info, err := os.Stat(options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var reader fileFrameReader
+	switch {
+	case info.IsDir():
+		reader, err = newPNGFrameReader(options.Path, options.FrameRate)
+	case strings.EqualFold(filepath.Ext(options.Path), ".y4m"):
+		reader, err = newY4MFrameReader(options.Path, options.ColorSpace)
+	default:
+		reader, err = newRawFrameReader(options.Path, options.Size, options.FrameRate)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	provider := FileFrameProvider{
+		reader:  reader,
+		options: options,
+		start:   time.Now(),
+	}
+	return &provider, nil
+}
+
+// target returns how many frames should have been read by now.
+func (p *FileFrameProvider) target(now time.Time) uint64 {
+	if !p.options.Realtime {
+		return p.index + 1
+	}
+
+	return uint64(now.Sub(p.start).Seconds()*p.reader.FrameRate()) + 1
+}
+
+func (p *FileFrameProvider) FrameSerial() uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.ended || !p.options.Realtime {
+		return p.index
+	}
+
+	return p.target(time.Now())
+}
+
+func (p *FileFrameProvider) Frame() (*image.RGBA, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// frames are skipped until catching up with the clock, only the last
+	// one is decoded
+	target := p.target(time.Now())
+	rewound, skipped := false, false
+	for !p.ended && p.index < target {
+		var frame *image.RGBA
+		var err error
+		if p.index+1 < target && p.current != nil {
+			err = p.reader.SkipFrame()
+		} else {
+			frame, err = p.reader.ReadFrame()
+		}
+		if errors.Is(err, io.EOF) {
+			if !p.options.Loop || rewound {
+				p.ended = true
+				if skipped {
+					if err := p.readLast(); err != nil {
+						return nil, err
+					}
+				}
+				break
+			}
+
+			if err := p.reader.Rewind(); err != nil {
+				return nil, err
+			}
+			rewound = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if frame != nil {
+			p.current = frame
+		}
+		p.index++
+		rewound, skipped = false, frame == nil
+	}
+
+	if p.current == nil {
+		return nil, errors.New("no frames in " + p.options.Path)
+	}
+
+	// the frames are drawn on downstream, so the reader's buffer is copied
+	frame := p.frames.Get(p.current.Rect)
+	copy(frame.Pix, p.current.Pix)
+
+	return frame, nil
+}
+
+// readLast decodes the last frame of the file after it was skipped, when
+// playback ended it's the one shown from then on.
+func (p *FileFrameProvider) readLast() error {
+	if err := p.reader.Rewind(); err != nil {
+		return err
+	}
+	for i := uint64(1); i < p.index; i++ {
+		if err := p.reader.SkipFrame(); err != nil {
+			return err
+		}
+	}
+
+	frame, err := p.reader.ReadFrame()
+	if err != nil {
+		return err
+	}
+	p.current = frame
+	return nil
+}
+
+func (p *FileFrameProvider) Recycle(frame *image.RGBA) {
+	p.frames.Put(frame)
+}
+
+func (p *FileFrameProvider) Close() error {
+	return p.reader.Close()
+}
+
+type FileFrameProviderFactory struct {
+	Options FileOptions
+}
+
+var _ FrameProviderFactory = (*FileFrameProviderFactory)(nil)
+
+func (f *FileFrameProviderFactory) NewFrameProvider() (FrameProvider, error) {
+	return NewFileFrameProvider(f.Options)
+}
+
+type pngFrameReader struct {
+	names     []string
+	next      int
+	frameRate float64
+	frame     *image.RGBA
+}
+
+func newPNGFrameReader(dir string, frameRate float64) (*pngFrameReader, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*.png"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no PNG images in %s", dir)
+	}
+	sort.Strings(names)
+
+	reader := pngFrameReader{
+		names:     names,
+		frameRate: frameRate,
+	}
+	return &reader, nil
+}
+
+func (r *pngFrameReader) ReadFrame() (*image.RGBA, error) {
+	if r.next >= len(r.names) {
+		return nil, io.EOF
+	}
+
+	file, err := os.Open(r.names[r.next])
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, err := png.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", r.names[r.next], err)
+	}
+	r.next++
+
+	rect := img.Bounds().Sub(img.Bounds().Min)
+	if r.frame == nil || r.frame.Rect != rect {
+		r.frame = image.NewRGBA(rect)
+	}
+	draw.Draw(r.frame, rect, img, img.Bounds().Min, draw.Src)
+
+	return r.frame, nil
+}
+
+func (r *pngFrameReader) SkipFrame() error {
+	if r.next >= len(r.names) {
+		return io.EOF
+	}
+
+	r.next++
+	return nil
+}
+
+func (r *pngFrameReader) Rewind() error {
+	r.next = 0
+	return nil
+}
+
+func (r *pngFrameReader) FrameRate() float64 {
+	return r.frameRate
+}
+
+func (r *pngFrameReader) Close() error {
+	return nil
+}
+
+type rawFrameReader struct {
+	file      *os.File
+	reader    *bufio.Reader
+	frameRate float64
+	frame     *image.RGBA
+	// next is read into, so a truncated frame doesn't overwrite the last one
+	next *image.RGBA
+}
+
+func newRawFrameReader(name string, size image.Point, frameRate float64) (*rawFrameReader, error) {
+	if size.X <= 0 || size.Y <= 0 {
+		return nil, errors.New("raw frame dumps need a frame size")
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := rawFrameReader{
+		file:      file,
+		reader:    bufio.NewReader(file),
+		frameRate: frameRate,
+		frame:     image.NewRGBA(image.Rect(0, 0, size.X, size.Y)),
+		next:      image.NewRGBA(image.Rect(0, 0, size.X, size.Y)),
+	}
+	return &reader, nil
+}
+
+func (r *rawFrameReader) ReadFrame() (*image.RGBA, error) {
+	// a truncated last frame is dropped
+	if _, err := io.ReadFull(r.reader, r.next.Pix); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	r.frame, r.next = r.next, r.frame
+	return r.frame, nil
+}
+
+func (r *rawFrameReader) SkipFrame() error {
+	// a truncated last frame is dropped, Discard returns io.EOF for it
+	_, err := r.reader.Discard(len(r.frame.Pix))
+	return err
+}
+
+func (r *rawFrameReader) Rewind() error {
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	r.reader.Reset(r.file)
+	return nil
+}
+
+func (r *rawFrameReader) FrameRate() float64 {
+	return r.frameRate
+}
+
+func (r *rawFrameReader) Close() error {
+	return r.file.Close()
+}
+
+type y4mFrameReader struct {
+	file       *os.File
+	reader     *bufio.Reader
+	dataOffset int64
+	frameRate  float64
+	colorSpace ColorSpace
+	mono       bool
+	ycbcr      *image.YCbCr
+	frame      *image.RGBA
+}
+
+func newY4MFrameReader(name string, colorSpace ColorSpace) (*y4mFrameReader, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := y4mFrameReader{
+		file:       file,
+		reader:     bufio.NewReader(file),
+		frameRate:  frameRate,
+		colorSpace: colorSpace,
+	}
+	if err := reader.readHeader(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+
+	return &reader, nil
+}
+
+func (r *y4mFrameReader) readHeader() error {
+	line, err := r.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	r.dataOffset = int64(len(line))
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != "YUV4MPEG2" {
+		return errors.New("not a YUV4MPEG2 file")
+	}
+
+	var width, height int
+	ratio := image.YCbCrSubsampleRatio420
+	for _, field := range fields[1:] {
+		value := field[1:]
+		switch field[0] {
+		case 'W':
+			width, err = strconv.Atoi(value)
+		case 'H':
+			height, err = strconv.Atoi(value)
+		case 'F':
+			var num, den float64
+			if _, err = fmt.Sscanf(value, "%g:%g", &num, &den); err == nil && num > 0 && den > 0 {
+				r.frameRate = num / den
+			}
+		case 'C':
+			switch {
+			case value == "420" || value == "420jpeg" || value == "420mpeg2" || value == "420paldv":
+				ratio = image.YCbCrSubsampleRatio420
+			case value == "422":
+				ratio = image.YCbCrSubsampleRatio422
+			case value == "444":
+				ratio = image.YCbCrSubsampleRatio444
+			case value == "mono":
+				r.mono = true
+			default:
+				return fmt.Errorf("unsupported colorspace: %s", value)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid header field %q: %w", field, err)
+		}
+	}
+	if width <= 0 || height <= 0 {
+		return errors.New("missing frame size")
+	}
+
+	rect := image.Rect(0, 0, width, height)
+	r.ycbcr = image.NewYCbCr(rect, ratio)
+	r.frame = image.NewRGBA(rect)
+	if r.mono {
+		for i := range r.ycbcr.Cb {
+			r.ycbcr.Cb[i] = 128
+			r.ycbcr.Cr[i] = 128
+		}
+	}
+
+	return nil
+}
+
+func (r *y4mFrameReader) readFrameHeader() error {
+	line, err := r.reader.ReadString('\n')
+	if errors.Is(err, io.EOF) && line == "" {
+		return io.EOF
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "FRAME") {
+		return fmt.Errorf("invalid frame header: %q", line)
+	}
+	return nil
+}
+
+func (r *y4mFrameReader) ReadFrame() (*image.RGBA, error) {
+	if err := r.readFrameHeader(); err != nil {
+		return nil, err
+	}
+
+	planes := [][]byte{r.ycbcr.Y}
+	if !r.mono {
+		planes = append(planes, r.ycbcr.Cb, r.ycbcr.Cr)
+	}
+	for _, plane := range planes {
+		if _, err := io.ReadFull(r.reader, plane); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+	}
+
+	ycbcrToRGBA(r.ycbcr, r.frame, r.colorSpace)
+	return r.frame, nil
+}
+
+func (r *y4mFrameReader) SkipFrame() error {
+	if err := r.readFrameHeader(); err != nil {
+		return err
+	}
+
+	size := len(r.ycbcr.Y)
+	if !r.mono {
+		size += len(r.ycbcr.Cb) + len(r.ycbcr.Cr)
+	}
+	_, err := r.reader.Discard(size)
+	return err
+}
+
+func (r *y4mFrameReader) Rewind() error {
+	if _, err := r.file.Seek(r.dataOffset, io.SeekStart); err != nil {
+		return err
+	}
+
+	r.reader.Reset(r.file)
+	return nil
+}
+
+func (r *y4mFrameReader) FrameRate() float64 {
+	return r.frameRate
+}
+
+func (r *y4mFrameReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeY4M writes uniform frames with the chroma subsampling given as the
+// Y4M C parameter.
+func writeY4M(t *testing.T, size image.Point, chroma string, frames ...color.RGBA) string {
+	t.Helper()
+
+	chromaSize := size
+	switch chroma {
+	case "420":
+		chromaSize = image.Pt((size.X+1)/2, (size.Y+1)/2)
+	case "422":
+		chromaSize = image.Pt((size.X+1)/2, size.Y)
+	}
+
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "YUV4MPEG2 W%d H%d F10:1 Ip A1:1 C%s\n", size.X, size.Y, chroma)
+	for _, c := range frames {
+		ycbcr := RGBAToYCbCr(uniformRGBA(image.Pt(2, 2), c), ColorSpace{})
+		data.WriteString("FRAME\n")
+		data.Write(bytes.Repeat(ycbcr.Y[:1], size.X*size.Y))
+		if chroma != "mono" {
+			data.Write(bytes.Repeat(ycbcr.Cb[:1], chromaSize.X*chromaSize.Y))
+			data.Write(bytes.Repeat(ycbcr.Cr[:1], chromaSize.X*chromaSize.Y))
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "video.y4m")
+	if err := os.WriteFile(path, data.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writePNGs writes one image per frame, a nil color writes a file that
+// isn't a PNG.
+func writePNGs(t *testing.T, size image.Point, frames ...*color.RGBA) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	for i, c := range frames {
+		var data bytes.Buffer
+		if c == nil {
+			data.WriteString("not a PNG")
+		} else if err := png.Encode(&data, uniformRGBA(size, *c)); err != nil {
+			t.Fatal(err)
+		}
+
+		// names sort by frame number, not by length
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("frame%03d.png", i)), data.Bytes(), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a frame"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// writeRaw writes RGBA frames followed by extra bytes, like a dump cut off
+// in the middle of a frame.
+func writeRaw(t *testing.T, size image.Point, extra int, frames ...color.RGBA) string {
+	t.Helper()
+
+	var data []byte
+	for _, c := range frames {
+		data = append(data, uniformRGBA(size, c).Pix...)
+	}
+	data = append(data, make([]byte, extra)...)
+
+	path := filepath.Join(t.TempDir(), "video.rgba")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func checkFileFrame(t *testing.T, provider *FileFrameProvider, size image.Point, want color.RGBA) {
+	t.Helper()
+
+	frame, err := provider.Frame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Recycle(frame)
+
+	if frame.Rect != (image.Rectangle{Max: size}) {
+		t.Fatalf("Rect = %v, want %v", frame.Rect, image.Rectangle{Max: size})
+	}
+	for _, p := range []image.Point{{}, size.Sub(image.Pt(1, 1))} {
+		got := frame.RGBAAt(p.X, p.Y)
+		if absDiff(got.R, want.R) > 2 || absDiff(got.G, want.G) > 2 || absDiff(got.B, want.B) > 2 || got.A != 255 {
+			t.Fatalf("pixel %v = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestFileFrameProvider(t *testing.T) {
+	size := image.Pt(6, 4)
+
+	tests := []struct {
+		name      string
+		options   FileOptions
+		frames    []color.RGBA
+		frameRate float64
+	}{
+		{
+			name:      "y4m 420",
+			options:   FileOptions{Path: writeY4M(t, size, "420", red, green, blue)},
+			frames:    []color.RGBA{red, green, blue},
+			frameRate: 10,
+		},
+		{
+			name:      "y4m 422",
+			options:   FileOptions{Path: writeY4M(t, size, "422", red, green, blue)},
+			frames:    []color.RGBA{red, green, blue},
+			frameRate: 10,
+		},
+		{
+			name:      "y4m 444",
+			options:   FileOptions{Path: writeY4M(t, size, "444", red, green, blue)},
+			frames:    []color.RGBA{red, green, blue},
+			frameRate: 10,
+		},
+		{
+			name:      "y4m mono",
+			options:   FileOptions{Path: writeY4M(t, size, "mono", black, white, gray)},
+			frames:    []color.RGBA{black, white, gray},
+			frameRate: 10,
+		},
+		{
+			name:      "y4m odd size",
+			options:   FileOptions{Path: writeY4M(t, image.Pt(5, 3), "420", red, blue)},
+			frames:    []color.RGBA{red, blue},
+			frameRate: 10,
+		},
+		{
+			name:      "png",
+			options:   FileOptions{Path: writePNGs(t, size, &red, &green, &blue), FrameRate: 5},
+			frames:    []color.RGBA{red, green, blue},
+			frameRate: 5,
+		},
+		{
+			name:      "raw",
+			options:   FileOptions{Path: writeRaw(t, size, 10, red, green, blue), Size: size},
+			frames:    []color.RGBA{red, green, blue},
+			frameRate: frameRate,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider, err := NewFileFrameProvider(test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer provider.Close()
+
+			if rate := provider.reader.FrameRate(); rate != test.frameRate {
+				t.Errorf("FrameRate = %g, want %g", rate, test.frameRate)
+			}
+
+			frameSize := size
+			if strings.Contains(test.name, "odd") {
+				frameSize = image.Pt(5, 3)
+			}
+			for _, c := range test.frames {
+				checkFileFrame(t, provider, frameSize, c)
+			}
+
+			// without looping the last frame stays
+			checkFileFrame(t, provider, frameSize, test.frames[len(test.frames)-1])
+			if serial := provider.FrameSerial(); serial != uint64(len(test.frames)) {
+				t.Errorf("FrameSerial = %d, want %d", serial, len(test.frames))
+			}
+		})
+	}
+}
+
+func TestFileFrameProviderLoop(t *testing.T) {
+	size := image.Pt(4, 2)
+
+	for _, path := range []string{
+		writeY4M(t, size, "420", red, green, blue),
+		writePNGs(t, size, &red, &green, &blue),
+		writeRaw(t, size, 3, red, green, blue),
+	} {
+		provider, err := NewFileFrameProvider(FileOptions{Path: path, Size: size, Loop: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range []color.RGBA{red, green, blue, red, green, blue, red} {
+			checkFileFrame(t, provider, size, c)
+		}
+		if serial := provider.FrameSerial(); serial != 7 {
+			t.Errorf("%s: FrameSerial = %d, want 7", path, serial)
+		}
+
+		provider.Close()
+	}
+}
+
+func TestFileFrameProviderRealtime(t *testing.T) {
+	size := image.Pt(4, 2)
+
+	// the frames that are dropped can't be decoded, so they must be
+	// skipped before decoding
+	path := writePNGs(t, size, &red, nil, nil, &green, nil, &blue)
+	provider, err := NewFileFrameProvider(FileOptions{Path: path, FrameRate: 5, Realtime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+
+	// halfway through the fourth frame, only the first and the fourth are
+	// decoded
+	provider.start = time.Now().Add(-700 * time.Millisecond)
+	checkFileFrame(t, provider, size, green)
+	if serial := provider.FrameSerial(); serial != 4 {
+		t.Errorf("FrameSerial = %d, want 4", serial)
+	}
+
+	// long past the end the last frame is decoded, even though it was
+	// skipped while catching up
+	provider.start = time.Now().Add(-time.Minute)
+	checkFileFrame(t, provider, size, blue)
+	if serial := provider.FrameSerial(); serial != 6 {
+		t.Errorf("FrameSerial after the end = %d, want 6", serial)
+	}
+
+	// a frame that has to be shown is decoded, and fails
+	provider, err = NewFileFrameProvider(FileOptions{Path: writePNGs(t, size, &red, nil), FrameRate: 10, Realtime: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	checkFileFrame(t, provider, size, red)
+	provider.start = time.Now().Add(-150 * time.Millisecond)
+	if _, err := provider.Frame(); err == nil {
+		t.Error("corrupt PNG decoded")
+	}
+}
+
+func TestFileFrameProviderErrors(t *testing.T) {
+	dir := t.TempDir()
+	y4m := func(header string) string {
+		path := filepath.Join(dir, fmt.Sprintf("%d.y4m", len(header)))
+		if err := os.WriteFile(path, []byte(header), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name    string
+		options FileOptions
+		err     string
+	}{
+		{"missing", FileOptions{Path: filepath.Join(dir, "missing.y4m")}, "no such file"},
+		{"not y4m", FileOptions{Path: y4m("RIFF\n")}, "not a YUV4MPEG2 file"},
+		{"no size", FileOptions{Path: y4m("YUV4MPEG2 W4\n")}, "missing frame size"},
+		{"bad width", FileOptions{Path: y4m("YUV4MPEG2 Wfour H2\n")}, "invalid header field"},
+		{"colorspace", FileOptions{Path: y4m("YUV4MPEG2 W4 H2 C411\n")}, "unsupported colorspace"},
+		{"empty directory", FileOptions{Path: t.TempDir()}, "no PNG images"},
+		{"raw without size", FileOptions{Path: writeRaw(t, image.Pt(2, 2), 0, red)}, "need a frame size"},
+	}
+
+	for _, test := range tests {
+		provider, err := NewFileFrameProvider(test.options)
+		if err == nil {
+			provider.Close()
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.err)
+		}
+	}
+
+	// a file shorter than a frame has no frames
+	provider, err := NewFileFrameProvider(FileOptions{Path: writeRaw(t, image.Pt(2, 2), 15), Size: image.Pt(2, 2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	if _, err := provider.Frame(); err == nil || !strings.Contains(err.Error(), "no frames") {
+		t.Errorf("Frame = %v, want no frames", err)
+	}
+}
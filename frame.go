@@ -3,6 +3,8 @@ package main
 import (
 	"image"
 	"io"
+	"sync"
+	"time"
 )
 
 type FrameProvider interface {
@@ -10,6 +12,83 @@ type FrameProvider interface {
 	Frame() (*image.RGBA, error)
 }
 
+// FrameSerialProvider is implemented by frame providers that can tell
+// whether the screen changed, the serial only moves when it did.
+type FrameSerialProvider interface {
+	FrameSerial() uint64
+}
+
+type FrameUpdate struct {
+	Serial uint64
+	Time   time.Time
+}
+
+// FrameNotifier is implemented by frame providers that can tell when new
+// pixels arrive, the channel only holds the latest update.
+type FrameNotifier interface {
+	FrameUpdates() <-chan FrameUpdate
+}
+
+// notifyFrameUpdate replaces whatever update is still waiting in updates,
+// without ever blocking the sender.
+func notifyFrameUpdate(updates chan FrameUpdate, update FrameUpdate) {
+	for {
+		select {
+		case updates <- update:
+			return
+		default:
+		}
+
+		select {
+		case <-updates:
+		default:
+		}
+	}
+}
+
+// FrameRecycler is implemented by frame providers that can reuse the
+// buffers of frames that aren't used anymore.
+type FrameRecycler interface {
+	Recycle(frame *image.RGBA)
+}
+
+// FrameFailureNotifier is implemented by frame providers that can stop on
+// their own, like clients losing their connection. Done is closed once they
+// did and Err tells why.
+type FrameFailureNotifier interface {
+	Done() <-chan struct{}
+	Err() error
+}
+
+// FramePool keeps frame buffers around between frames of the same size.
+type FramePool struct {
+	pool sync.Pool
+}
+
+func (p *FramePool) Get(rect image.Rectangle) *image.RGBA {
+	if frame, ok := p.pool.Get().(*image.RGBA); ok && frame.Rect == rect {
+		return frame
+	}
+
+	return image.NewRGBA(rect)
+}
+
+func (p *FramePool) Put(frame *image.RGBA) {
+	p.pool.Put(frame)
+}
+
 type FrameProviderFactory interface {
 	NewFrameProvider() (FrameProvider, error)
 }
+
+type Cursor struct {
+	Image    *image.RGBA
+	Hotspot  image.Point
+	Position image.Point
+	// Serial changes whenever Image does.
+	Serial uint
+}
+
+type CursorProvider interface {
+	Cursor() (*Cursor, bool)
+}
@@ -2,10 +2,197 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"image"
 	"log"
+	"net/http"
+	"os"
 )
 
 func main() {
+	source := flag.String("source", defaultSource, "where frames come from, vnc (unless built with the novnc tag), rfb (the cgo free VNC client), x11, testpattern, file or mosaic")
+	addr := flag.String("addr", "", "VNC server address for -source vnc and rfb, as HOST[:PORT], unix:PATH, listen:[HOST:]PORT to wait for a reverse connection, ssh://[USER@]BASTION[:PORT]/ADDR to tunnel through SSH, or a ws:// or wss:// websockify URL, defaults to 127.0.0.1:5901")
+	password := flag.String("password", os.Getenv("VNC_PASSWORD"), "VNC password for -source vnc, rfb and mosaic, defaults to $VNC_PASSWORD")
+	display := flag.String("display", "", "X11 display to capture with -source x11, defaults to $DISPLAY")
+
+	var tls VNCTLSOptions
+	flag.BoolVar(&tls.Required, "tls", false, "refuse VNC servers without a TLS security type, VeNCrypt or AnonTLS, with -source vnc; without -tls-ca the server isn't authenticated")
+	flag.StringVar(&tls.CAFile, "tls-ca", "", "CA certificates to verify VeNCrypt X509 servers with, refusing other security types")
+	flag.StringVar(&tls.CRLFile, "tls-crl", "", "certificate revocation list to check VeNCrypt X509 servers against")
+	flag.StringVar(&tls.CertFile, "tls-cert", "", "client certificate for VeNCrypt X509 servers asking for one")
+	flag.StringVar(&tls.KeyFile, "tls-key", "", "client certificate key")
+	flag.StringVar(&tls.Username, "username", "", "user name for VeNCrypt Plain authentication")
+
+	var ssh SSHOptions
+	flag.StringVar(&ssh.KeyFile, "ssh-key", "", "private key for ssh:// addresses, by default the SSH agent and the keys in ~/.ssh are tried")
+	flag.StringVar(&ssh.KnownHostsFile, "ssh-known-hosts", "", "known hosts to verify SSH bastions against, defaults to ~/.ssh/known_hosts")
+
+	webSocket := WebSocketOptions{
+		Header: make(http.Header),
+	}
+	flag.Var(HTTPHeader(webSocket.Header), "ws-header", "HTTP header sent to ws:// and wss:// addresses, as \"Name: value\", like a Cookie or Authorization, can be repeated")
+	flag.StringVar(&webSocket.CAFile, "ws-ca", "", "CA certificates to verify wss:// servers with instead of the system ones")
+	flag.BoolVar(&webSocket.InsecureSkipVerify, "ws-insecure", false, "skip verifying wss:// server certificates")
+
+	testPattern := TestPatternOptions{
+		Size:      image.Pt(1280, 720),
+		FrameRate: frameRate,
+	}
+	flag.Var((*FrameSize)(&testPattern.Size), "pattern-size", "test pattern size, as WIDTHxHEIGHT")
+	flag.Float64Var(&testPattern.FrameRate, "pattern-rate", frameRate, "test pattern frame rate")
+
+	var file FileOptions
+	flag.StringVar(&file.Path, "file", "", "Y4M file, directory of PNG images or raw RGBA dump to play with -source file")
+	flag.Var((*FrameSize)(&file.Size), "file-size", "frame size of raw RGBA dumps, as WIDTHxHEIGHT")
+	flag.Float64Var(&file.FrameRate, "file-rate", frameRate, "frame rate of PNG directories and raw RGBA dumps")
+	flag.BoolVar(&file.Loop, "file-loop", true, "start over at the end of the file")
+	flag.BoolVar(&file.Realtime, "file-realtime", true, "play at the file frame rate instead of as fast as frames are encoded")
+
+	var mosaic MosaicOptions
+	flag.Var(&mosaic.Sources, "mosaic", "VNC server to show with -source mosaic, as [LABEL=]ADDR with ADDR like -addr, can be repeated")
+	flag.IntVar(&mosaic.Columns, "mosaic-columns", 0, "mosaic grid columns, 0 to keep it roughly square")
+	mosaic.TileSize = image.Pt(640, 360)
+	flag.Var((*FrameSize)(&mosaic.TileSize), "mosaic-tile", "mosaic tile size, as WIDTHxHEIGHT")
+
+	audioSource := flag.String("audio", "", "where audio comes from, pulse (PulseAudio or PipeWire), alsa, file or vnc (QEMU's VNC audio extension, with -source vnc), empty for no audio")
+	audioDevice := flag.String("audio-device", "", "PulseAudio source or ALSA device to capture, defaults to the desktop output monitor or the default ALSA device")
+	audioFile := AudioFileOptions{
+		Format: defaultAudioFormat,
+	}
+	flag.StringVar(&audioFile.Path, "audio-file", "", "WAV file or raw signed 16-bit little endian PCM to play with -audio file")
+	flag.BoolVar(&audioFile.Loop, "audio-file-loop", true, "start the audio file over at the end")
+	flag.IntVar(&audioFile.Format.SampleRate, "audio-rate", defaultAudioFormat.SampleRate, "sample rate to capture at, and of raw PCM files")
+	flag.IntVar(&audioFile.Format.Channels, "audio-channels", defaultAudioFormat.Channels, "channels to capture, and of raw PCM files, 1 or 2")
+	audioBitrate := flag.Uint("audio-bitrate", defaultAudioBitrate, "Opus bitrate in kbps")
+
+	keyFrameInterval := flag.Uint("keyframe-interval", 0, "force a key frame every N frames, 0 to only send key frames on PLI/FIR")
+	temporalLayers := flag.Uint("temporal-layers", 1, "number of VP8 temporal layers, from 1 to 3")
+	simulcast := flag.Bool("simulcast", false, "publish full, half and quarter resolution encodings for SFUs")
+
+	var colorSpace ColorSpace
+	flag.Var(&colorSpace.Matrix, "color-matrix", "YUV to RGB matrix of Y4M files for -source file, bt601 or bt709. VP8 is always sent as limited range BT.601, the only color space its decoders know")
+	flag.BoolVar(&colorSpace.FullRange, "full-range", false, "Y4M files for -source file are full range YUV instead of limited range")
+
+	var crop Crop
+	flag.Var(&crop, "crop", "only stream this region of the desktop, as WIDTHxHEIGHT+X+Y")
+
+	var masks Masks
+	flag.Var(&masks, "mask", "redact this region of the desktop, as WIDTHxHEIGHT+X+Y with an optional :fill or :pixelate suffix, can be repeated")
+
+	var scale ScaleOptions
+	flag.IntVar(&scale.MaxWidth, "max-width", 0, "downscale frames wider than this, 0 for no limit")
+	flag.IntVar(&scale.MaxHeight, "max-height", 0, "downscale frames taller than this, 0 for no limit")
+	flag.Float64Var(&scale.Factor, "scale", 0, "scale frames by this factor before applying -max-width and -max-height")
+	flag.Var(&scale.Filter, "scale-filter", "scaling filter, bilinear, area or lanczos")
+
+	var evenSize EvenSizeMode
+	flag.Var(&evenSize, "even-size", "make odd frame sizes even for picky decoders, none, crop or pad, padded frames get their real size sent on the control channel")
+
+	var cursor CursorMode
+	flag.Var(&cursor, "cursor", "how to show the remote cursor, none, composite or channel")
+
+	var overlayOptions OverlayOptions
+	flag.BoolVar(&overlayOptions.Hostname, "overlay-hostname", false, "draw the host name over the video")
+	flag.BoolVar(&overlayOptions.Timestamp, "overlay-timestamp", false, "draw the wall-clock time over the video")
+	flag.StringVar(&overlayOptions.SessionID, "overlay-session", "", "draw this session id over the video")
+	flag.StringVar(&overlayOptions.Text, "overlay-text", "", "draw this text over the video")
+	overlayLogo := flag.String("overlay-logo", "", "draw this PNG image over the video")
+	flag.Var(&overlayOptions.Position, "overlay-position", "overlay corner, top-left, top-right, bottom-left or bottom-right")
+	flag.Float64Var(&overlayOptions.FontSize, "overlay-font-size", defaultOverlayFontSize, "overlay font size in pixels")
+	overlayOptions.Opacity = flag.Float64("overlay-opacity", 1, "overlay opacity, from 0 to 1")
+
+	flag.Parse()
+
+	if *overlayLogo != "" {
+		logo, err := loadPNG(*overlayLogo)
+		if err != nil {
+			log.Panic(err)
+		}
+		overlayOptions.Logo = logo
+	}
+
+	overlay, err := NewOverlay(overlayOptions)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var frameProviderFactory FrameProviderFactory
+	switch *source {
+	case "vnc":
+		frameProviderFactory = &VNCFrameProviderFactory{
+			Options: VNCOptions{
+				Addr:         *addr,
+				Password:     *password,
+				RemoteCursor: cursor != CursorModeNone,
+				Audio:        *audioSource == "vnc",
+				TLS:          tls,
+				SSH:          ssh,
+				WebSocket:    webSocket,
+			},
+		}
+	case "rfb":
+		frameProviderFactory = &RFBFrameProviderFactory{
+			Options: RFBOptions{
+				Addr:         *addr,
+				Password:     *password,
+				RemoteCursor: cursor != CursorModeNone,
+				SSH:          ssh,
+				WebSocket:    webSocket,
+			},
+		}
+	case "x11":
+		frameProviderFactory = &X11FrameProviderFactory{
+			Display: *display,
+		}
+	case "testpattern":
+		frameProviderFactory = &TestPatternFrameProviderFactory{
+			Options: testPattern,
+		}
+	case "file":
+		file.ColorSpace = colorSpace
+		frameProviderFactory = &FileFrameProviderFactory{
+			Options: file,
+		}
+	case "mosaic":
+		for _, source := range mosaic.Sources {
+			factory, ok := source.Factory.(*RFBFrameProviderFactory)
+			if !ok {
+				continue
+			}
+			factory.Options.Password = *password
+			factory.Options.SSH = ssh
+			factory.Options.WebSocket = webSocket
+		}
+		frameProviderFactory = &MosaicFrameProviderFactory{
+			Options: mosaic,
+		}
+	default:
+		log.Panicf("unknown source: %s", *source)
+	}
+
+	var audio AudioProviderFactory
+	switch *audioSource {
+	case "":
+	case "pulse":
+		audio = &PulseAudioProviderFactory{
+			Device: *audioDevice,
+			Format: audioFile.Format,
+		}
+	case "alsa":
+		audio = &ALSAAudioProviderFactory{
+			Device: *audioDevice,
+			Format: audioFile.Format,
+		}
+	case "file":
+		audio = &AudioFileProviderFactory{
+			Options: audioFile,
+		}
+	case "vnc":
+		audio = FrameProviderAudio
+	default:
+		log.Panicf("unknown audio source: %s", *audioSource)
+	}
+
 	room, err := NewRoom()
 	if err != nil {
 		log.Panic(err)
@@ -20,7 +207,23 @@ func main() {
 		log.Panic(errs)
 	}
 
-	peer, err := NewPeer(&VNCFrameProviderFactory{}, config)
+	peer, err := NewPeer(frameProviderFactory, config, PeerOptions{
+		Encoder: VP8EncoderOptions{
+			KeyFrameInterval: *keyFrameInterval,
+			TemporalLayers:   *temporalLayers,
+		},
+		Crop:      &crop,
+		Masks:     &masks,
+		Scale:     scale,
+		EvenSize:  evenSize,
+		Cursor:    cursor,
+		Overlay:   overlay,
+		Simulcast: *simulcast,
+		Audio:     audio,
+		AudioEncoder: OpusEncoderOptions{
+			Bitrate: *audioBitrate,
+		},
+	})
 	if err != nil {
 		log.Panic(err)
 	}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultMaskBlockSize = 16
+)
+
+type MaskStyle int
+
+const (
+	MaskStyleFill MaskStyle = iota
+	MaskStylePixelate
+)
+
+func (s MaskStyle) String() string {
+	switch s {
+	case MaskStyleFill:
+		return "fill"
+	case MaskStylePixelate:
+		return "pixelate"
+	default:
+		return fmt.Sprintf("MaskStyle(%d)", int(s))
+	}
+}
+
+func (s *MaskStyle) Set(v string) error {
+	switch v {
+	case "fill":
+		*s = MaskStyleFill
+	case "pixelate":
+		*s = MaskStylePixelate
+	default:
+		return fmt.Errorf("unknown mask style: %s", v)
+	}
+
+	return nil
+}
+
+type Mask struct {
+	// Rect is in framebuffer coordinates, before cropping and scaling.
+	Rect  image.Rectangle
+	Style MaskStyle
+	Color color.RGBA
+	// BlockSize is the pixelation block size, zero means defaultMaskBlockSize.
+	BlockSize int
+}
+
+func (m Mask) apply(frame *image.RGBA) {
+	rect := m.Rect.Add(frame.Rect.Min).Intersect(frame.Rect)
+	if rect.Empty() {
+		return
+	}
+
+	if m.Style == MaskStyleFill {
+		draw.Draw(frame, rect, image.NewUniform(m.Color), image.Point{}, draw.Src)
+		return
+	}
+
+	size := m.BlockSize
+	if size <= 0 {
+		size = defaultMaskBlockSize
+	}
+
+	for y := rect.Min.Y; y < rect.Max.Y; y += size {
+		for x := rect.Min.X; x < rect.Max.X; x += size {
+			block := image.Rect(x, y, x+size, y+size).Intersect(rect)
+
+			var r, g, b, a, n int
+			for by := block.Min.Y; by < block.Max.Y; by++ {
+				row := frame.Pix[frame.PixOffset(block.Min.X, by):frame.PixOffset(block.Max.X, by)]
+				for i := 0; i < len(row); i += 4 {
+					r += int(row[i])
+					g += int(row[i+1])
+					b += int(row[i+2])
+					a += int(row[i+3])
+				}
+				n += block.Dx()
+			}
+
+			average := color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)}
+			draw.Draw(frame, block, image.NewUniform(average), image.Point{}, draw.Src)
+		}
+	}
+}
+
+// Masks redacts regions of the frames before they reach the encoder, masks
+// can be added and removed while frames are flowing.
+type Masks struct {
+	mutex    sync.Mutex
+	masks    map[string]Mask
+	revision uint
+}
+
+func (m *Masks) Get(id string) (Mask, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mask, ok := m.masks[id]
+	return mask, ok
+}
+
+// IDs returns the ids of the current masks, sorted.
+func (m *Masks) IDs() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	ids := make([]string, 0, len(m.masks))
+	for id := range m.masks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Put adds a mask, replacing any other with the same id.
+func (m *Masks) Put(id string, mask Mask) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.masks == nil {
+		m.masks = make(map[string]Mask)
+	}
+	mask.Rect = mask.Rect.Canon()
+	m.masks[id] = mask
+	m.revision++
+}
+
+func (m *Masks) Remove(id string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.masks, id)
+	m.revision++
+}
+
+func (m *Masks) Clear() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.masks = nil
+	m.revision++
+}
+
+// Revision changes whenever a mask is added or removed.
+func (m *Masks) Revision() uint {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.revision
+}
+
+func (m *Masks) Apply(frame *image.RGBA) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, mask := range m.masks {
+		mask.apply(frame)
+	}
+}
+
+func (m *Masks) String() string {
+	var masks []string
+	for _, id := range m.IDs() {
+		mask, _ := m.Get(id)
+		rect := mask.Rect
+		masks = append(masks, fmt.Sprintf("%dx%d+%d+%d:%s", rect.Dx(), rect.Dy(), rect.Min.X, rect.Min.Y, mask.Style))
+	}
+	return strings.Join(masks, ",")
+}
+
+// Set adds a mask given as WIDTHxHEIGHT+X+Y, optionally followed by :fill
+// or :pixelate, so the flag can be repeated.
+func (m *Masks) Set(s string) error {
+	geometry, style, _ := strings.Cut(s, ":")
+
+	var w, h, x, y int
+	if _, err := fmt.Sscanf(geometry, "%dx%d+%d+%d", &w, &h, &x, &y); err != nil {
+		return fmt.Errorf("invalid geometry %q: %w", geometry, err)
+	}
+	if w <= 0 || h <= 0 || x < 0 || y < 0 {
+		return fmt.Errorf("invalid geometry %q", geometry)
+	}
+
+	mask := Mask{
+		Rect:  image.Rect(x, y, x+w, y+h),
+		Color: color.RGBA{0, 0, 0, 255},
+	}
+	if style != "" {
+		if err := mask.Style.Set(style); err != nil {
+			return err
+		}
+	}
+
+	m.Put(strconv.Itoa(len(m.IDs())+1), mask)
+	return nil
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	mosaicRetryInterval = 5 * time.Second
+)
+
+type MosaicSource struct {
+	Label   string
+	Factory FrameProviderFactory
+}
+
+// MosaicSources is a repeatable [LABEL=]ADDR command line value, with
+// addresses as in RFBOptions.Addr. The servers are read by the native RFB
+// client, libvncclient only handles one connection per process.
+type MosaicSources []MosaicSource
+
+func (s *MosaicSources) String() string {
+	var sources []string
+	for _, source := range *s {
+		sources = append(sources, source.Label)
+	}
+	return strings.Join(sources, ",")
+}
+
+func (s *MosaicSources) Set(v string) error {
+	label, addr, ok := strings.Cut(v, "=")
+	if !ok {
+		label, addr = "", v
+	}
+	if addr == "" {
+		return fmt.Errorf("invalid mosaic source %q", v)
+	}
+	if label == "" {
+		label = addr
+	}
+
+	*s = append(*s, MosaicSource{
+		Label: label,
+		Factory: &RFBFrameProviderFactory{
+			Options: RFBOptions{
+				Addr: addr,
+			},
+		},
+	})
+	return nil
+}
+
+type MosaicOptions struct {
+	Sources MosaicSources
+	// Columns of the grid, zero for as many as make it roughly square.
+	Columns  int
+	TileSize image.Point
+}
+
+type mosaicTileState struct {
+	generation uint
+	serial     uint64
+}
+
+type mosaicTile struct {
+	source MosaicSource
+	rect   image.Rectangle
+	scaler *Scaler
+
+	mutex      sync.Mutex
+	provider   FrameProvider
+	err        error
+	failed     chan struct{}
+	generation uint
+	seen       mosaicTileState
+}
+
+// MosaicFrameProvider lays several sources out in a grid. Sources connect
+// and reconnect in the background, showing a placeholder tile meanwhile, so
+// one of them going away doesn't stop the stream.
+type MosaicFrameProvider struct {
+	mutex         sync.Mutex
+	tiles         []*mosaicTile
+	size          image.Point
+	face          font.Face
+	frames        FramePool
+	serial        uint64
+	notifications uint64
+	updates       chan FrameUpdate
+	done          chan struct{}
+	close         sync.Once
+}
+
+var _ FrameProvider = (*MosaicFrameProvider)(nil)
+var _ FrameSerialProvider = (*MosaicFrameProvider)(nil)
+var _ FrameNotifier = (*MosaicFrameProvider)(nil)
+var _ FrameRecycler = (*MosaicFrameProvider)(nil)
+
+func NewMosaicFrameProvider(options MosaicOptions) (*MosaicFrameProvider, error) {
+	if len(options.Sources) == 0 {
+		return nil, fmt.Errorf("mosaic without sources")
+	}
+	if options.TileSize.X <= 0 || options.TileSize.Y <= 0 {
+		return nil, fmt.Errorf("invalid mosaic tile size: %v", options.TileSize)
+	}
+
+	columns := options.Columns
+	if columns <= 0 {
+		columns = int(math.Ceil(math.Sqrt(float64(len(options.Sources)))))
+	}
+	rows := (len(options.Sources) + columns - 1) / columns
+
+	f, err := opentype.Parse(gomonobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    math.Max(12, float64(options.TileSize.Y)/20),
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	provider := MosaicFrameProvider{
+		size:    image.Pt(columns*options.TileSize.X, rows*options.TileSize.Y),
+		face:    face,
+		updates: make(chan FrameUpdate, 1),
+		done:    make(chan struct{}),
+	}
+	for i, source := range options.Sources {
+		min := image.Pt(i%columns*options.TileSize.X, i/columns*options.TileSize.Y)
+		tile := mosaicTile{
+			source: source,
+			rect:   image.Rectangle{min, min.Add(options.TileSize)},
+			scaler: NewScaler(ScaleFilterArea),
+		}
+		provider.tiles = append(provider.tiles, &tile)
+	}
+
+	for _, tile := range provider.tiles {
+		go provider.run(tile)
+	}
+
+	return &provider, nil
+}
+
+func (m *MosaicFrameProvider) notify() {
+	notifyFrameUpdate(m.updates, FrameUpdate{
+		Serial: atomic.AddUint64(&m.notifications, 1),
+		Time:   time.Now(),
+	})
+}
+
+func (m *MosaicFrameProvider) wait(d time.Duration) bool {
+	select {
+	case <-m.done:
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// run keeps the tile connected until the mosaic is closed.
+func (m *MosaicFrameProvider) run(tile *mosaicTile) {
+	for {
+		provider, err := tile.source.Factory.NewFrameProvider()
+		if err != nil {
+			tile.mutex.Lock()
+			tile.err = err
+			tile.generation++
+			tile.mutex.Unlock()
+
+			m.notify()
+			if !m.wait(mosaicRetryInterval) {
+				return
+			}
+			continue
+		}
+
+		failed := make(chan struct{})
+		tile.mutex.Lock()
+		select {
+		case <-m.done:
+			tile.mutex.Unlock()
+			provider.Close()
+			return
+		default:
+		}
+		tile.provider = provider
+		tile.err = nil
+		tile.failed = failed
+		tile.generation++
+		tile.mutex.Unlock()
+		m.notify()
+
+		var updates <-chan FrameUpdate
+		if notifier, ok := provider.(FrameNotifier); ok {
+			updates = notifier.FrameUpdates()
+		}
+
+		// without this, a dead source is only noticed when a frame is drawn
+		var sourceDone <-chan struct{}
+		failure, ok := provider.(FrameFailureNotifier)
+		if ok {
+			sourceDone = failure.Done()
+		}
+
+	connected:
+		for {
+			select {
+			case <-m.done:
+				return
+			case <-failed:
+				break connected
+			case <-sourceDone:
+				tile.mutex.Lock()
+				if tile.provider == provider {
+					tile.fail(failure.Err())
+				}
+				tile.mutex.Unlock()
+				m.notify()
+				break connected
+			case <-updates:
+				m.notify()
+			}
+		}
+
+		if !m.wait(mosaicRetryInterval) {
+			return
+		}
+	}
+}
+
+// fail drops the tile provider, to be called with the tile mutex held.
+func (t *mosaicTile) fail(err error) {
+	t.provider.Close()
+	t.provider = nil
+	t.err = err
+	t.generation++
+	close(t.failed)
+}
+
+func (m *MosaicFrameProvider) FrameSerial() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	changed := false
+	for _, tile := range m.tiles {
+		tile.mutex.Lock()
+		state := mosaicTileState{
+			generation: tile.generation,
+		}
+		if provider, ok := tile.provider.(FrameSerialProvider); ok {
+			state.serial = provider.FrameSerial()
+		} else if tile.provider != nil {
+			// sources that can't tell are always captured again
+			changed = true
+		}
+		if state != tile.seen {
+			tile.seen = state
+			changed = true
+		}
+		tile.mutex.Unlock()
+	}
+
+	if changed {
+		m.serial++
+	}
+	return m.serial
+}
+
+func (m *MosaicFrameProvider) Frame() (*image.RGBA, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	frame := m.frames.Get(image.Rectangle{Max: m.size})
+	draw.Draw(frame, frame.Rect, image.Black, image.Point{}, draw.Src)
+
+	for _, tile := range m.tiles {
+		m.drawTile(frame, tile)
+	}
+
+	return frame, nil
+}
+
+func (m *MosaicFrameProvider) drawTile(frame *image.RGBA, tile *mosaicTile) {
+	tile.mutex.Lock()
+	defer tile.mutex.Unlock()
+
+	if tile.provider == nil {
+		status := "connecting"
+		if tile.err != nil {
+			status = "disconnected: " + tile.err.Error()
+		}
+		draw.Draw(frame, tile.rect, image.NewUniform(color.RGBA{48, 48, 48, 255}), image.Point{}, draw.Src)
+		m.drawText(frame, tile.rect, tile.rect.Dy()/2, status)
+		m.drawText(frame, tile.rect, 0, tile.source.Label)
+		return
+	}
+
+	src, err := tile.provider.Frame()
+	if err != nil {
+		tile.fail(err)
+		draw.Draw(frame, tile.rect, image.NewUniform(color.RGBA{48, 48, 48, 255}), image.Point{}, draw.Src)
+		m.drawText(frame, tile.rect, tile.rect.Dy()/2, "disconnected: "+err.Error())
+		m.drawText(frame, tile.rect, 0, tile.source.Label)
+		return
+	}
+
+	scaled := tile.scaler.Scale(src, ScaleOptions{
+		MaxWidth:  tile.rect.Dx(),
+		MaxHeight: tile.rect.Dy(),
+	}.Size(src.Rect.Size()))
+
+	// letterboxed in the middle of the tile
+	offset := tile.rect.Size().Sub(scaled.Rect.Size()).Div(2)
+	rect := scaled.Rect.Sub(scaled.Rect.Min).Add(tile.rect.Min.Add(offset))
+	draw.Draw(frame, rect, scaled, scaled.Rect.Min, draw.Src)
+
+	if recycler, ok := tile.provider.(FrameRecycler); ok {
+		recycler.Recycle(src)
+	}
+
+	m.drawText(frame, tile.rect, 0, tile.source.Label)
+}
+
+// drawText writes text on a dark box, y pixels below the top of the tile.
+func (m *MosaicFrameProvider) drawText(frame *image.RGBA, tile image.Rectangle, y int, text string) {
+	if text == "" {
+		return
+	}
+
+	metrics := m.face.Metrics()
+	padding := metrics.Height.Ceil() / 4
+	width := font.MeasureString(m.face, text).Ceil()
+
+	box := image.Rect(0, 0, width+2*padding, metrics.Height.Ceil()+2*padding).Add(tile.Min).Add(image.Pt(0, y)).Intersect(tile)
+	draw.Draw(frame, box, image.NewUniform(color.RGBA{0, 0, 0, 160}), image.Point{}, draw.Over)
+
+	drawer := font.Drawer{
+		Dst:  frame.SubImage(tile).(*image.RGBA),
+		Src:  image.White,
+		Face: m.face,
+		Dot:  fixed.P(box.Min.X+padding, box.Min.Y+padding+metrics.Ascent.Ceil()),
+	}
+	drawer.DrawString(text)
+}
+
+func (m *MosaicFrameProvider) Recycle(frame *image.RGBA) {
+	m.frames.Put(frame)
+}
+
+func (m *MosaicFrameProvider) FrameUpdates() <-chan FrameUpdate {
+	return m.updates
+}
+
+func (m *MosaicFrameProvider) Close() error {
+	m.close.Do(func() {
+		close(m.done)
+
+		for _, tile := range m.tiles {
+			tile.mutex.Lock()
+			if tile.provider != nil {
+				tile.provider.Close()
+				tile.provider = nil
+			}
+			tile.mutex.Unlock()
+		}
+	})
+
+	return nil
+}
+
+type MosaicFrameProviderFactory struct {
+	Options MosaicOptions
+}
+
+var _ FrameProviderFactory = (*MosaicFrameProviderFactory)(nil)
+
+func (f *MosaicFrameProviderFactory) NewFrameProvider() (FrameProvider, error) {
+	return NewMosaicFrameProvider(f.Options)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFailingProvider stops on its own when fail is called, like a client
+// losing its connection.
+type fakeFailingProvider struct {
+	mutex  sync.Mutex
+	done   chan struct{}
+	err    error
+	closed bool
+}
+
+var _ FrameProvider = (*fakeFailingProvider)(nil)
+var _ FrameFailureNotifier = (*fakeFailingProvider)(nil)
+
+func (p *fakeFailingProvider) fail(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.err = err
+	close(p.done)
+}
+
+func (p *fakeFailingProvider) Frame() (*image.RGBA, error) {
+	return uniformRGBA(image.Pt(16, 16), red), nil
+}
+
+func (p *fakeFailingProvider) Done() <-chan struct{} {
+	return p.done
+}
+
+func (p *fakeFailingProvider) Err() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.err
+}
+
+func (p *fakeFailingProvider) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	return nil
+}
+
+type fakeFailingProviderFactory struct {
+	providers chan *fakeFailingProvider
+}
+
+func (f *fakeFailingProviderFactory) NewFrameProvider() (FrameProvider, error) {
+	provider := fakeFailingProvider{
+		done: make(chan struct{}),
+	}
+	f.providers <- &provider
+	return &provider, nil
+}
+
+func TestMosaicSourceFailure(t *testing.T) {
+	factory := fakeFailingProviderFactory{
+		providers: make(chan *fakeFailingProvider, 1),
+	}
+	mosaic, err := NewMosaicFrameProvider(MosaicOptions{
+		Sources:  MosaicSources{{Label: "fake", Factory: &factory}},
+		TileSize: image.Pt(64, 48),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mosaic.Close()
+
+	tile := mosaic.tiles[0]
+	waitTile := func(done func() bool) {
+		t.Helper()
+
+		timeout := time.After(5 * time.Second)
+		for {
+			tile.mutex.Lock()
+			ok := done()
+			tile.mutex.Unlock()
+			if ok {
+				return
+			}
+
+			select {
+			case <-mosaic.FrameUpdates():
+			case <-timeout:
+				t.Fatal("timed out")
+			}
+		}
+	}
+
+	var provider *fakeFailingProvider
+	select {
+	case provider = <-factory.providers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("source not connected")
+	}
+	waitTile(func() bool {
+		return tile.provider != nil
+	})
+
+	// no frame is drawn, the failure alone has to drop the source
+	sourceErr := errors.New("connection reset")
+	provider.fail(sourceErr)
+	waitTile(func() bool {
+		return tile.provider == nil
+	})
+
+	tile.mutex.Lock()
+	defer tile.mutex.Unlock()
+	if tile.err != sourceErr {
+		t.Errorf("tile err = %v, want %v", tile.err, sourceErr)
+	}
+
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if !provider.closed {
+		t.Error("failed source wasn't closed")
+	}
+}
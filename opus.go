@@ -0,0 +1,112 @@
+package main
+
+// #cgo pkg-config: opus
+//
+// #include <opus/opus.h>
+//
+// int encoder_set_bitrate(OpusEncoder *enc, opus_int32 bitrate) {
+//     return opus_encoder_ctl(enc, OPUS_SET_BITRATE(bitrate));
+// }
+//
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+const (
+	opusClockRate       = 48000
+	opusFrameDuration   = 20 * time.Millisecond
+	opusFramesPerSecond = int(time.Second / opusFrameDuration)
+	opusMaxChannels     = 2
+	maxOpusPacketSize   = 4000
+	defaultAudioBitrate = 64
+)
+
+// opusSampleRates are the only input rates libopus takes.
+var opusSampleRates = []int{8000, 12000, 16000, 24000, 48000}
+
+type OpusEncoderOptions struct {
+	// Bitrate is the target bitrate in kbps, zero means defaultAudioBitrate.
+	Bitrate uint
+}
+
+type OpusEncoder struct {
+	encoder   *C.OpusEncoder
+	format    AudioFormat
+	frameSize int
+	buffer    []byte
+}
+
+func NewOpusEncoder(format AudioFormat, options OpusEncoderOptions) (*OpusEncoder, error) {
+	supported := false
+	for _, rate := range opusSampleRates {
+		supported = supported || format.SampleRate == rate
+	}
+	if !supported {
+		return nil, fmt.Errorf("unsupported sample rate for Opus: %d", format.SampleRate)
+	}
+	if format.Channels < 1 || format.Channels > opusMaxChannels {
+		return nil, fmt.Errorf("unsupported number of channels for Opus: %d", format.Channels)
+	}
+
+	var res C.int
+	encoder := C.opus_encoder_create(C.opus_int32(format.SampleRate), C.int(format.Channels), C.OPUS_APPLICATION_AUDIO, &res)
+	if res != C.OPUS_OK {
+		return nil, fmt.Errorf("failed to initialize Opus encoder: %w", opusError(res))
+	}
+
+	bitrate := uint(defaultAudioBitrate)
+	if options.Bitrate > 0 {
+		bitrate = options.Bitrate
+	}
+	if res := C.encoder_set_bitrate(encoder, C.opus_int32(bitrate*1000)); res != C.OPUS_OK {
+		C.opus_encoder_destroy(encoder)
+		return nil, opusError(res)
+	}
+
+	opusEncoder := OpusEncoder{
+		encoder:   encoder,
+		format:    format,
+		frameSize: format.SampleRate / opusFramesPerSecond,
+		buffer:    make([]byte, maxOpusPacketSize),
+	}
+	return &opusEncoder, nil
+}
+
+// FrameSamples is how many interleaved samples Encode takes.
+func (e *OpusEncoder) FrameSamples() int {
+	return e.frameSize * e.format.Channels
+}
+
+// Encode compresses opusFrameDuration of interleaved samples into a packet.
+func (e *OpusEncoder) Encode(pcm []int16) ([]byte, error) {
+	if len(pcm) != e.FrameSamples() {
+		return nil, fmt.Errorf("got %d samples, Opus frames take %d", len(pcm), e.FrameSamples())
+	}
+
+	n := C.opus_encode(
+		e.encoder,
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])),
+		C.int(e.frameSize),
+		(*C.uchar)(unsafe.Pointer(&e.buffer[0])),
+		C.opus_int32(len(e.buffer)),
+	)
+	if n < 0 {
+		return nil, opusError(n)
+	}
+
+	return append([]byte(nil), e.buffer[:n]...), nil
+}
+
+func opusError(res C.int) error {
+	return errors.New(C.GoString(C.opus_strerror(res)))
+}
+
+func (e *OpusEncoder) Close() error {
+	C.opus_encoder_destroy(e.encoder)
+	return nil
+}
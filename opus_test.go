@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOpusEncoder(t *testing.T) {
+	tests := []struct {
+		format  AudioFormat
+		samples int
+		err     string
+	}{
+		{format: AudioFormat{SampleRate: 48000, Channels: 2}, samples: 1920},
+		{format: AudioFormat{SampleRate: 48000, Channels: 1}, samples: 960},
+		{format: AudioFormat{SampleRate: 8000, Channels: 1}, samples: 160},
+		{format: AudioFormat{SampleRate: 24000, Channels: 2}, samples: 960},
+		{format: AudioFormat{SampleRate: 44100, Channels: 2}, err: "unsupported sample rate"},
+		{format: AudioFormat{SampleRate: 48000, Channels: 0}, err: "unsupported number of channels"},
+		{format: AudioFormat{SampleRate: 48000, Channels: 3}, err: "unsupported number of channels"},
+	}
+
+	for _, test := range tests {
+		encoder, err := NewOpusEncoder(test.format, OpusEncoderOptions{})
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%+v: error = %v, want %q", test.format, err, test.err)
+			}
+			if err == nil {
+				encoder.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: %v", test.format, err)
+			continue
+		}
+
+		if samples := encoder.FrameSamples(); samples != test.samples {
+			t.Errorf("%+v: FrameSamples = %d, want %d", test.format, samples, test.samples)
+		}
+
+		// only whole 20 ms frames are encoded
+		for _, n := range []int{0, test.samples - 1, test.samples + test.format.Channels} {
+			if _, err := encoder.Encode(make([]int16, n)); err == nil {
+				t.Errorf("%+v: Encode of %d samples succeeded", test.format, n)
+			}
+		}
+		packet, err := encoder.Encode(make([]int16, test.samples))
+		if err != nil {
+			t.Errorf("%+v: %v", test.format, err)
+		} else if len(packet) == 0 {
+			t.Errorf("%+v: empty packet", test.format)
+		}
+
+		encoder.Close()
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	defaultOverlayFontSize = 16
+	overlayTimeFormat      = "2006-01-02 15:04:05 MST"
+)
+
+type OverlayPosition int
+
+const (
+	OverlayTopLeft OverlayPosition = iota
+	OverlayTopRight
+	OverlayBottomLeft
+	OverlayBottomRight
+)
+
+func (p OverlayPosition) String() string {
+	switch p {
+	case OverlayTopLeft:
+		return "top-left"
+	case OverlayTopRight:
+		return "top-right"
+	case OverlayBottomLeft:
+		return "bottom-left"
+	case OverlayBottomRight:
+		return "bottom-right"
+	default:
+		return fmt.Sprintf("OverlayPosition(%d)", int(p))
+	}
+}
+
+func (p *OverlayPosition) Set(s string) error {
+	switch s {
+	case "top-left":
+		*p = OverlayTopLeft
+	case "top-right":
+		*p = OverlayTopRight
+	case "bottom-left":
+		*p = OverlayBottomLeft
+	case "bottom-right":
+		*p = OverlayBottomRight
+	default:
+		return fmt.Errorf("unknown overlay position: %s", s)
+	}
+
+	return nil
+}
+
+type OverlayOptions struct {
+	Hostname  bool
+	Timestamp bool
+	SessionID string
+	Text      string
+	Logo      image.Image
+	Position  OverlayPosition
+	// FontSize is in pixels, zero means defaultOverlayFontSize.
+	FontSize float64
+	// Opacity goes from 0, fully transparent, to 1, nil means fully opaque.
+	Opacity *float64
+}
+
+// Overlay draws text and a logo over the outgoing frames, its options can
+// be changed while frames are flowing.
+type Overlay struct {
+	mutex    sync.Mutex
+	options  OverlayOptions
+	revision uint
+	hostname string
+	font     *opentype.Font
+	face     font.Face
+	faceSize float64
+}
+
+func NewOverlay(options OverlayOptions) (*Overlay, error) {
+	f, err := opentype.Parse(gomonobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	overlay := Overlay{
+		options:  options,
+		hostname: hostname,
+		font:     f,
+	}
+	return &overlay, nil
+}
+
+func (o *Overlay) Options() OverlayOptions {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return o.options
+}
+
+func (o *Overlay) SetOptions(options OverlayOptions) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	o.options = options
+	o.revision++
+}
+
+func (o *Overlay) lines(now time.Time) []string {
+	var lines []string
+	if o.options.Hostname {
+		lines = append(lines, o.hostname)
+	}
+	if o.options.Timestamp {
+		lines = append(lines, now.Format(overlayTimeFormat))
+	}
+	if o.options.SessionID != "" {
+		lines = append(lines, o.options.SessionID)
+	}
+	if o.options.Text != "" {
+		lines = append(lines, strings.Split(o.options.Text, "\n")...)
+	}
+	return lines
+}
+
+// State changes whenever the overlay would draw something different.
+func (o *Overlay) State(now time.Time) string {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	return fmt.Sprintf("%d\n%s", o.revision, strings.Join(o.lines(now), "\n"))
+}
+
+func (o *Overlay) Apply(frame *image.RGBA, now time.Time) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	lines := o.lines(now)
+	logo := o.options.Logo
+	if len(lines) == 0 && logo == nil {
+		return nil
+	}
+
+	size := o.options.FontSize
+	if size <= 0 {
+		size = defaultOverlayFontSize
+	}
+	if o.face == nil || o.faceSize != size {
+		face, err := opentype.NewFace(o.font, &opentype.FaceOptions{
+			Size:    size,
+			DPI:     72,
+			Hinting: font.HintingFull,
+		})
+		if err != nil {
+			return err
+		}
+		o.face = face
+		o.faceSize = size
+	}
+
+	alpha := uint8(255)
+	if opacity := o.options.Opacity; opacity != nil && *opacity < 1 {
+		if *opacity <= 0 {
+			return nil
+		}
+		alpha = uint8(math.Round(*opacity * 255))
+	}
+
+	padding := int(size / 2)
+	metrics := o.face.Metrics()
+	lineHeight := metrics.Height.Ceil()
+
+	var width, height int
+	if logo != nil {
+		width = logo.Bounds().Dx()
+		height = logo.Bounds().Dy()
+		if len(lines) > 0 {
+			height += padding
+		}
+	}
+	for _, line := range lines {
+		if w := font.MeasureString(o.face, line).Ceil(); w > width {
+			width = w
+		}
+	}
+	height += len(lines) * lineHeight
+
+	box := image.Rect(0, 0, width+2*padding, height+2*padding)
+	bounds := frame.Rect
+	switch o.options.Position {
+	case OverlayTopRight:
+		box = box.Add(image.Pt(bounds.Max.X-box.Dx(), bounds.Min.Y))
+	case OverlayBottomLeft:
+		box = box.Add(image.Pt(bounds.Min.X, bounds.Max.Y-box.Dy()))
+	case OverlayBottomRight:
+		box = box.Add(bounds.Max.Sub(box.Size()))
+	default:
+		box = box.Add(bounds.Min)
+	}
+
+	mask := image.NewUniform(color.Alpha{alpha})
+	draw.DrawMask(frame, box, image.NewUniform(color.RGBA{0, 0, 0, 128}), image.Point{}, mask, image.Point{}, draw.Over)
+
+	y := box.Min.Y + padding
+	if logo != nil {
+		rect := logo.Bounds().Sub(logo.Bounds().Min).Add(image.Pt(box.Min.X+padding, y))
+		draw.DrawMask(frame, rect, logo, logo.Bounds().Min, mask, image.Point{}, draw.Over)
+		y += logo.Bounds().Dy() + padding
+	}
+
+	drawer := font.Drawer{
+		Dst:  frame,
+		Src:  image.NewUniform(color.RGBA{alpha, alpha, alpha, alpha}),
+		Face: o.face,
+	}
+	for _, line := range lines {
+		drawer.Dot = fixed.P(box.Min.X+padding, y+metrics.Ascent.Ceil())
+		drawer.DrawString(line)
+		y += lineHeight
+	}
+
+	return nil
+}
+
+func loadPNG(name string) (image.Image, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return png.Decode(file)
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bufio"
+	"crypto/des"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rfbSecurityInvalid = 0
+	rfbSecurityNone    = 1
+	rfbSecurityVNCAuth = 2
+
+	rfbFramebufferUpdate    = 0
+	rfbSetColourMapEntries  = 1
+	rfbBell                 = 2
+	rfbServerCutText        = 3
+	rfbSetPixelFormat       = 0
+	rfbSetEncodings         = 2
+	rfbFramebufferUpdateReq = 3
+
+	rfbEncodingRaw         = 0
+	rfbEncodingCopyRect    = 1
+	rfbEncodingHextile     = 5
+	rfbEncodingTight       = 7
+	rfbEncodingZRLE        = 16
+	rfbEncodingQuality9    = -23
+	rfbEncodingDesktopSize = -223
+	rfbEncodingLastRect    = -224
+	rfbEncodingPointerPos  = -232
+	rfbEncodingCursor      = -239
+
+	rfbDialTimeout = 10 * time.Second
+	// rfbMaxSize bounds the framebuffer, VP8 can't encode more anyway
+	rfbMaxSize = 16384
+	// rfbMaxStringLength bounds desktop names and failure reasons
+	rfbMaxStringLength = 1 << 16
+)
+
+type RFBOptions struct {
+	// Addr is the HOST[:PORT] of the VNC server, unix:PATH for a UNIX
+	// socket, listen:[HOST:]PORT to wait for a reverse connection,
+	// ssh://[USER@]BASTION[:PORT]/ADDR to tunnel through SSH or a ws:// or
+	// wss:// websockify URL.
+	Addr      string
+	Password  string
+	SSH       SSHOptions
+	WebSocket WebSocketOptions
+	// RemoteCursor asks the server to send the cursor separately instead of
+	// painting it in the framebuffer.
+	RemoteCursor bool
+}
+
+// RFBClient is a native RFB 3.3, 3.7 and 3.8 client. It asks the server for
+// 32 bits little endian pixels with red in the lowest byte, the memory
+// layout of image.RGBA, so raw pixels are copied as they come.
+type RFBClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	minor  int
+	name   string
+
+	writeMutex sync.Mutex
+
+	// updates are decoded into fb, which only loop touches, and what they
+	// changed is copied into front once complete. fbMutex guards front.
+	fb      *image.RGBA
+	fbMutex sync.Mutex
+	front   *image.RGBA
+	serial  uint64
+	updates chan FrameUpdate
+	frames  FramePool
+
+	cursorMutex sync.Mutex
+	cursor      Cursor
+
+	zrle  zlibStream
+	tight [4]zlibStream
+
+	err     error
+	errOnce sync.Once
+	done    chan struct{}
+}
+
+func NewRFBClient(options RFBOptions) (*RFBClient, error) {
+	addr, err := parseVNCAddr(options.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	switch {
+	case addr.listen:
+		conn, err = addr.accept()
+	case addr.sshHost != "":
+		conn, err = dialSSHTunnel(addr, options.SSH)
+	case addr.network == "ws":
+		conn, err = dialWebSocket(addr.address, options.WebSocket)
+	default:
+		conn, err = net.DialTimeout(addr.network, addr.address, rfbDialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := NewRFBClientConn(conn, options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+// NewRFBClientConn runs the RFB handshake over conn and starts handling
+// server messages.
+func NewRFBClientConn(conn net.Conn, options RFBOptions) (*RFBClient, error) {
+	client := RFBClient{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		updates: make(chan FrameUpdate, 1),
+		done:    make(chan struct{}),
+	}
+
+	if err := client.handshake(options.Password); err != nil {
+		return nil, fmt.Errorf("rfb handshake: %w", err)
+	}
+
+	encodings := []int32{
+		rfbEncodingTight,
+		rfbEncodingZRLE,
+		rfbEncodingHextile,
+		rfbEncodingCopyRect,
+		rfbEncodingRaw,
+		rfbEncodingQuality9,
+		rfbEncodingDesktopSize,
+		rfbEncodingLastRect,
+	}
+	if options.RemoteCursor {
+		encodings = append(encodings, rfbEncodingCursor, rfbEncodingPointerPos)
+	}
+	if err := client.setEncodings(encodings); err != nil {
+		return nil, err
+	}
+
+	if err := client.requestUpdate(false); err != nil {
+		return nil, err
+	}
+
+	go client.loop()
+
+	return &client, nil
+}
+
+func (c *RFBClient) read(data ...interface{}) error {
+	for _, v := range data {
+		if err := binary.Read(c.reader, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RFBClient) readString() (string, error) {
+	var length uint32
+	if err := c.read(&length); err != nil {
+		return "", err
+	}
+	if length > rfbMaxStringLength {
+		return "", fmt.Errorf("string of %d bytes", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (c *RFBClient) write(data ...interface{}) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	for _, v := range data {
+		if err := binary.Write(c.conn, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *RFBClient) handshake(password string) error {
+	var version [12]byte
+	if _, err := io.ReadFull(c.reader, version[:]); err != nil {
+		return err
+	}
+
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version[:]), "RFB %03d.%03d\n", &major, &minor); err != nil {
+		return fmt.Errorf("invalid protocol version %q", version)
+	}
+	switch {
+	case major < 3:
+		return fmt.Errorf("unsupported protocol version %d.%d", major, minor)
+	case major > 3 || minor >= 8:
+		c.minor = 8
+	case minor == 7:
+		c.minor = 7
+	default:
+		c.minor = 3
+	}
+	if _, err := fmt.Fprintf(c.conn, "RFB 003.%03d\n", c.minor); err != nil {
+		return err
+	}
+
+	securityType, err := c.negotiateSecurity(password)
+	if err != nil {
+		return err
+	}
+
+	switch securityType {
+	case rfbSecurityNone:
+	case rfbSecurityVNCAuth:
+		if err := c.vncAuth(password); err != nil {
+			return err
+		}
+	}
+
+	// RFB 3.3 and 3.7 only send a result after authenticating
+	if securityType != rfbSecurityNone || c.minor >= 8 {
+		var result uint32
+		if err := c.read(&result); err != nil {
+			return err
+		}
+		if result != 0 {
+			reason := "authentication failed"
+			if c.minor >= 8 {
+				if r, err := c.readString(); err == nil {
+					reason = r
+				}
+			}
+			return errors.New(reason)
+		}
+	}
+
+	// shared, so other viewers stay connected
+	if err := c.write(uint8(1)); err != nil {
+		return err
+	}
+
+	var width, height uint16
+	var format [16]byte
+	if err := c.read(&width, &height, &format); err != nil {
+		return err
+	}
+	if c.name, err = c.readString(); err != nil {
+		return err
+	}
+
+	if err := c.resize(int(width), int(height)); err != nil {
+		return err
+	}
+	c.front = image.NewRGBA(c.fb.Rect)
+	copy(c.front.Pix, c.fb.Pix)
+
+	return c.write(
+		uint8(rfbSetPixelFormat), [3]byte{},
+		uint8(32), uint8(24), uint8(0), uint8(1),
+		uint16(255), uint16(255), uint16(255),
+		uint8(0), uint8(8), uint8(16), [3]byte{},
+	)
+}
+
+func (c *RFBClient) negotiateSecurity(password string) (uint8, error) {
+	if c.minor == 3 {
+		var securityType uint32
+		if err := c.read(&securityType); err != nil {
+			return 0, err
+		}
+		if securityType == rfbSecurityInvalid {
+			reason, err := c.readString()
+			if err != nil {
+				return 0, err
+			}
+			return 0, errors.New(reason)
+		}
+		if securityType != rfbSecurityNone && securityType != rfbSecurityVNCAuth {
+			return 0, fmt.Errorf("unsupported security type %d", securityType)
+		}
+		return uint8(securityType), nil
+	}
+
+	var count uint8
+	if err := c.read(&count); err != nil {
+		return 0, err
+	}
+	if count == 0 {
+		reason, err := c.readString()
+		if err != nil {
+			return 0, err
+		}
+		return 0, errors.New(reason)
+	}
+
+	types := make([]byte, count)
+	if _, err := io.ReadFull(c.reader, types); err != nil {
+		return 0, err
+	}
+
+	var chosen uint8
+	for _, t := range types {
+		if t == rfbSecurityVNCAuth && password != "" {
+			chosen = t
+			break
+		}
+		if t == rfbSecurityNone {
+			chosen = t
+		}
+	}
+	if chosen == rfbSecurityInvalid {
+		return 0, fmt.Errorf("no supported security type in %v", types)
+	}
+
+	return chosen, c.write(chosen)
+}
+
+func (c *RFBClient) vncAuth(password string) error {
+	var challenge [16]byte
+	if _, err := io.ReadFull(c.reader, challenge[:]); err != nil {
+		return err
+	}
+
+	// VNC authentication uses the password, truncated or zero padded to 8
+	// bytes, with the bits of each byte mirrored as the DES key
+	var key [8]byte
+	copy(key[:], password)
+	for i, b := range key {
+		var mirrored byte
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				mirrored |= 0x80 >> bit
+			}
+		}
+		key[i] = mirrored
+	}
+
+	cipher, err := des.NewCipher(key[:])
+	if err != nil {
+		return err
+	}
+
+	var response [16]byte
+	cipher.Encrypt(response[:8], challenge[:8])
+	cipher.Encrypt(response[8:], challenge[8:])
+
+	return c.write(response)
+}
+
+func (c *RFBClient) setEncodings(encodings []int32) error {
+	return c.write(uint8(rfbSetEncodings), uint8(0), uint16(len(encodings)), encodings)
+}
+
+func (c *RFBClient) requestUpdate(incremental bool) error {
+	size := c.fb.Rect.Size()
+
+	var flag uint8
+	if incremental {
+		flag = 1
+	}
+	return c.write(uint8(rfbFramebufferUpdateReq), flag, uint16(0), uint16(0), uint16(size.X), uint16(size.Y))
+}
+
+func (c *RFBClient) resize(width, height int) error {
+	if width > rfbMaxSize || height > rfbMaxSize {
+		return fmt.Errorf("framebuffer of %dx%d", width, height)
+	}
+
+	c.fb = image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := 3; i < len(c.fb.Pix); i += 4 {
+		c.fb.Pix[i] = 255
+	}
+	return nil
+}
+
+func (c *RFBClient) fail(err error) {
+	c.errOnce.Do(func() {
+		c.err = err
+		close(c.done)
+	})
+}
+
+// Done is closed once the connection stopped.
+func (c *RFBClient) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the connection stopped, or nil while it is running.
+func (c *RFBClient) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *RFBClient) loop() {
+	for {
+		var messageType uint8
+		if err := c.read(&messageType); err != nil {
+			c.fail(err)
+			return
+		}
+
+		var err error
+		switch messageType {
+		case rfbFramebufferUpdate:
+			err = c.handleFramebufferUpdate()
+
+		case rfbSetColourMapEntries:
+			var first, count uint16
+			if err = c.read(new(uint8), &first, &count); err == nil {
+				_, err = c.reader.Discard(6 * int(count))
+			}
+
+		case rfbBell:
+
+		case rfbServerCutText:
+			// the clipboard isn't used, however long it is
+			var length uint32
+			if err = c.read(new([3]byte), &length); err == nil {
+				_, err = io.CopyN(io.Discard, c.reader, int64(length))
+			}
+
+		default:
+			err = fmt.Errorf("unknown rfb message type %d", messageType)
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+func (c *RFBClient) handleFramebufferUpdate() error {
+	var count uint16
+	if err := c.read(new(uint8), &count); err != nil {
+		return err
+	}
+
+	dirty, err := c.readRects(int(count))
+	if err != nil {
+		return err
+	}
+	c.publish(dirty)
+
+	notifyFrameUpdate(c.updates, FrameUpdate{
+		Serial: atomic.AddUint64(&c.serial, 1),
+		Time:   time.Now(),
+	})
+
+	return c.requestUpdate(true)
+}
+
+// publish copies what an update changed into front.
+func (c *RFBClient) publish(dirty image.Rectangle) {
+	c.fbMutex.Lock()
+	defer c.fbMutex.Unlock()
+
+	if c.front.Rect != c.fb.Rect {
+		c.front = image.NewRGBA(c.fb.Rect)
+		dirty = c.fb.Rect
+	}
+
+	dirty = dirty.Intersect(c.fb.Rect)
+	for y := dirty.Min.Y; y < dirty.Max.Y; y++ {
+		i, j := c.fb.PixOffset(dirty.Min.X, y), c.fb.PixOffset(dirty.Max.X, y)
+		copy(c.front.Pix[i:j], c.fb.Pix[i:j])
+	}
+}
+
+// readRects decodes an update into fb and returns the part of it that
+// changed.
+func (c *RFBClient) readRects(count int) (image.Rectangle, error) {
+	var dirty image.Rectangle
+	for i := 0; i < count; i++ {
+		var x, y, w, h uint16
+		var encoding int32
+		if err := c.read(&x, &y, &w, &h, &encoding); err != nil {
+			return dirty, err
+		}
+		rect := image.Rect(int(x), int(y), int(x)+int(w), int(y)+int(h))
+
+		switch encoding {
+		case rfbEncodingLastRect:
+			return dirty, nil
+		case rfbEncodingCursor, rfbEncodingPointerPos:
+		case rfbEncodingDesktopSize:
+			dirty = image.Rect(0, 0, rect.Dx(), rect.Dy())
+		default:
+			dirty = dirty.Union(rect)
+		}
+
+		if err := c.readRect(rect, encoding); err != nil {
+			return dirty, fmt.Errorf("rfb encoding %d: %w", encoding, err)
+		}
+	}
+
+	return dirty, nil
+}
+
+func (c *RFBClient) readRect(rect image.Rectangle, encoding int32) error {
+	switch encoding {
+	case rfbEncodingDesktopSize:
+		return c.resize(rect.Dx(), rect.Dy())
+	case rfbEncodingCursor:
+		return c.readCursor(rect)
+	case rfbEncodingPointerPos:
+		c.cursorMutex.Lock()
+		c.cursor.Position = rect.Min
+		c.cursorMutex.Unlock()
+		return nil
+	}
+
+	if !rect.In(c.fb.Rect) {
+		return fmt.Errorf("rectangle %v outside of the framebuffer", rect)
+	}
+
+	switch encoding {
+	case rfbEncodingRaw:
+		return c.readRaw(rect)
+	case rfbEncodingCopyRect:
+		return c.readCopyRect(rect)
+	case rfbEncodingHextile:
+		return c.readHextile(rect)
+	case rfbEncodingZRLE:
+		return c.readZRLE(rect)
+	case rfbEncodingTight:
+		return c.readTight(rect)
+	default:
+		return errors.New("unsupported encoding")
+	}
+}
+
+func (c *RFBClient) readCursor(rect image.Rectangle) error {
+	w, h := rect.Dx(), rect.Dy()
+	if w > c.fb.Rect.Dx() || h > c.fb.Rect.Dy() {
+		return fmt.Errorf("cursor of %dx%d larger than the framebuffer", w, h)
+	}
+
+	pixels := make([]byte, 4*w*h)
+	mask := make([]byte, (w+7)/8*h)
+	if _, err := io.ReadFull(c.reader, pixels); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(c.reader, mask); err != nil {
+		return err
+	}
+
+	cursor := image.NewRGBA(image.Rect(0, 0, w, h))
+	copy(cursor.Pix, pixels)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			alpha := byte(0)
+			if mask[y*((w+7)/8)+x/8]&(0x80>>(x%8)) != 0 {
+				alpha = 255
+			}
+			i := cursor.PixOffset(x, y)
+			cursor.Pix[i+3] = alpha
+			// image.RGBA is premultiplied
+			if alpha == 0 {
+				cursor.Pix[i], cursor.Pix[i+1], cursor.Pix[i+2] = 0, 0, 0
+			}
+		}
+	}
+
+	c.cursorMutex.Lock()
+	c.cursor.Image = cursor
+	c.cursor.Hotspot = rect.Min
+	c.cursor.Serial++
+	c.cursorMutex.Unlock()
+
+	return nil
+}
+
+func (c *RFBClient) Cursor() (*Cursor, bool) {
+	c.cursorMutex.Lock()
+	defer c.cursorMutex.Unlock()
+
+	if c.cursor.Image == nil {
+		return nil, false
+	}
+
+	cursor := c.cursor
+	return &cursor, true
+}
+
+// Frame copies the last complete framebuffer update into a frame, which
+// can be handed back with Recycle once it isn't used anymore.
+func (c *RFBClient) Frame() (*image.RGBA, error) {
+	if err := c.Err(); err != nil {
+		return nil, err
+	}
+
+	c.fbMutex.Lock()
+	defer c.fbMutex.Unlock()
+
+	frame := c.frames.Get(c.front.Rect)
+	copy(frame.Pix, c.front.Pix)
+	return frame, nil
+}
+
+func (c *RFBClient) Recycle(frame *image.RGBA) {
+	c.frames.Put(frame)
+}
+
+// FrameSerial counts the framebuffer updates received from the server.
+func (c *RFBClient) FrameSerial() uint64 {
+	return atomic.LoadUint64(&c.serial)
+}
+
+func (c *RFBClient) FrameUpdates() <-chan FrameUpdate {
+	return c.updates
+}
+
+func (c *RFBClient) Close() error {
+	c.fail(errors.New("closed"))
+	return c.conn.Close()
+}
+
+// RFBFrameProvider is the cgo free counterpart of VNCFrameProvider.
+type RFBFrameProvider struct {
+	*RFBClient
+}
+
+var _ FrameProvider = (*RFBFrameProvider)(nil)
+var _ CursorProvider = (*RFBFrameProvider)(nil)
+var _ FrameSerialProvider = (*RFBFrameProvider)(nil)
+var _ FrameNotifier = (*RFBFrameProvider)(nil)
+var _ FrameRecycler = (*RFBFrameProvider)(nil)
+var _ FrameFailureNotifier = (*RFBFrameProvider)(nil)
+
+type RFBFrameProviderFactory struct {
+	Options RFBOptions
+}
+
+var _ FrameProviderFactory = (*RFBFrameProviderFactory)(nil)
+
+func (f *RFBFrameProviderFactory) NewFrameProvider() (FrameProvider, error) {
+	client, err := NewRFBClient(f.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RFBFrameProvider{client}, nil
+}
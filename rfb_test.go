@@ -0,0 +1,930 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeRFBServer is the server end of a net.Pipe, scripted by the tests.
+type fakeRFBServer struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (s *fakeRFBServer) write(data ...interface{}) bool {
+	for _, v := range data {
+		if err := binary.Write(s.conn, binary.BigEndian, v); err != nil {
+			s.t.Errorf("server write: %v", err)
+			return false
+		}
+	}
+	return true
+}
+
+func (s *fakeRFBServer) read(n int) ([]byte, bool) {
+	data := make([]byte, n)
+	if _, err := io.ReadFull(s.reader, data); err != nil {
+		s.t.Errorf("server read: %v", err)
+		return nil, false
+	}
+	return data, true
+}
+
+func (s *fakeRFBServer) writeString(v string) bool {
+	return s.write(uint32(len(v)), []byte(v))
+}
+
+// version sends the server version and checks the one the client picked.
+func (s *fakeRFBServer) version(server, want string) bool {
+	if !s.write([]byte(server)) {
+		return false
+	}
+	version, ok := s.read(12)
+	if ok && string(version) != want {
+		s.t.Errorf("client version = %q, want %q", version, want)
+		return false
+	}
+	return ok
+}
+
+// securityTypes offers types the RFB 3.7 and 3.8 way and returns the one
+// the client chose.
+func (s *fakeRFBServer) securityTypes(types ...uint8) (uint8, bool) {
+	if !s.write(uint8(len(types)), types) {
+		return 0, false
+	}
+	chosen, ok := s.read(1)
+	if !ok {
+		return 0, false
+	}
+	return chosen[0], true
+}
+
+// vncAuth sends a fixed challenge and checks the response to password.
+func (s *fakeRFBServer) vncAuth(response string) bool {
+	var challenge [16]byte
+	for i := range challenge {
+		challenge[i] = byte(i)
+	}
+	if !s.write(challenge) {
+		return false
+	}
+
+	got, ok := s.read(16)
+	if ok && hex.EncodeToString(got) != response {
+		s.t.Errorf("VNC auth response = %x, want %s", got, response)
+		return false
+	}
+	return ok
+}
+
+// init answers ClientInit and checks the pixel format the client asks for.
+func (s *fakeRFBServer) init(size image.Point, name string) bool {
+	shared, ok := s.read(1)
+	if !ok {
+		return false
+	}
+	if shared[0] != 1 {
+		s.t.Errorf("shared flag = %d, want 1", shared[0])
+	}
+
+	// the server's own format, 16 bits big endian, which the client replaces
+	format := []byte{16, 16, 1, 1, 0, 31, 0, 63, 0, 31, 11, 5, 0, 0, 0, 0}
+	if !s.write(uint16(size.X), uint16(size.Y), format) || !s.writeString(name) {
+		return false
+	}
+
+	setPixelFormat, ok := s.read(20)
+	want := []byte{
+		rfbSetPixelFormat, 0, 0, 0,
+		32, 24, 0, 1,
+		0, 255, 0, 255, 0, 255,
+		0, 8, 16, 0, 0, 0,
+	}
+	if ok && !bytes.Equal(setPixelFormat, want) {
+		s.t.Errorf("SetPixelFormat = %v, want %v", setPixelFormat, want)
+		return false
+	}
+	return ok
+}
+
+// serveFakeRFB runs handshake on the server end of conn, then ignores
+// whatever else the client sends.
+func serveFakeRFB(t *testing.T, conn net.Conn, handshake func(s *fakeRFBServer) bool) *fakeRFBServer {
+	server := fakeRFBServer{
+		t:      t,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	// the handshake can still be reading what the client sent last when the
+	// test is over
+	handshakeDone := make(chan struct{})
+	t.Cleanup(func() {
+		<-handshakeDone
+		conn.Close()
+	})
+
+	go func() {
+		ok := handshake(&server)
+		close(handshakeDone)
+		if ok {
+			io.Copy(io.Discard, server.reader)
+		} else {
+			conn.Close()
+		}
+	}()
+
+	return &server
+}
+
+// startFakeRFBServer serves handshake on a pipe and returns the client end.
+func startFakeRFBServer(t *testing.T, handshake func(s *fakeRFBServer) bool) (*fakeRFBServer, net.Conn) {
+	serverConn, clientConn := net.Pipe()
+	server := serveFakeRFB(t, serverConn, handshake)
+	t.Cleanup(func() {
+		clientConn.Close()
+	})
+
+	return server, clientConn
+}
+
+// fakeRFBNoAuth is an RFB 3.8 handshake without authentication.
+func fakeRFBNoAuth(size image.Point) func(s *fakeRFBServer) bool {
+	return func(s *fakeRFBServer) bool {
+		if !s.version("RFB 003.008\n", "RFB 003.008\n") {
+			return false
+		}
+		_, ok := s.securityTypes(rfbSecurityNone)
+		return ok && s.write(uint32(0)) && s.init(size, "desktop")
+	}
+}
+
+func TestRFBHandshake(t *testing.T) {
+	// the response to "password" for the challenge 0, 1, ... 15
+	const passwordResponse = "b866924125c8eebb9debc1db61c538e2"
+
+	tests := []struct {
+		name      string
+		password  string
+		handshake func(s *fakeRFBServer) bool
+		err       string
+	}{
+		{
+			name: "3.3 none",
+			handshake: func(s *fakeRFBServer) bool {
+				return s.version("RFB 003.003\n", "RFB 003.003\n") &&
+					s.write(uint32(rfbSecurityNone)) &&
+					s.init(image.Pt(64, 48), "desktop")
+			},
+		},
+		{
+			name:     "3.3 vnc auth",
+			password: "password",
+			handshake: func(s *fakeRFBServer) bool {
+				return s.version("RFB 003.003\n", "RFB 003.003\n") &&
+					s.write(uint32(rfbSecurityVNCAuth)) &&
+					s.vncAuth(passwordResponse) &&
+					s.write(uint32(0)) &&
+					s.init(image.Pt(64, 48), "desktop")
+			},
+		},
+		{
+			name:     "3.3 vnc auth failed",
+			password: "password",
+			handshake: func(s *fakeRFBServer) bool {
+				return s.version("RFB 003.003\n", "RFB 003.003\n") &&
+					s.write(uint32(rfbSecurityVNCAuth)) &&
+					s.vncAuth(passwordResponse) &&
+					s.write(uint32(1))
+			},
+			err: "authentication failed",
+		},
+		{
+			name: "3.3 refused",
+			handshake: func(s *fakeRFBServer) bool {
+				return s.version("RFB 003.003\n", "RFB 003.003\n") &&
+					s.write(uint32(rfbSecurityInvalid)) &&
+					s.writeString("too many connections")
+			},
+			err: "too many connections",
+		},
+		{
+			// 3.5 is what some old servers announce, it's 3.3 on the wire
+			name: "3.5 none",
+			handshake: func(s *fakeRFBServer) bool {
+				return s.version("RFB 003.005\n", "RFB 003.003\n") &&
+					s.write(uint32(rfbSecurityNone)) &&
+					s.init(image.Pt(64, 48), "desktop")
+			},
+		},
+		{
+			name: "3.7 none",
+			handshake: func(s *fakeRFBServer) bool {
+				if !s.version("RFB 003.007\n", "RFB 003.007\n") {
+					return false
+				}
+				chosen, ok := s.securityTypes(rfbSecurityNone)
+				if ok && chosen != rfbSecurityNone {
+					s.t.Errorf("chose security type %d, want %d", chosen, rfbSecurityNone)
+				}
+				return ok && s.init(image.Pt(64, 48), "desktop")
+			},
+		},
+		{
+			name:     "3.7 vnc auth",
+			password: "password",
+			handshake: func(s *fakeRFBServer) bool {
+				if !s.version("RFB 003.007\n", "RFB 003.007\n") {
+					return false
+				}
+				chosen, ok := s.securityTypes(rfbSecurityNone, rfbSecurityVNCAuth)
+				if ok && chosen != rfbSecurityVNCAuth {
+					s.t.Errorf("chose security type %d, want %d", chosen, rfbSecurityVNCAuth)
+				}
+				return ok &&
+					s.vncAuth(passwordResponse) &&
+					s.write(uint32(0)) &&
+					s.init(image.Pt(64, 48), "desktop")
+			},
+		},
+		{
+			name: "3.8 none",
+			handshake: func(s *fakeRFBServer) bool {
+				if !s.version("RFB 003.008\n", "RFB 003.008\n") {
+					return false
+				}
+				// without a password the client can only pick None
+				chosen, ok := s.securityTypes(rfbSecurityVNCAuth, rfbSecurityNone)
+				if ok && chosen != rfbSecurityNone {
+					s.t.Errorf("chose security type %d, want %d", chosen, rfbSecurityNone)
+				}
+				// RFB 3.8 sends a result even without authentication
+				return ok &&
+					s.write(uint32(0)) &&
+					s.init(image.Pt(64, 48), "desktop")
+			},
+		},
+		{
+			name:     "3.8 vnc auth",
+			password: "password",
+			handshake: func(s *fakeRFBServer) bool {
+				if !s.version("RFB 003.008\n", "RFB 003.008\n") {
+					return false
+				}
+				chosen, ok := s.securityTypes(rfbSecurityVNCAuth)
+				if ok && chosen != rfbSecurityVNCAuth {
+					s.t.Errorf("chose security type %d, want %d", chosen, rfbSecurityVNCAuth)
+				}
+				return ok &&
+					s.vncAuth(passwordResponse) &&
+					s.write(uint32(0)) &&
+					s.init(image.Pt(64, 48), "desktop")
+			},
+		},
+		{
+			name:     "3.8 vnc auth failed",
+			password: "password",
+			handshake: func(s *fakeRFBServer) bool {
+				if !s.version("RFB 003.008\n", "RFB 003.008\n") {
+					return false
+				}
+				_, ok := s.securityTypes(rfbSecurityVNCAuth)
+				return ok &&
+					s.vncAuth(passwordResponse) &&
+					s.write(uint32(1)) &&
+					s.writeString("wrong password")
+			},
+			err: "wrong password",
+		},
+		{
+			name: "3.8 no supported security type",
+			handshake: func(s *fakeRFBServer) bool {
+				if !s.version("RFB 003.008\n", "RFB 003.008\n") {
+					return false
+				}
+				// VeNCrypt only, the native client doesn't do TLS
+				return s.write(uint8(1), uint8(19))
+			},
+			err: "no supported security type",
+		},
+		{
+			// macOS screen sharing announces 3.889
+			name: "3.889 none",
+			handshake: func(s *fakeRFBServer) bool {
+				if !s.version("RFB 003.889\n", "RFB 003.008\n") {
+					return false
+				}
+				_, ok := s.securityTypes(rfbSecurityNone)
+				return ok &&
+					s.write(uint32(0)) &&
+					s.init(image.Pt(64, 48), "desktop")
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, conn := startFakeRFBServer(t, test.handshake)
+
+			client, err := NewRFBClientConn(conn, RFBOptions{Password: test.password})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("err = %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			if client.name != "desktop" {
+				t.Errorf("name = %q, want %q", client.name, "desktop")
+			}
+
+			frame, err := client.Frame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Recycle(frame)
+
+			if frame.Rect != image.Rect(0, 0, 64, 48) {
+				t.Errorf("Rect = %v, want %v", frame.Rect, image.Rect(0, 0, 64, 48))
+			}
+			if got := frame.RGBAAt(0, 0); got != black {
+				t.Errorf("pixel = %v, want %v", got, black)
+			}
+		})
+	}
+}
+
+// rfbUpdate builds a FramebufferUpdate message.
+type rfbUpdate struct {
+	bytes.Buffer
+	count uint16
+}
+
+func (u *rfbUpdate) rect(rect image.Rectangle, encoding int32, data ...interface{}) {
+	u.count++
+	binary.Write(u, binary.BigEndian, []uint16{uint16(rect.Min.X), uint16(rect.Min.Y), uint16(rect.Dx()), uint16(rect.Dy())})
+	binary.Write(u, binary.BigEndian, encoding)
+	for _, v := range data {
+		binary.Write(u, binary.BigEndian, v)
+	}
+}
+
+func (u *rfbUpdate) message() []byte {
+	header := []byte{rfbFramebufferUpdate, 0, byte(u.count >> 8), byte(u.count)}
+	return append(header, u.Bytes()...)
+}
+
+// encodePixel is a pixel in the format the client asks for.
+func encodePixel(c color.RGBA) []byte {
+	return []byte{c.R, c.G, c.B, 0}
+}
+
+func encodeCompactPixel(c color.RGBA) []byte {
+	return []byte{c.R, c.G, c.B}
+}
+
+func encodePixels(c color.RGBA, n int) []byte {
+	return bytes.Repeat(encodePixel(c), n)
+}
+
+func encodeCompactPixels(c color.RGBA, n int) []byte {
+	return bytes.Repeat(encodeCompactPixel(c), n)
+}
+
+func encodeCompactLength(n int) []byte {
+	length := []byte{byte(n & 0x7F)}
+	if n > 0x7F {
+		length[0] |= 0x80
+		length = append(length, byte(n>>7&0x7F))
+		if n > 0x3FFF {
+			length[1] |= 0x80
+			length = append(length, byte(n>>14))
+		}
+	}
+	return length
+}
+
+// rfbZlib compresses data on a stream kept across rectangles, like servers
+// do.
+type rfbZlib struct {
+	buffer bytes.Buffer
+	writer *zlib.Writer
+}
+
+func (z *rfbZlib) compress(data []byte) []byte {
+	if z.writer == nil {
+		z.writer = zlib.NewWriter(&z.buffer)
+	}
+	z.writer.Write(data)
+	z.writer.Flush()
+
+	compressed := append([]byte(nil), z.buffer.Bytes()...)
+	z.buffer.Reset()
+	return compressed
+}
+
+func newTestRFBClient(t *testing.T, size image.Point) (*RFBClient, *fakeRFBServer) {
+	t.Helper()
+
+	server, conn := startFakeRFBServer(t, fakeRFBNoAuth(size))
+
+	client, err := NewRFBClientConn(conn, RFBOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+	})
+
+	return client, server
+}
+
+// sendUpdate sends the update and returns the frame once the client
+// applied it.
+func sendUpdate(t *testing.T, client *RFBClient, server *fakeRFBServer, update *rfbUpdate) *image.RGBA {
+	t.Helper()
+
+	serial := client.FrameSerial()
+	if _, err := server.conn.Write(update.message()); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for client.FrameSerial() == serial {
+		select {
+		case <-client.FrameUpdates():
+		case <-client.done:
+			t.Fatal(client.Err())
+		case <-timeout:
+			t.Fatal("no update")
+		}
+	}
+
+	frame, err := client.Frame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Recycle(frame)
+	})
+	return frame
+}
+
+// checkPixels compares every pixel of rect with want.
+func checkPixels(t *testing.T, frame *image.RGBA, rect image.Rectangle, want func(p image.Point) color.RGBA) {
+	t.Helper()
+
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			p := image.Pt(x, y)
+			if got := frame.RGBAAt(x, y); got != want(p) {
+				t.Fatalf("pixel %v = %v, want %v", p, got, want(p))
+			}
+		}
+	}
+}
+
+func uniformPixels(c color.RGBA) func(p image.Point) color.RGBA {
+	return func(p image.Point) color.RGBA {
+		return c
+	}
+}
+
+func TestRFBRaw(t *testing.T) {
+	client, server := newTestRFBClient(t, image.Pt(32, 24))
+
+	var update rfbUpdate
+	rect := image.Rect(4, 2, 12, 6)
+	var pixels []byte
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			pixels = append(pixels, encodePixel(color.RGBA{uint8(x), uint8(y), uint8(x + y), 255})...)
+		}
+	}
+	update.rect(rect, rfbEncodingRaw, pixels)
+	frame := sendUpdate(t, client, server, &update)
+
+	checkPixels(t, frame, frame.Rect, func(p image.Point) color.RGBA {
+		if p.In(rect) {
+			return color.RGBA{uint8(p.X), uint8(p.Y), uint8(p.X + p.Y), 255}
+		}
+		return black
+	})
+}
+
+func TestRFBCopyRect(t *testing.T) {
+	client, server := newTestRFBClient(t, image.Pt(32, 24))
+
+	var update rfbUpdate
+	update.rect(image.Rect(0, 0, 4, 4), rfbEncodingRaw, encodePixels(red, 16))
+	// overlapping the source, which has to be read before it's overwritten
+	update.rect(image.Rect(2, 2, 6, 6), rfbEncodingCopyRect, uint16(0), uint16(0))
+	update.rect(image.Rect(20, 10, 24, 14), rfbEncodingCopyRect, uint16(2), uint16(2))
+	frame := sendUpdate(t, client, server, &update)
+
+	checkPixels(t, frame, frame.Rect, func(p image.Point) color.RGBA {
+		switch {
+		case p.In(image.Rect(0, 0, 4, 4)), p.In(image.Rect(2, 2, 6, 6)), p.In(image.Rect(20, 10, 24, 14)):
+			return red
+		default:
+			return black
+		}
+	})
+
+	// a source outside of the framebuffer is a protocol error
+	update = rfbUpdate{}
+	update.rect(image.Rect(0, 0, 4, 4), rfbEncodingCopyRect, uint16(30), uint16(0))
+	if _, err := server.conn.Write(update.message()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-client.done:
+		if err := client.Err(); err == nil || !strings.Contains(err.Error(), "outside of the framebuffer") {
+			t.Errorf("Err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("client didn't fail")
+	}
+}
+
+func TestRFBHextile(t *testing.T) {
+	client, server := newTestRFBClient(t, image.Pt(32, 24))
+
+	// 20x18 is 4 tiles, 3 of them partial
+	var data []byte
+	// background and foreground with a 2x2 subrect at 2, 3
+	data = append(data, hextileBackgroundSpecified|hextileForegroundSpecified|hextileAnySubrects)
+	data = append(data, encodePixel(red)...)
+	data = append(data, encodePixel(blue)...)
+	data = append(data, 1, 0x23, 0x11)
+	// the background carries over
+	data = append(data, 0)
+	// raw
+	data = append(data, hextileRaw)
+	data = append(data, encodePixels(green, 16*2)...)
+	// a coloured 1x1 subrect over the background of the first tile
+	data = append(data, hextileAnySubrects|hextileSubrectsColoured, 1)
+	data = append(data, encodePixel(white)...)
+	data = append(data, 0x00, 0x00)
+
+	var update rfbUpdate
+	update.rect(image.Rect(0, 0, 20, 18), rfbEncodingHextile, data)
+	frame := sendUpdate(t, client, server, &update)
+
+	checkPixels(t, frame, frame.Rect, func(p image.Point) color.RGBA {
+		switch {
+		case p.In(image.Rect(2, 3, 4, 5)):
+			return blue
+		case p.In(image.Rect(0, 16, 16, 18)):
+			return green
+		case p == image.Pt(16, 16):
+			return white
+		case p.In(image.Rect(0, 0, 20, 18)):
+			return red
+		default:
+			return black
+		}
+	})
+}
+
+func TestRFBZRLE(t *testing.T) {
+	client, server := newTestRFBClient(t, image.Pt(80, 24))
+
+	var stream rfbZlib
+
+	// 70x10 is a full width tile and a 6 pixel wide one
+	var tiles []byte
+	tiles = append(tiles, 1)
+	tiles = append(tiles, encodeCompactPixel(green)...)
+	// plain RLE, 30 red then 30 blue, the run length is stored minus one
+	tiles = append(tiles, zrlePlainRLE)
+	tiles = append(tiles, encodeCompactPixel(red)...)
+	tiles = append(tiles, 29)
+	tiles = append(tiles, encodeCompactPixel(blue)...)
+	tiles = append(tiles, 29)
+	compressed := stream.compress(tiles)
+
+	var update rfbUpdate
+	update.rect(image.Rect(0, 0, 70, 10), rfbEncodingZRLE, uint32(len(compressed)), compressed)
+	frame := sendUpdate(t, client, server, &update)
+
+	checkPixels(t, frame, image.Rect(0, 0, 80, 10), func(p image.Point) color.RGBA {
+		switch {
+		case p.X < 64:
+			return green
+		case p.X < 70 && p.Y < 5:
+			return red
+		case p.X < 70:
+			return blue
+		default:
+			return black
+		}
+	})
+
+	// later rectangles continue the same zlib stream
+	tiles = nil
+	// raw
+	tiles = append(tiles, 0)
+	tiles = append(tiles, encodeCompactPixels(white, 4)...)
+	compressed = stream.compress(tiles)
+	tiles = nil
+	// a packed palette, 1 bit per pixel, alternating white and red
+	tiles = append(tiles, 2)
+	tiles = append(tiles, encodeCompactPixel(white)...)
+	tiles = append(tiles, encodeCompactPixel(red)...)
+	tiles = append(tiles, 0xAA, 0x55)
+	packed := stream.compress(tiles)
+	tiles = nil
+	// palette RLE, 3 blue then 1 green
+	tiles = append(tiles, zrlePlainRLE+2)
+	tiles = append(tiles, encodeCompactPixel(blue)...)
+	tiles = append(tiles, encodeCompactPixel(green)...)
+	tiles = append(tiles, 128|0, 2, 1)
+	paletteRLE := stream.compress(tiles)
+
+	update = rfbUpdate{}
+	update.rect(image.Rect(0, 12, 4, 13), rfbEncodingZRLE, uint32(len(compressed)), compressed)
+	update.rect(image.Rect(0, 14, 8, 16), rfbEncodingZRLE, uint32(len(packed)), packed)
+	update.rect(image.Rect(0, 18, 2, 20), rfbEncodingZRLE, uint32(len(paletteRLE)), paletteRLE)
+	frame = sendUpdate(t, client, server, &update)
+
+	checkPixels(t, frame, image.Rect(0, 12, 80, 24), func(p image.Point) color.RGBA {
+		switch {
+		case p.In(image.Rect(0, 12, 4, 13)):
+			return white
+		case p.In(image.Rect(0, 14, 8, 16)):
+			if (p.X+p.Y)%2 == 0 {
+				return red
+			}
+			return white
+		case p == image.Pt(1, 19):
+			return green
+		case p.In(image.Rect(0, 18, 2, 20)):
+			return blue
+		default:
+			return black
+		}
+	})
+}
+
+func TestRFBTight(t *testing.T) {
+	client, server := newTestRFBClient(t, image.Pt(64, 48))
+
+	var streams [4]rfbZlib
+	var update rfbUpdate
+
+	// fill
+	fill := image.Rect(0, 0, 8, 8)
+	update.rect(fill, rfbEncodingTight, []byte{tightFill << 4}, encodeCompactPixel(red))
+
+	// copy filter under the compression threshold is sent as is
+	small := image.Rect(8, 0, 10, 1)
+	update.rect(small, rfbEncodingTight, []byte{0}, encodeCompactPixels(green, 2))
+
+	// copy filter compressed on stream 1
+	copied := image.Rect(16, 0, 20, 4)
+	compressed := streams[1].compress(encodeCompactPixels(blue, 16))
+	update.rect(copied, rfbEncodingTight, []byte{1 << 4}, encodeCompactLength(len(compressed)), compressed)
+
+	// 2 colour palette on stream 2, 1 bit per pixel
+	palette := image.Rect(24, 0, 32, 2)
+	update.rect(palette, rfbEncodingTight,
+		[]byte{(tightExplicitFilter | 2) << 4, tightFilterPalette, 1},
+		encodeCompactPixel(white), encodeCompactPixel(blue),
+		[]byte{0xF0, 0x0F},
+	)
+
+	// gradient on stream 3, each value is sent as the difference from its
+	// prediction
+	gradient := image.Rect(32, 0, 40, 4)
+	ramp := func(x, y int) int {
+		if x < 0 || y < 0 {
+			return 0
+		}
+		return 10 * x
+	}
+	var residuals []byte
+	for y := 0; y < gradient.Dy(); y++ {
+		for x := 0; x < gradient.Dx(); x++ {
+			prediction := ramp(x-1, y) + ramp(x, y-1) - ramp(x-1, y-1)
+			residual := byte(ramp(x, y) - prediction)
+			residuals = append(residuals, residual, residual, residual)
+		}
+	}
+	compressed = streams[3].compress(residuals)
+	update.rect(gradient, rfbEncodingTight,
+		[]byte{(tightExplicitFilter | 3) << 4, tightFilterGradient},
+		encodeCompactLength(len(compressed)), compressed,
+	)
+
+	// JPEG
+	jpegRect := image.Rect(0, 16, 16, 32)
+	var jpegData bytes.Buffer
+	if err := jpeg.Encode(&jpegData, uniformRGBA(image.Pt(16, 16), gray), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	update.rect(jpegRect, rfbEncodingTight, []byte{tightJPEG << 4}, encodeCompactLength(jpegData.Len()), jpegData.Bytes())
+
+	frame := sendUpdate(t, client, server, &update)
+
+	checkPixels(t, frame, image.Rect(0, 0, 64, 16), func(p image.Point) color.RGBA {
+		switch {
+		case p.In(fill):
+			return red
+		case p.In(small):
+			return green
+		case p.In(copied):
+			return blue
+		case p.In(palette):
+			if (p.X-palette.Min.X < 4) == (p.Y == 0) {
+				return blue
+			}
+			return white
+		case p.In(gradient):
+			v := uint8(10 * (p.X - gradient.Min.X))
+			return color.RGBA{v, v, v, 255}
+		default:
+			return black
+		}
+	})
+
+	for y := jpegRect.Min.Y; y < jpegRect.Max.Y; y++ {
+		for x := jpegRect.Min.X; x < jpegRect.Max.X; x++ {
+			got := frame.RGBAAt(x, y)
+			if absDiff(got.R, gray.R) > 2 || absDiff(got.G, gray.G) > 2 || absDiff(got.B, gray.B) > 2 || got.A != 255 {
+				t.Fatalf("JPEG pixel (%d, %d) = %v, want about %v", x, y, got, gray)
+			}
+		}
+	}
+
+	// resetting stream 1 starts a new zlib stream on it
+	streams[1] = rfbZlib{}
+	compressed = streams[1].compress(encodeCompactPixels(green, 16))
+	update = rfbUpdate{}
+	update.rect(copied, rfbEncodingTight, []byte{1<<4 | 1<<1}, encodeCompactLength(len(compressed)), compressed)
+	frame = sendUpdate(t, client, server, &update)
+
+	checkPixels(t, frame, copied, uniformPixels(green))
+}
+
+func TestRFBDesktopSize(t *testing.T) {
+	client, server := newTestRFBClient(t, image.Pt(32, 24))
+
+	var update rfbUpdate
+	update.rect(image.Rect(0, 0, 40, 30), rfbEncodingDesktopSize)
+	update.rect(image.Rect(36, 26, 40, 30), rfbEncodingRaw, encodePixels(red, 16))
+	update.rect(image.Rect(0, 0, 0, 0), rfbEncodingLastRect)
+	frame := sendUpdate(t, client, server, &update)
+
+	if frame.Rect != image.Rect(0, 0, 40, 30) {
+		t.Fatalf("Rect = %v, want %v", frame.Rect, image.Rect(0, 0, 40, 30))
+	}
+	checkPixels(t, frame, frame.Rect, func(p image.Point) color.RGBA {
+		if p.In(image.Rect(36, 26, 40, 30)) {
+			return red
+		}
+		return black
+	})
+}
+
+func TestRFBFrameDuringUpdate(t *testing.T) {
+	client, server := newTestRFBClient(t, image.Pt(32, 24))
+
+	var update rfbUpdate
+	update.rect(image.Rect(0, 0, 32, 24), rfbEncodingRaw, encodePixels(red, 32*24))
+	message := update.message()
+	if _, err := server.conn.Write(message[:len(message)/2]); err != nil {
+		t.Fatal(err)
+	}
+
+	// the update is still on its way, frames are the previous one
+	frame, err := client.Frame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPixels(t, frame, frame.Rect, uniformPixels(black))
+	client.Recycle(frame)
+
+	serial := client.FrameSerial()
+	if _, err := server.conn.Write(message[len(message)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	timeout := time.After(5 * time.Second)
+	for client.FrameSerial() == serial {
+		select {
+		case <-client.FrameUpdates():
+		case <-timeout:
+			t.Fatal("no update")
+		}
+	}
+
+	frame, err = client.Frame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPixels(t, frame, frame.Rect, uniformPixels(red))
+	client.Recycle(frame)
+}
+
+func TestRFBServerCutText(t *testing.T) {
+	client, server := newTestRFBClient(t, image.Pt(32, 24))
+
+	// longer than the client would ever buffer
+	text := bytes.Repeat([]byte("x"), 4<<20)
+	if !server.write(uint8(rfbServerCutText), [3]byte{}, uint32(len(text)), text) {
+		t.FailNow()
+	}
+
+	var update rfbUpdate
+	update.rect(image.Rect(0, 0, 4, 4), rfbEncodingRaw, encodePixels(red, 16))
+	frame := sendUpdate(t, client, server, &update)
+	checkPixels(t, frame, image.Rect(0, 0, 4, 4), uniformPixels(red))
+}
+
+func TestRFBLimits(t *testing.T) {
+	var largeJPEG bytes.Buffer
+	if err := jpeg.Encode(&largeJPEG, uniformRGBA(image.Pt(8, 8), red), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		rect image.Rectangle
+		data []interface{}
+		err  string
+	}{
+		{
+			name: "cursor larger than the framebuffer",
+			rect: image.Rect(0, 0, 64, 64),
+			data: []interface{}{int32(rfbEncodingCursor)},
+			err:  "larger than the framebuffer",
+		},
+		{
+			name: "desktop size",
+			rect: image.Rect(0, 0, 20000, 100),
+			data: []interface{}{int32(rfbEncodingDesktopSize)},
+			err:  "framebuffer of 20000x100",
+		},
+		{
+			name: "zrle length",
+			rect: image.Rect(0, 0, 4, 4),
+			data: []interface{}{int32(rfbEncodingZRLE), uint32(1 << 30)},
+			err:  "bytes of zlib data",
+		},
+		{
+			name: "tight zlib length",
+			rect: image.Rect(0, 0, 4, 4),
+			data: []interface{}{int32(rfbEncodingTight), []byte{0}, encodeCompactLength(1 << 20)},
+			err:  "bytes of zlib data",
+		},
+		{
+			name: "tight jpeg length",
+			rect: image.Rect(0, 0, 4, 4),
+			data: []interface{}{int32(rfbEncodingTight), []byte{tightJPEG << 4}, encodeCompactLength(1 << 20)},
+			err:  "bytes of JPEG",
+		},
+		{
+			name: "tight jpeg size",
+			rect: image.Rect(0, 0, 4, 4),
+			data: []interface{}{int32(rfbEncodingTight), []byte{tightJPEG << 4}, encodeCompactLength(largeJPEG.Len()), largeJPEG.Bytes()},
+			err:  "8x8 JPEG",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := newTestRFBClient(t, image.Pt(32, 24))
+
+			var update rfbUpdate
+			update.rect(test.rect, test.data[0].(int32), test.data[1:]...)
+			// the client stops reading halfway
+			go server.conn.Write(update.message())
+
+			select {
+			case <-client.done:
+				if err := client.Err(); err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Errorf("Err = %v, want %q", err, test.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Error("client didn't fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+)
+
+const (
+	rfbPixelSize    = 4
+	rfbCompactPixel = 3
+
+	hextileTileSize            = 16
+	hextileRaw                 = 1
+	hextileBackgroundSpecified = 2
+	hextileForegroundSpecified = 4
+	hextileAnySubrects         = 8
+	hextileSubrectsColoured    = 16
+
+	zrleTileSize     = 64
+	zrleMaxPackedPal = 16
+	zrlePlainRLE     = 128
+
+	tightExplicitFilter = 4
+	tightFill           = 8
+	tightJPEG           = 9
+	tightFilterCopy     = 0
+	tightFilterPalette  = 1
+	tightFilterGradient = 2
+	tightMinToCompress  = 12
+	tightMaxJPEGHeader  = 4096
+)
+
+// zlibStream inflates a zlib stream that the server sends in chunks, one or
+// more per rectangle, without resetting it in between.
+type zlibStream struct {
+	input  bytes.Buffer
+	reader io.ReadCloser
+}
+
+func (z *zlibStream) feed(r io.Reader, n int) error {
+	if _, err := io.CopyN(&z.input, r, int64(n)); err != nil {
+		return err
+	}
+
+	if z.reader == nil {
+		reader, err := zlib.NewReader(&z.input)
+		if err != nil {
+			return err
+		}
+		z.reader = reader
+	}
+
+	return nil
+}
+
+func (z *zlibStream) Read(p []byte) (int, error) {
+	if z.reader == nil {
+		return 0, errors.New("zlib stream without data")
+	}
+
+	return z.reader.Read(p)
+}
+
+func (z *zlibStream) reset() {
+	z.reader = nil
+	z.input.Reset()
+}
+
+// zlibMaxLength bounds the compressed length of size bytes, deflate stores
+// what doesn't compress in blocks of up to 64KiB with a few bytes each.
+func zlibMaxLength(size int) int {
+	return size + size/1024 + 64
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func (c *RFBClient) fill(rect image.Rectangle, pixel color.RGBA) {
+	draw.Draw(c.fb, rect, image.NewUniform(pixel), image.Point{}, draw.Src)
+}
+
+func readPixel(r io.Reader) (color.RGBA, error) {
+	var p [rfbPixelSize]byte
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{p[0], p[1], p[2], 255}, nil
+}
+
+// readCompactPixel reads the 3 byte pixels ZRLE and Tight use for 24 bit
+// depths.
+func readCompactPixel(r io.Reader) (color.RGBA, error) {
+	var p [rfbCompactPixel]byte
+	if _, err := io.ReadFull(r, p[:]); err != nil {
+		return color.RGBA{}, err
+	}
+	return color.RGBA{p[0], p[1], p[2], 255}, nil
+}
+
+func readByte(r io.Reader) (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
+// setCompactPixels copies rows of 3 byte pixels into rect.
+func (c *RFBClient) setCompactPixels(rect image.Rectangle, data []byte) {
+	w := rect.Dx()
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := c.fb.Pix[c.fb.PixOffset(rect.Min.X, y):]
+		src := data[(y-rect.Min.Y)*w*rfbCompactPixel:]
+		for x := 0; x < w; x++ {
+			row[4*x] = src[3*x]
+			row[4*x+1] = src[3*x+1]
+			row[4*x+2] = src[3*x+2]
+			row[4*x+3] = 255
+		}
+	}
+}
+
+func (c *RFBClient) readRaw(rect image.Rectangle) error {
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		row := c.fb.Pix[c.fb.PixOffset(rect.Min.X, y):c.fb.PixOffset(rect.Max.X, y)]
+		if _, err := io.ReadFull(c.reader, row); err != nil {
+			return err
+		}
+		for i := 3; i < len(row); i += 4 {
+			row[i] = 255
+		}
+	}
+
+	return nil
+}
+
+func (c *RFBClient) readCopyRect(rect image.Rectangle) error {
+	var x, y uint16
+	if err := c.read(&x, &y); err != nil {
+		return err
+	}
+
+	src := image.Pt(int(x), int(y))
+	if !rect.Sub(rect.Min).Add(src).In(c.fb.Rect) {
+		return fmt.Errorf("copy source %v outside of the framebuffer", src)
+	}
+
+	// image/draw handles overlapping copies within the same image
+	draw.Draw(c.fb, rect, c.fb, src, draw.Src)
+	return nil
+}
+
+func (c *RFBClient) readHextile(rect image.Rectangle) error {
+	var background, foreground color.RGBA
+
+	for ty := rect.Min.Y; ty < rect.Max.Y; ty += hextileTileSize {
+		for tx := rect.Min.X; tx < rect.Max.X; tx += hextileTileSize {
+			tile := image.Rect(tx, ty, minInt(tx+hextileTileSize, rect.Max.X), minInt(ty+hextileTileSize, rect.Max.Y))
+
+			subencoding, err := readByte(c.reader)
+			if err != nil {
+				return err
+			}
+
+			if subencoding&hextileRaw != 0 {
+				if err := c.readRaw(tile); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if subencoding&hextileBackgroundSpecified != 0 {
+				if background, err = readPixel(c.reader); err != nil {
+					return err
+				}
+			}
+			c.fill(tile, background)
+
+			if subencoding&hextileForegroundSpecified != 0 {
+				if foreground, err = readPixel(c.reader); err != nil {
+					return err
+				}
+			}
+
+			if subencoding&hextileAnySubrects == 0 {
+				continue
+			}
+
+			count, err := readByte(c.reader)
+			if err != nil {
+				return err
+			}
+			for i := 0; i < int(count); i++ {
+				pixel := foreground
+				if subencoding&hextileSubrectsColoured != 0 {
+					if pixel, err = readPixel(c.reader); err != nil {
+						return err
+					}
+				}
+
+				var xy, wh uint8
+				if err := c.read(&xy, &wh); err != nil {
+					return err
+				}
+
+				x, y := tile.Min.X+int(xy>>4), tile.Min.Y+int(xy&15)
+				subrect := image.Rect(x, y, x+int(wh>>4)+1, y+int(wh&15)+1)
+				c.fill(subrect.Intersect(tile), pixel)
+			}
+		}
+	}
+
+	return nil
+}
+
+// tilePixels writes the pixels of a tile one after the other, for run
+// length encoded tiles.
+type tilePixels struct {
+	fb    *image.RGBA
+	tile  image.Rectangle
+	index int
+}
+
+func (t *tilePixels) remaining() int {
+	return t.tile.Dx()*t.tile.Dy() - t.index
+}
+
+func (t *tilePixels) put(pixel color.RGBA, run int) {
+	w := t.tile.Dx()
+	for ; run > 0; run-- {
+		i := t.fb.PixOffset(t.tile.Min.X+t.index%w, t.tile.Min.Y+t.index/w)
+		t.fb.Pix[i] = pixel.R
+		t.fb.Pix[i+1] = pixel.G
+		t.fb.Pix[i+2] = pixel.B
+		t.fb.Pix[i+3] = 255
+		t.index++
+	}
+}
+
+func readRunLength(r io.Reader) (int, error) {
+	run := 1
+	for {
+		b, err := readByte(r)
+		if err != nil {
+			return 0, err
+		}
+		run += int(b)
+		if b != 255 {
+			return run, nil
+		}
+	}
+}
+
+func readPalette(r io.Reader, size int) ([]color.RGBA, error) {
+	palette := make([]color.RGBA, size)
+	for i := range palette {
+		var err error
+		if palette[i], err = readCompactPixel(r); err != nil {
+			return nil, err
+		}
+	}
+	return palette, nil
+}
+
+func (c *RFBClient) readZRLE(rect image.Rectangle) error {
+	var length uint32
+	if err := c.read(&length); err != nil {
+		return err
+	}
+
+	// at worst every pixel is a run of one, with a full palette per tile
+	tiles := (rect.Dx() + zrleTileSize - 1) / zrleTileSize * ((rect.Dy() + zrleTileSize - 1) / zrleTileSize)
+	if max := zlibMaxLength(rect.Dx()*rect.Dy()*(rfbCompactPixel+1) + tiles*(1+127*rfbCompactPixel)); int64(length) > int64(max) {
+		return fmt.Errorf("%d bytes of zlib data for %d", length, max)
+	}
+	if err := c.zrle.feed(c.reader, int(length)); err != nil {
+		return err
+	}
+	r := &c.zrle
+
+	for ty := rect.Min.Y; ty < rect.Max.Y; ty += zrleTileSize {
+		for tx := rect.Min.X; tx < rect.Max.X; tx += zrleTileSize {
+			tile := image.Rect(tx, ty, minInt(tx+zrleTileSize, rect.Max.X), minInt(ty+zrleTileSize, rect.Max.Y))
+			if err := c.readZRLETile(r, tile); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *RFBClient) readZRLETile(r io.Reader, tile image.Rectangle) error {
+	subencoding, err := readByte(r)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case subencoding == 0:
+		data := make([]byte, tile.Dx()*tile.Dy()*rfbCompactPixel)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		c.setCompactPixels(tile, data)
+
+	case subencoding == 1:
+		pixel, err := readCompactPixel(r)
+		if err != nil {
+			return err
+		}
+		c.fill(tile, pixel)
+
+	case subencoding <= zrleMaxPackedPal:
+		palette, err := readPalette(r, int(subencoding))
+		if err != nil {
+			return err
+		}
+
+		bits := 4
+		if subencoding == 2 {
+			bits = 1
+		} else if subencoding <= 4 {
+			bits = 2
+		}
+
+		w := tile.Dx()
+		row := make([]byte, (w*bits+7)/8)
+		pixels := tilePixels{fb: c.fb, tile: tile}
+		for y := 0; y < tile.Dy(); y++ {
+			if _, err := io.ReadFull(r, row); err != nil {
+				return err
+			}
+			for x := 0; x < w; x++ {
+				shift := 8 - bits - (x*bits)%8
+				index := int(row[x*bits/8]>>shift) & (1<<bits - 1)
+				if index >= len(palette) {
+					return errors.New("palette index out of range")
+				}
+				pixels.put(palette[index], 1)
+			}
+		}
+
+	case subencoding == zrlePlainRLE:
+		pixels := tilePixels{fb: c.fb, tile: tile}
+		for pixels.remaining() > 0 {
+			pixel, err := readCompactPixel(r)
+			if err != nil {
+				return err
+			}
+			run, err := readRunLength(r)
+			if err != nil {
+				return err
+			}
+			if run > pixels.remaining() {
+				return errors.New("run past the end of the tile")
+			}
+			pixels.put(pixel, run)
+		}
+
+	case subencoding > zrlePlainRLE+1:
+		palette, err := readPalette(r, int(subencoding)-zrlePlainRLE)
+		if err != nil {
+			return err
+		}
+
+		pixels := tilePixels{fb: c.fb, tile: tile}
+		for pixels.remaining() > 0 {
+			index, err := readByte(r)
+			if err != nil {
+				return err
+			}
+
+			run := 1
+			if index&128 != 0 {
+				if run, err = readRunLength(r); err != nil {
+					return err
+				}
+			}
+			if int(index&127) >= len(palette) {
+				return errors.New("palette index out of range")
+			}
+			if run > pixels.remaining() {
+				return errors.New("run past the end of the tile")
+			}
+			pixels.put(palette[index&127], run)
+		}
+
+	default:
+		return fmt.Errorf("unknown ZRLE subencoding %d", subencoding)
+	}
+
+	return nil
+}
+
+func (c *RFBClient) readCompactLength() (int, error) {
+	length := 0
+	for i := 0; i < 3; i++ {
+		b, err := readByte(c.reader)
+		if err != nil {
+			return 0, err
+		}
+		if i == 2 {
+			return length | int(b)<<14, nil
+		}
+
+		length |= int(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	return length, nil
+}
+
+// readTightData reads size bytes of filtered pixels, which short rectangles
+// send as they are and longer ones compress with one of the 4 streams.
+func (c *RFBClient) readTightData(stream int, size int) ([]byte, error) {
+	data := make([]byte, size)
+	if size < tightMinToCompress {
+		_, err := io.ReadFull(c.reader, data)
+		return data, err
+	}
+
+	length, err := c.readCompactLength()
+	if err != nil {
+		return nil, err
+	}
+	if max := zlibMaxLength(size); length > max {
+		return nil, fmt.Errorf("%d bytes of zlib data for %d", length, max)
+	}
+	if err := c.tight[stream].feed(c.reader, length); err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(&c.tight[stream], data)
+	return data, err
+}
+
+func (c *RFBClient) readTight(rect image.Rectangle) error {
+	control, err := readByte(c.reader)
+	if err != nil {
+		return err
+	}
+
+	for i := range c.tight {
+		if control&(1<<i) != 0 {
+			c.tight[i].reset()
+		}
+	}
+
+	kind := control >> 4
+	switch {
+	case kind == tightFill:
+		pixel, err := readCompactPixel(c.reader)
+		if err != nil {
+			return err
+		}
+		c.fill(rect, pixel)
+		return nil
+
+	case kind == tightJPEG:
+		length, err := c.readCompactLength()
+		if err != nil {
+			return err
+		}
+		// even noise at the best quality doesn't take twice the raw pixels
+		if max := 2*rect.Dx()*rect.Dy()*rfbCompactPixel + tightMaxJPEGHeader; length > max {
+			return fmt.Errorf("%d bytes of JPEG for %d", length, max)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, data); err != nil {
+			return err
+		}
+
+		// the image is only allocated once its size is known to fit
+		config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if config.Width != rect.Dx() || config.Height != rect.Dy() {
+			return fmt.Errorf("%dx%d JPEG for a %v rectangle", config.Width, config.Height, rect.Size())
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		draw.Draw(c.fb, rect, img, img.Bounds().Min, draw.Src)
+		return nil
+
+	case kind > tightJPEG:
+		return fmt.Errorf("unknown tight compression %d", kind)
+	}
+
+	stream := int(kind & 3)
+	filter := byte(tightFilterCopy)
+	if kind&tightExplicitFilter != 0 {
+		if filter, err = readByte(c.reader); err != nil {
+			return err
+		}
+	}
+
+	w, h := rect.Dx(), rect.Dy()
+	switch filter {
+	case tightFilterCopy:
+		data, err := c.readTightData(stream, w*h*rfbCompactPixel)
+		if err != nil {
+			return err
+		}
+		c.setCompactPixels(rect, data)
+
+	case tightFilterPalette:
+		size, err := readByte(c.reader)
+		if err != nil {
+			return err
+		}
+		palette, err := readPalette(c.reader, int(size)+1)
+		if err != nil {
+			return err
+		}
+
+		rowSize := w
+		if len(palette) == 2 {
+			rowSize = (w + 7) / 8
+		}
+		data, err := c.readTightData(stream, rowSize*h)
+		if err != nil {
+			return err
+		}
+
+		pixels := tilePixels{fb: c.fb, tile: rect}
+		for y := 0; y < h; y++ {
+			row := data[y*rowSize:]
+			for x := 0; x < w; x++ {
+				var index int
+				if len(palette) == 2 {
+					index = int(row[x/8]>>(7-x%8)) & 1
+				} else {
+					index = int(row[x])
+				}
+				if index >= len(palette) {
+					return errors.New("palette index out of range")
+				}
+				pixels.put(palette[index], 1)
+			}
+		}
+
+	case tightFilterGradient:
+		data, err := c.readTightData(stream, w*h*rfbCompactPixel)
+		if err != nil {
+			return err
+		}
+
+		// each value is predicted from its left, upper and upper left
+		// neighbours, which are zero outside of the rectangle
+		stride := w * rfbCompactPixel
+		for y := 0; y < h; y++ {
+			for x := 0; x < stride; x++ {
+				var left, up, upLeft int
+				if x >= rfbCompactPixel {
+					left = int(data[y*stride+x-rfbCompactPixel])
+				}
+				if y > 0 {
+					up = int(data[(y-1)*stride+x])
+					if x >= rfbCompactPixel {
+						upLeft = int(data[(y-1)*stride+x-rfbCompactPixel])
+					}
+				}
+
+				prediction := left + up - upLeft
+				if prediction < 0 {
+					prediction = 0
+				} else if prediction > 255 {
+					prediction = 255
+				}
+				data[y*stride+x] += byte(prediction)
+			}
+		}
+		c.setCompactPixels(rect, data)
+
+	default:
+		return fmt.Errorf("unknown tight filter %d", filter)
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+type ScaleFilter int
+
+const (
+	ScaleFilterBilinear ScaleFilter = iota
+	ScaleFilterArea
+	ScaleFilterLanczos
+)
+
+func (f ScaleFilter) String() string {
+	switch f {
+	case ScaleFilterBilinear:
+		return "bilinear"
+	case ScaleFilterArea:
+		return "area"
+	case ScaleFilterLanczos:
+		return "lanczos"
+	default:
+		return fmt.Sprintf("ScaleFilter(%d)", int(f))
+	}
+}
+
+func (f *ScaleFilter) Set(s string) error {
+	switch s {
+	case "bilinear":
+		*f = ScaleFilterBilinear
+	case "area":
+		*f = ScaleFilterArea
+	case "lanczos":
+		*f = ScaleFilterLanczos
+	default:
+		return fmt.Errorf("unknown scale filter: %s", s)
+	}
+
+	return nil
+}
+
+func (f ScaleFilter) kernel() (support float64, weight func(float64) float64) {
+	switch f {
+	case ScaleFilterArea:
+		return 0.5, func(x float64) float64 {
+			if math.Abs(x) <= 0.5 {
+				return 1
+			}
+			return 0
+		}
+
+	case ScaleFilterLanczos:
+		return 3, func(x float64) float64 {
+			if x == 0 {
+				return 1
+			}
+			if math.Abs(x) >= 3 {
+				return 0
+			}
+			x *= math.Pi
+			return 3 * math.Sin(x) * math.Sin(x/3) / (x * x)
+		}
+
+	default:
+		return 1, func(x float64) float64 {
+			return math.Max(0, 1-math.Abs(x))
+		}
+	}
+}
+
+type ScaleOptions struct {
+	// MaxWidth and MaxHeight bound the output size, zero means unbounded.
+	MaxWidth  int
+	MaxHeight int
+	// Factor scales the input before the bounds are applied, zero means 1.
+	Factor float64
+	Filter ScaleFilter
+}
+
+// Size returns the output size for a frame of size src, preserving its
+// aspect ratio.
+func (o ScaleOptions) Size(src image.Point) image.Point {
+	w, h := float64(src.X), float64(src.Y)
+	if o.Factor > 0 {
+		w, h = w*o.Factor, h*o.Factor
+	}
+	if o.MaxWidth > 0 && w > float64(o.MaxWidth) {
+		w, h = float64(o.MaxWidth), h*float64(o.MaxWidth)/w
+	}
+	if o.MaxHeight > 0 && h > float64(o.MaxHeight) {
+		w, h = w*float64(o.MaxHeight)/h, float64(o.MaxHeight)
+	}
+
+	return image.Pt(int(math.Max(1, math.Round(w))), int(math.Max(1, math.Round(h))))
+}
+
+const (
+	scaleWeightBits = 14
+)
+
+type scaleWeights struct {
+	start   int
+	weights []int32
+}
+
+func newScaleWeights(filter ScaleFilter, srcLen, dstLen int) []scaleWeights {
+	support, weight := filter.kernel()
+
+	ratio := float64(srcLen) / float64(dstLen)
+	scale := math.Max(ratio, 1)
+	support *= scale
+
+	contributions := make([]scaleWeights, dstLen)
+	for i := range contributions {
+		center := (float64(i)+0.5)*ratio - 0.5
+		first := int(math.Ceil(center - support))
+		last := int(math.Floor(center + support))
+
+		start := first
+		if start < 0 {
+			start = 0
+		}
+		end := last
+		if end > srcLen-1 {
+			end = srcLen - 1
+		}
+
+		// taps falling outside the source are folded into the edge pixels
+		values := make([]float64, end-start+1)
+		var sum float64
+		for j := first; j <= last; j++ {
+			w := weight((float64(j) - center) / scale)
+			k := j
+			if k < start {
+				k = start
+			}
+			if k > end {
+				k = end
+			}
+			values[k-start] += w
+			sum += w
+		}
+		if sum == 0 {
+			values[int(math.Round(center))-start] = 1
+			sum = 1
+		}
+
+		weights := make([]int32, len(values))
+		for j, w := range values {
+			weights[j] = int32(math.Round(w / sum * (1 << scaleWeightBits)))
+		}
+		contributions[i] = scaleWeights{
+			start:   start,
+			weights: weights,
+		}
+	}
+
+	return contributions
+}
+
+func clampScaled(v int32) uint8 {
+	v = (v + 1<<(scaleWeightBits-1)) >> scaleWeightBits
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
+
+// Scaler resizes frames with a separable filter, keeping its weights and
+// buffers around between frames of the same size.
+type Scaler struct {
+	filter   ScaleFilter
+	srcSize  image.Point
+	dstSize  image.Point
+	xWeights []scaleWeights
+	yWeights []scaleWeights
+	tmp      []uint8
+	dst      *image.RGBA
+}
+
+func NewScaler(filter ScaleFilter) *Scaler {
+	scaler := Scaler{
+		filter: filter,
+	}
+	return &scaler
+}
+
+// Scale returns src resized to size. The returned image is reused by the
+// next call, and src itself is returned when no resizing is needed.
+func (s *Scaler) Scale(src *image.RGBA, size image.Point) *image.RGBA {
+	srcSize := src.Rect.Size()
+	if srcSize == size || srcSize.X <= 0 || srcSize.Y <= 0 || size.X <= 0 || size.Y <= 0 {
+		return src
+	}
+
+	if s.srcSize != srcSize || s.dstSize != size {
+		s.srcSize = srcSize
+		s.dstSize = size
+		s.xWeights = newScaleWeights(s.filter, srcSize.X, size.X)
+		s.yWeights = newScaleWeights(s.filter, srcSize.Y, size.Y)
+		s.tmp = make([]uint8, 4*size.X*srcSize.Y)
+		s.dst = image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+	}
+
+	for y := 0; y < srcSize.Y; y++ {
+		row := src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y+y):]
+		out := s.tmp[4*size.X*y:]
+
+		for x, contribution := range s.xWeights {
+			var r, g, b, a int32
+			i := 4 * contribution.start
+			for _, w := range contribution.weights {
+				r += w * int32(row[i])
+				g += w * int32(row[i+1])
+				b += w * int32(row[i+2])
+				a += w * int32(row[i+3])
+				i += 4
+			}
+
+			out[4*x] = clampScaled(r)
+			out[4*x+1] = clampScaled(g)
+			out[4*x+2] = clampScaled(b)
+			out[4*x+3] = clampScaled(a)
+		}
+	}
+
+	stride := 4 * size.X
+	for y, contribution := range s.yWeights {
+		out := s.dst.Pix[y*s.dst.Stride:]
+
+		for x := 0; x < stride; x++ {
+			var v int32
+			i := contribution.start*stride + x
+			for _, w := range contribution.weights {
+				v += w * int32(s.tmp[i])
+				i += stride
+			}
+
+			out[x] = clampScaled(v)
+		}
+	}
+
+	return s.dst
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestScaleFilter(t *testing.T) {
+	for _, filter := range []ScaleFilter{ScaleFilterBilinear, ScaleFilterArea, ScaleFilterLanczos} {
+		var got ScaleFilter
+		if err := got.Set(filter.String()); err != nil {
+			t.Errorf("Set(%q): %v", filter, err)
+		} else if got != filter {
+			t.Errorf("Set(%q) = %v", filter, got)
+		}
+	}
+
+	var filter ScaleFilter
+	if err := filter.Set("bicubic"); err == nil {
+		t.Error("Set(bicubic) succeeded")
+	}
+}
+
+func TestScaleOptionsSize(t *testing.T) {
+	tests := []struct {
+		options ScaleOptions
+		src     image.Point
+		want    image.Point
+	}{
+		{ScaleOptions{}, image.Pt(1920, 1080), image.Pt(1920, 1080)},
+		{ScaleOptions{Factor: 0.5}, image.Pt(1920, 1080), image.Pt(960, 540)},
+		{ScaleOptions{Factor: 2}, image.Pt(640, 480), image.Pt(1280, 960)},
+		// rounded to the nearest pixel, odd sizes are left to EvenSizeMode
+		{ScaleOptions{Factor: 0.5}, image.Pt(1366, 767), image.Pt(683, 384)},
+		{ScaleOptions{Factor: 1.0 / 3}, image.Pt(1280, 720), image.Pt(427, 240)},
+		{ScaleOptions{MaxWidth: 1280}, image.Pt(1920, 1080), image.Pt(1280, 720)},
+		{ScaleOptions{MaxHeight: 720}, image.Pt(1920, 1080), image.Pt(1280, 720)},
+		{ScaleOptions{MaxWidth: 1280}, image.Pt(1280, 1024), image.Pt(1280, 1024)},
+		// the tighter bound wins and the aspect ratio is kept
+		{ScaleOptions{MaxWidth: 1280, MaxHeight: 720}, image.Pt(1920, 1200), image.Pt(1152, 720)},
+		{ScaleOptions{MaxWidth: 1280, MaxHeight: 720}, image.Pt(2560, 1080), image.Pt(1280, 540)},
+		// bounds never scale up
+		{ScaleOptions{MaxWidth: 1920, MaxHeight: 1080}, image.Pt(1280, 720), image.Pt(1280, 720)},
+		// the factor applies before the bounds
+		{ScaleOptions{Factor: 2, MaxWidth: 1920}, image.Pt(1280, 720), image.Pt(1920, 1080)},
+		{ScaleOptions{Factor: 0.5, MaxWidth: 1280}, image.Pt(1920, 1080), image.Pt(960, 540)},
+		// nothing goes below a pixel
+		{ScaleOptions{MaxHeight: 10}, image.Pt(4000, 2), image.Pt(4000, 2)},
+		{ScaleOptions{MaxWidth: 10}, image.Pt(4000, 2), image.Pt(10, 1)},
+		{ScaleOptions{Factor: 0.001}, image.Pt(640, 480), image.Pt(1, 1)},
+	}
+
+	for _, test := range tests {
+		if got := test.options.Size(test.src); got != test.want {
+			t.Errorf("%+v.Size(%v) = %v, want %v", test.options, test.src, got, test.want)
+		}
+	}
+}
+
+func TestScaleWeights(t *testing.T) {
+	tests := []struct {
+		filter         ScaleFilter
+		srcLen, dstLen int
+		want           []scaleWeights
+	}{
+		{
+			// the taps left of the first pixel are folded into it
+			filter: ScaleFilterBilinear,
+			srcLen: 4, dstLen: 2,
+			want: []scaleWeights{
+				{start: 0, weights: []int32{8192, 6144, 2048}},
+				{start: 1, weights: []int32{2048, 6144, 8192}},
+			},
+		},
+		{
+			filter: ScaleFilterBilinear,
+			srcLen: 2, dstLen: 4,
+			want: []scaleWeights{
+				{start: 0, weights: []int32{16384}},
+				{start: 0, weights: []int32{12288, 4096}},
+				{start: 0, weights: []int32{4096, 12288}},
+				{start: 1, weights: []int32{16384}},
+			},
+		},
+		{
+			filter: ScaleFilterArea,
+			srcLen: 4, dstLen: 2,
+			want: []scaleWeights{
+				{start: 0, weights: []int32{8192, 8192}},
+				{start: 2, weights: []int32{8192, 8192}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		got := newScaleWeights(test.filter, test.srcLen, test.dstLen)
+		if len(got) != len(test.want) {
+			t.Errorf("%v %d to %d: %d weights, want %d", test.filter, test.srcLen, test.dstLen, len(got), len(test.want))
+			continue
+		}
+		for i := range got {
+			if got[i].start != test.want[i].start || len(got[i].weights) != len(test.want[i].weights) {
+				t.Errorf("%v %d to %d: pixel %d = %+v, want %+v", test.filter, test.srcLen, test.dstLen, i, got[i], test.want[i])
+				continue
+			}
+			for j := range got[i].weights {
+				if got[i].weights[j] != test.want[i].weights[j] {
+					t.Errorf("%v %d to %d: pixel %d = %+v, want %+v", test.filter, test.srcLen, test.dstLen, i, got[i], test.want[i])
+					break
+				}
+			}
+		}
+	}
+
+	// whatever the filter and ratio, weights stay in the source and add up
+	// to one, give or take the rounding of each
+	for _, filter := range []ScaleFilter{ScaleFilterBilinear, ScaleFilterArea, ScaleFilterLanczos} {
+		for _, lengths := range [][2]int{{1920, 1280}, {1366, 683}, {720, 1080}, {7, 3}, {3, 7}, {1, 5}, {5, 1}} {
+			negative := false
+			for i, contribution := range newScaleWeights(filter, lengths[0], lengths[1]) {
+				if contribution.start < 0 || contribution.start+len(contribution.weights) > lengths[0] {
+					t.Fatalf("%v %d to %d: pixel %d reads outside the source: %+v", filter, lengths[0], lengths[1], i, contribution)
+				}
+
+				var sum int32
+				for _, w := range contribution.weights {
+					sum += w
+					negative = negative || w < 0
+				}
+				if d := sum - 1<<scaleWeightBits; d < -int32(len(contribution.weights)) || d > int32(len(contribution.weights)) {
+					t.Fatalf("%v %d to %d: pixel %d weights add up to %d", filter, lengths[0], lengths[1], i, sum)
+				}
+			}
+
+			// only Lanczos has negative lobes, unless they're all folded
+			// into the same pixels
+			if wantNegative := filter == ScaleFilterLanczos && lengths[0] > 1 && lengths[1] > 1; negative != wantNegative {
+				t.Errorf("%v %d to %d: negative weights %t, want %t", filter, lengths[0], lengths[1], negative, wantNegative)
+			}
+		}
+	}
+}
+
+// rampRGBA fills each column with its x scaled by step.
+func rampRGBA(size image.Point, step int) *image.RGBA {
+	img := image.NewRGBA(image.Rectangle{Max: size})
+	for y := 0; y < size.Y; y++ {
+		for x := 0; x < size.X; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * step), uint8(255 - x*step), 0, 255})
+		}
+	}
+	return img
+}
+
+func TestScaler(t *testing.T) {
+	for _, filter := range []ScaleFilter{ScaleFilterBilinear, ScaleFilterArea, ScaleFilterLanczos} {
+		scaler := NewScaler(filter)
+
+		// uniform frames stay uniform, even with Lanczos' negative lobes
+		for _, size := range []image.Point{{8, 6}, {3, 2}, {17, 11}} {
+			for _, c := range []color.RGBA{black, white, red, gray} {
+				got := scaler.Scale(uniformRGBA(image.Pt(12, 8), c), size)
+				if got.Rect != (image.Rectangle{Max: size}) {
+					t.Fatalf("%v: Rect = %v, want %v", filter, got.Rect, image.Rectangle{Max: size})
+				}
+				for i := 0; i < len(got.Pix); i += 4 {
+					if p := (color.RGBA{got.Pix[i], got.Pix[i+1], got.Pix[i+2], got.Pix[i+3]}); p != c {
+						t.Fatalf("%v %v: pixel %d = %v, want %v", filter, size, i/4, p, c)
+					}
+				}
+			}
+		}
+
+		// a ramp halved averages pairs of columns
+		got := scaler.Scale(rampRGBA(image.Pt(16, 4), 16), image.Pt(8, 2))
+		for x := 1; x < 7; x++ {
+			want := uint8(32*x + 8)
+			if c := got.RGBAAt(x, 1); absDiff(c.R, want) > 1 || absDiff(c.G, 255-want) > 1 {
+				t.Errorf("%v: column %d = %v, want R %d", filter, x, c, want)
+			}
+		}
+	}
+
+	// area halving is an exact 2x2 average
+	checker := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			if (x+y)%2 == 0 {
+				checker.SetRGBA(x, y, white)
+			} else {
+				checker.SetRGBA(x, y, black)
+			}
+		}
+	}
+	got := NewScaler(ScaleFilterArea).Scale(checker, image.Pt(2, 2))
+	for i := 0; i < len(got.Pix); i += 4 {
+		if got.Pix[i] != 128 || got.Pix[i+3] != 255 {
+			t.Fatalf("area checkerboard pixel %d = %v", i/4, got.Pix[i:i+4])
+		}
+	}
+}
+
+func TestScalerSubImage(t *testing.T) {
+	// the right half of the ramp, halved
+	src := rampRGBA(image.Pt(16, 4), 16).SubImage(image.Rect(8, 1, 16, 3)).(*image.RGBA)
+
+	got := NewScaler(ScaleFilterArea).Scale(src, image.Pt(4, 1))
+	for x := 0; x < 4; x++ {
+		want := uint8(16*(8+2*x) + 8)
+		if c := got.RGBAAt(x, 0); c.R != want {
+			t.Errorf("column %d = %v, want R %d", x, c, want)
+		}
+	}
+}
+
+func TestScalerBuffers(t *testing.T) {
+	scaler := NewScaler(ScaleFilterBilinear)
+	src := uniformRGBA(image.Pt(16, 8), red)
+
+	// nothing to do
+	if got := scaler.Scale(src, image.Pt(16, 8)); got != src {
+		t.Error("same size frame was copied")
+	}
+
+	first := scaler.Scale(src, image.Pt(8, 4))
+	if second := scaler.Scale(uniformRGBA(image.Pt(16, 8), blue), image.Pt(8, 4)); second != first {
+		t.Error("output buffer not reused for the same sizes")
+	} else if c := second.RGBAAt(0, 0); c != blue {
+		t.Errorf("reused buffer = %v, want %v", c, blue)
+	}
+
+	// either size changing sets the scaler up again
+	if got := scaler.Scale(src, image.Pt(4, 2)); got == first || got.Rect.Size() != image.Pt(4, 2) {
+		t.Errorf("output size change: Rect = %v", got.Rect)
+	}
+	if got := scaler.Scale(uniformRGBA(image.Pt(12, 8), green), image.Pt(4, 2)); got.RGBAAt(3, 1) != green {
+		t.Errorf("input size change: pixel = %v, want %v", got.RGBAAt(3, 1), green)
+	}
+}
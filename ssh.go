@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	sshDialTimeout = 10 * time.Second
+)
+
+var sshDefaultKeyFiles = []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+
+type SSHOptions struct {
+	// KeyFile is the private key to log in with, by default the SSH agent
+	// and the usual keys in ~/.ssh are tried.
+	KeyFile string
+	// KnownHostsFile verifies the bastion host key, ~/.ssh/known_hosts by
+	// default. Unknown hosts are refused.
+	KnownHostsFile string
+}
+
+// authMethods also returns the connection to the SSH agent, if any, which
+// is only needed until logged in.
+func (o SSHOptions) authMethods() ([]ssh.AuthMethod, net.Conn, error) {
+	home, _ := os.UserHomeDir()
+
+	keyFiles := []string{o.KeyFile}
+	if o.KeyFile == "" {
+		keyFiles = nil
+		for _, name := range sshDefaultKeyFiles {
+			keyFiles = append(keyFiles, filepath.Join(home, ".ssh", name))
+		}
+	}
+
+	var methods []ssh.AuthMethod
+	var agentConn net.Conn
+	if o.KeyFile == "" {
+		if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+			if conn, err := net.Dial("unix", socket); err == nil {
+				agentConn = conn
+				methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			}
+		}
+	}
+
+	var ok bool
+	defer func() {
+		if !ok && agentConn != nil {
+			agentConn.Close()
+		}
+	}()
+
+	var signers []ssh.Signer
+	for _, name := range keyFiles {
+		key, err := os.ReadFile(name)
+		if errors.Is(err, os.ErrNotExist) && o.KeyFile == "" {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			// encrypted keys are left to the agent
+			if o.KeyFile == "" {
+				continue
+			}
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, errors.New("no SSH agent or private key to log in with")
+	}
+
+	ok = true
+	return methods, agentConn, nil
+}
+
+func (o SSHOptions) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	name := o.KnownHostsFile
+	if name == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		name = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	return knownhosts.New(name)
+}
+
+// dialSSH logs into the bastion of an ssh:// VNC address.
+func dialSSH(addr vncAddr, options SSHOptions) (*ssh.Client, error) {
+	methods, agentConn, err := options.authMethods()
+	if err != nil {
+		return nil, err
+	}
+	if agentConn != nil {
+		defer agentConn.Close()
+	}
+
+	hostKeyCallback, err := options.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	config := ssh.ClientConfig{
+		User:            addr.sshUser,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         sshDialTimeout,
+	}
+	return ssh.Dial("tcp", addr.sshHost, &config)
+}
+
+// sshConn closes the SSH connection along with the tunneled one.
+type sshConn struct {
+	net.Conn
+	client *ssh.Client
+}
+
+func (c *sshConn) Close() error {
+	err := c.Conn.Close()
+	c.client.Close()
+	return err
+}
+
+// dialSSHTunnel connects to the VNC server through the bastion.
+func dialSSHTunnel(addr vncAddr, options SSHOptions) (net.Conn, error) {
+	client, err := dialSSH(addr, options)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial(addr.network, addr.address)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("ssh tunnel to %s: %w", addr.address, err)
+	}
+
+	return &sshConn{Conn: conn, client: client}, nil
+}
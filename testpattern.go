@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sync"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gomonobold"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+var testPatternBars = []color.RGBA{
+	{192, 192, 192, 255},
+	{192, 192, 0, 255},
+	{0, 192, 192, 255},
+	{0, 192, 0, 255},
+	{192, 0, 192, 255},
+	{192, 0, 0, 255},
+	{0, 0, 192, 255},
+}
+
+// FrameSize is a WIDTHxHEIGHT command line value.
+type FrameSize image.Point
+
+func (s *FrameSize) String() string {
+	return fmt.Sprintf("%dx%d", s.X, s.Y)
+}
+
+func (s *FrameSize) Set(v string) error {
+	var w, h int
+	if _, err := fmt.Sscanf(v, "%dx%d", &w, &h); err != nil {
+		return fmt.Errorf("invalid size %q: %w", v, err)
+	}
+	if w <= 0 || h <= 0 || w > maxVP8Dimension || h > maxVP8Dimension {
+		return fmt.Errorf("invalid size %q", v)
+	}
+
+	s.X, s.Y = w, h
+	return nil
+}
+
+type TestPatternOptions struct {
+	Size image.Point
+	// FrameRate is how often the pattern changes, in frames per second.
+	FrameRate float64
+}
+
+// TestPatternFrameProvider draws color bars, a moving box, a frame counter
+// and the wall clock, so viewers and latency can be checked without a
+// desktop.
+type TestPatternFrameProvider struct {
+	mutex   sync.Mutex
+	options TestPatternOptions
+	start   time.Time
+	face    font.Face
+	frames  FramePool
+}
+
+var _ FrameProvider = (*TestPatternFrameProvider)(nil)
+var _ FrameSerialProvider = (*TestPatternFrameProvider)(nil)
+var _ FrameRecycler = (*TestPatternFrameProvider)(nil)
+
+func NewTestPatternFrameProvider(options TestPatternOptions) (*TestPatternFrameProvider, error) {
+	if options.Size.X <= 0 || options.Size.Y <= 0 {
+		return nil, fmt.Errorf("invalid test pattern size: %v", options.Size)
+	}
+	if options.FrameRate <= 0 {
+		options.FrameRate = frameRate
+	}
+
+	f, err := opentype.Parse(gomonobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+
+	face, err := opentype.NewFace(f, &opentype.FaceOptions{
+		Size:    float64(options.Size.Y) / 12,
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	provider := TestPatternFrameProvider{
+		options: options,
+		start:   time.Now(),
+		face:    face,
+	}
+	return &provider, nil
+}
+
+func (p *TestPatternFrameProvider) frameNumber(now time.Time) uint64 {
+	return uint64(now.Sub(p.start).Seconds() * p.options.FrameRate)
+}
+
+func (p *TestPatternFrameProvider) FrameSerial() uint64 {
+	return p.frameNumber(time.Now())
+}
+
+func (p *TestPatternFrameProvider) Frame() (*image.RGBA, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	return p.draw(p.frameNumber(now), now), nil
+}
+
+// draw renders frame number at the time now, the same arguments always
+// give the same pixels.
+func (p *TestPatternFrameProvider) draw(number uint64, now time.Time) *image.RGBA {
+	size := p.options.Size
+	frame := p.frames.Get(image.Rect(0, 0, size.X, size.Y))
+
+	barsHeight := size.Y * 2 / 3
+	for i, bar := range testPatternBars {
+		rect := image.Rect(i*size.X/len(testPatternBars), 0, (i+1)*size.X/len(testPatternBars), barsHeight)
+		draw.Draw(frame, rect, image.NewUniform(bar), image.Point{}, draw.Src)
+	}
+	draw.Draw(frame, image.Rect(0, barsHeight, size.X, size.Y), image.NewUniform(color.RGBA{16, 16, 16, 255}), image.Point{}, draw.Src)
+
+	// the box crosses the frame and back every 4 seconds worth of frames
+	boxSize := size.Y / 8
+	period := uint64(4 * p.options.FrameRate)
+	if period < 2 {
+		period = 2
+	}
+	phase := float64(number%period) / float64(period)
+	if phase > 0.5 {
+		phase = 1 - phase
+	}
+	x := int(phase * 2 * float64(size.X-boxSize))
+	box := image.Rect(x, barsHeight-boxSize/2, x+boxSize, barsHeight+boxSize/2)
+	draw.Draw(frame, box, image.White, image.Point{}, draw.Src)
+
+	drawer := font.Drawer{
+		Dst:  frame,
+		Src:  image.White,
+		Face: p.face,
+	}
+	lineHeight := p.face.Metrics().Height.Ceil()
+	y := barsHeight + boxSize/2 + lineHeight
+	for _, line := range []string{
+		fmt.Sprintf("frame %d", number),
+		now.Format("15:04:05.000"),
+	} {
+		drawer.Dot = fixed.P(size.X/16, y)
+		drawer.DrawString(line)
+		y += lineHeight
+	}
+
+	return frame
+}
+
+func (p *TestPatternFrameProvider) Recycle(frame *image.RGBA) {
+	p.frames.Put(frame)
+}
+
+func (p *TestPatternFrameProvider) Close() error {
+	return nil
+}
+
+type TestPatternFrameProviderFactory struct {
+	Options TestPatternOptions
+}
+
+var _ FrameProviderFactory = (*TestPatternFrameProviderFactory)(nil)
+
+func (f *TestPatternFrameProviderFactory) NewFrameProvider() (FrameProvider, error) {
+	return NewTestPatternFrameProvider(f.Options)
+}
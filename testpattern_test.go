@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"testing"
+	"time"
+)
+
+func TestTestPatternDeterministic(t *testing.T) {
+	options := TestPatternOptions{Size: image.Pt(320, 240), FrameRate: 30}
+	now := time.Date(2021, 6, 1, 12, 30, 15, 250e6, time.UTC)
+
+	a, err := NewTestPatternFrameProvider(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewTestPatternFrameProvider(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := a.draw(42, now)
+	defer a.Recycle(first)
+
+	// a recycled frame holds the previous pattern, which has to be drawn over
+	a.Recycle(a.draw(7, now.Add(time.Second)))
+	again := a.draw(42, now)
+	defer a.Recycle(again)
+
+	other := b.draw(42, now)
+	defer b.Recycle(other)
+
+	if !bytes.Equal(first.Pix, again.Pix) {
+		t.Error("redrawing a frame on the same provider changed it")
+	}
+	if !bytes.Equal(first.Pix, other.Pix) {
+		t.Error("another provider drew the frame differently")
+	}
+
+	next := a.draw(43, now)
+	defer a.Recycle(next)
+	if bytes.Equal(first.Pix, next.Pix) {
+		t.Error("the next frame is identical")
+	}
+}
+
+func TestTestPatternFrameSize(t *testing.T) {
+	for _, size := range []image.Point{
+		{640, 480},
+		{1920, 1080},
+		{321, 241},
+		{16, 16},
+		{1, 1},
+	} {
+		provider, err := NewTestPatternFrameProvider(TestPatternOptions{Size: size})
+		if err != nil {
+			t.Fatalf("%v: %v", size, err)
+		}
+
+		frame, err := provider.Frame()
+		if err != nil {
+			t.Fatalf("%v: %v", size, err)
+		}
+		if frame.Rect != (image.Rectangle{Max: size}) {
+			t.Errorf("%v: Rect = %v", size, frame.Rect)
+		}
+		provider.Recycle(frame)
+	}
+
+	for _, size := range []image.Point{{0, 480}, {640, 0}, {-1, -1}} {
+		if _, err := NewTestPatternFrameProvider(TestPatternOptions{Size: size}); err == nil {
+			t.Errorf("%v: no error", size)
+		}
+	}
+}
+
+func TestFrameSizeSet(t *testing.T) {
+	tests := []struct {
+		value string
+		want  image.Point
+		ok    bool
+	}{
+		{"1280x720", image.Pt(1280, 720), true},
+		{"1x1", image.Pt(1, 1), true},
+		{"0x720", image.Point{}, false},
+		{"1280", image.Point{}, false},
+		{"x720", image.Point{}, false},
+		{"20000x720", image.Point{}, false},
+	}
+
+	for _, test := range tests {
+		var size FrameSize
+		err := size.Set(test.value)
+		if (err == nil) != test.ok {
+			t.Errorf("Set(%q) error = %v", test.value, err)
+			continue
+		}
+		if test.ok && image.Point(size) != test.want {
+			t.Errorf("Set(%q) = %v, want %v", test.value, image.Point(size), test.want)
+		}
+	}
+}
@@ -1,17 +1,52 @@
+//go:build !novnc
+
 package main
 
 // #cgo pkg-config: libvncclient
 //
+// #include <pthread.h>
+// #include <string.h>
+// #include <sys/socket.h>
 // #include <rfb/rfbclient.h>
 //
-// static unsigned char *__fb_snapshot = NULL;
+// typedef struct {
+//     unsigned char *rgba;
+//     int width, height, xhot, yhot, x, y;
+//     unsigned int serial;
+// } cursor_t;
+//
+// // client_t is the state kept for each client, in its client data.
+// // libvncclient decodes updates straight into its framebuffer, so the
+// // rectangles an update touched are tracked and handed to Go along with
+// // the framebuffer once it's complete. handle is only used on the thread
+// // running the client, which Destroy waits for.
+// typedef struct {
+//     uintptr_t handle;
+//     int dirty_x1, dirty_y1, dirty_x2, dirty_y2;
+//     pthread_mutex_t cursor_mutex;
+//     cursor_t cursor;
+//     int audio, audio_rate, audio_channels;
+// } client_t;
 //
-// static unsigned char *get_fb_snapshot() {
-//     return __fb_snapshot;
+// static int client_tag;
+//
+// static client_t *get_client(rfbClient *c) {
+//     return rfbClientGetClientData(c, &client_tag);
 // }
 //
-// static void set_fb_snapshot(unsigned char *s) {
-//     __fb_snapshot = s;
+// static client_t *new_client(void) {
+//     client_t *client = calloc(1, sizeof(client_t));
+//     if (!client)
+//         return NULL;
+//
+//     pthread_mutex_init(&client->cursor_mutex, NULL);
+//     return client;
+// }
+//
+// static void free_client(client_t *client) {
+//     pthread_mutex_destroy(&client->cursor_mutex);
+//     free(client->cursor.rgba);
+//     free(client);
 // }
 //
 // static int get_fb_width(rfbClient *c) {
@@ -30,44 +65,295 @@ package main
 //     return get_fb_width(c) * get_fb_height(c) * get_fb_depth(c) / 8;
 // }
 //
-// static rfbBool malloc_fb(rfbClient *c) {
-//     int fb_size = calc_fb_size(c);
+// static void mark_fb_dirty(client_t *client, int x, int y, int w, int h) {
+//     if (client->dirty_x1 >= client->dirty_x2 || client->dirty_y1 >= client->dirty_y2) {
+//         client->dirty_x1 = x;
+//         client->dirty_y1 = y;
+//         client->dirty_x2 = x + w;
+//         client->dirty_y2 = y + h;
+//         return;
+//     }
 //
-//     unsigned char *fb = malloc(fb_size * sizeof(unsigned char));
-//     if (!fb)
-//         goto fail;
-//     rfbClientSetClientData(c, NULL, fb);
+//     if (x < client->dirty_x1)
+//         client->dirty_x1 = x;
+//     if (y < client->dirty_y1)
+//         client->dirty_y1 = y;
+//     if (x + w > client->dirty_x2)
+//         client->dirty_x2 = x + w;
+//     if (y + h > client->dirty_y2)
+//         client->dirty_y2 = y + h;
+// }
 //
-//     unsigned char *fb_snapshot = malloc(fb_size * sizeof(unsigned char));
-//     if (!fb_snapshot)
-//         goto fail;
-//     set_fb_snapshot(fb_snapshot);
+// static rfbBool malloc_fb(rfbClient *c) {
+//     unsigned char *fb = calloc(calc_fb_size(c), sizeof(unsigned char));
+//     if (!fb)
+//         return FALSE;
 //
+//     free(c->frameBuffer);
 //     c->frameBuffer = fb;
+//     mark_fb_dirty(get_client(c), 0, 0, get_fb_width(c), get_fb_height(c));
 //     return TRUE;
+// }
+//
+// static void got_fb_update(rfbClient *c, int x, int y, int w, int h) {
+//     mark_fb_dirty(get_client(c), x, y, w, h);
+// }
+//
+// // get_fb returns the framebuffer when it's RGBA
+// static unsigned char *get_fb(rfbClient *c) {
+//     return get_fb_depth(c) == 32 ? c->frameBuffer : NULL;
+// }
+//
+// static void set_client_handle(rfbClient *c, uintptr_t handle) {
+//     get_client(c)->handle = handle;
+// }
+//
+// extern void vncFrameUpdated(uintptr_t handle, unsigned char *fb, int width, int height, int x1, int y1, int x2, int y2);
+//
+// // finished_fb_update runs before libvncclient asks for the next
+// // incremental update itself, with the framebuffer complete
+// static void finished_fb_update(rfbClient *c) {
+//     client_t *client = get_client(c);
+//     int x1 = client->dirty_x1, y1 = client->dirty_y1, x2 = client->dirty_x2, y2 = client->dirty_y2;
+//     client->dirty_x1 = client->dirty_y1 = client->dirty_x2 = client->dirty_y2 = 0;
+//
+//     if (client->handle)
+//         vncFrameUpdated(client->handle, get_fb(c), get_fb_width(c), get_fb_height(c), x1, y1, x2, y2);
+// }
+//
+// static void got_cursor_shape(rfbClient *c, int xhot, int yhot, int width, int height, int bytes_per_pixel) {
+//     if (!c->rcSource || !c->rcMask || bytes_per_pixel != 4)
+//         return;
+//
+//     unsigned char *rgba = malloc(width * height * 4 * sizeof(unsigned char));
+//     if (!rgba)
+//         return;
 //
-// fail:
-//     if (fb) {
-//         free(fb);
-//         fb = NULL;
+//     for (int i = 0; i < width * height; ++i) {
+//         memcpy(rgba + 4 * i, c->rcSource + 4 * i, 3);
+//         rgba[4 * i + 3] = c->rcMask[i] ? 255 : 0;
 //     }
 //
-//     if (fb_snapshot) {
-//         free(fb_snapshot);
-//         fb_snapshot = NULL;
+//     client_t *client = get_client(c);
+//     pthread_mutex_lock(&client->cursor_mutex);
+//     free(client->cursor.rgba);
+//     client->cursor.rgba = rgba;
+//     client->cursor.width = width;
+//     client->cursor.height = height;
+//     client->cursor.xhot = xhot;
+//     client->cursor.yhot = yhot;
+//     client->cursor.serial++;
+//     pthread_mutex_unlock(&client->cursor_mutex);
+// }
+//
+// static rfbBool handle_cursor_pos(rfbClient *c, int x, int y) {
+//     client_t *client = get_client(c);
+//     pthread_mutex_lock(&client->cursor_mutex);
+//     client->cursor.x = x;
+//     client->cursor.y = y;
+//     pthread_mutex_unlock(&client->cursor_mutex);
+//
+//     return TRUE;
+// }
+//
+// // get_cursor returns a snapshot of the cursor, its image is only copied,
+// // to be freed by the caller, when the serial differs from known_serial
+// static cursor_t get_cursor(rfbClient *c, unsigned int known_serial) {
+//     client_t *client = get_client(c);
+//     pthread_mutex_lock(&client->cursor_mutex);
+//     cursor_t cursor = client->cursor;
+//     cursor.rgba = NULL;
+//     if (client->cursor.rgba && client->cursor.serial != known_serial) {
+//         size_t size = cursor.width * cursor.height * 4 * sizeof(unsigned char);
+//         cursor.rgba = malloc(size);
+//         if (cursor.rgba)
+//             memcpy(cursor.rgba, client->cursor.rgba, size);
 //     }
+//     pthread_mutex_unlock(&client->cursor_mutex);
 //
-//     return FALSE;
+//     return cursor;
 // }
 //
-// static void got_fb_update(rfbClient *c, int x, int y, int w, int h) {
-//     int fb_size = calc_fb_size(c);
+// // QEMU's audio pseudo-encoding and messages, with QEMU resampling the
+// // guest audio to 16-bit samples in the host byte order
+// #define QEMU_AUDIO_ENCODING -259
+// #define QEMU_MESSAGE 255
+// #define QEMU_AUDIO 1
+// #define QEMU_AUDIO_ENABLE 0
+// #define QEMU_AUDIO_SET_FORMAT 2
+// #define QEMU_AUDIO_END 0
+// #define QEMU_AUDIO_BEGIN 1
+// #define QEMU_AUDIO_DATA 2
+// #define QEMU_AUDIO_S16 3
+// #define QEMU_AUDIO_MAX_DATA (1 << 20)
 //
-//     unsigned char *fb = rfbClientGetClientData(c, NULL);
-//     memcpy(get_fb_snapshot(), fb, fb_size * sizeof(unsigned char));
+// extern void vncAudioReceived(uintptr_t handle, void *data, int length);
+//
+// static rfbBool handle_audio_encoding(rfbClient *c, rfbFramebufferUpdateRectHeader *rect) {
+//     if ((int32_t)rect->encoding != QEMU_AUDIO_ENCODING)
+//         return FALSE;
+//
+//     client_t *client = get_client(c);
+//     if (!client || !client->audio)
+//         return TRUE;
+//
+//     // the server acknowledges the pseudo-encoding before audio can be enabled
+//     int rate = client->audio_rate;
+//     uint8_t set_format[] = {
+//         QEMU_MESSAGE, QEMU_AUDIO, 0, QEMU_AUDIO_SET_FORMAT,
+//         QEMU_AUDIO_S16, client->audio_channels,
+//         rate >> 24, rate >> 16, rate >> 8, rate,
+//     };
+//     uint8_t enable[] = { QEMU_MESSAGE, QEMU_AUDIO, 0, QEMU_AUDIO_ENABLE };
+//     return WriteToRFBServer(c, (char *)set_format, sizeof(set_format)) &&
+//         WriteToRFBServer(c, (char *)enable, sizeof(enable));
 // }
 //
-// static rfbClient *rfb_init_client(char addr[]) {
+// static rfbBool handle_audio_message(rfbClient *c, rfbServerToClientMsg *message) {
+//     if (message->type != QEMU_MESSAGE)
+//         return FALSE;
+//
+//     uint8_t header[3];
+//     if (!ReadFromRFBServer(c, (char *)header, sizeof(header)) || header[0] != QEMU_AUDIO)
+//         return FALSE;
+//
+//     int operation = header[1] << 8 | header[2];
+//     if (operation == QEMU_AUDIO_BEGIN || operation == QEMU_AUDIO_END)
+//         return TRUE;
+//     if (operation != QEMU_AUDIO_DATA)
+//         return FALSE;
+//
+//     uint8_t length_be[4];
+//     if (!ReadFromRFBServer(c, (char *)length_be, sizeof(length_be)))
+//         return FALSE;
+//     uint32_t length = (uint32_t)length_be[0] << 24 | length_be[1] << 16 | length_be[2] << 8 | length_be[3];
+//     if (length > QEMU_AUDIO_MAX_DATA)
+//         return FALSE;
+//
+//     char *data = malloc(length ? length : 1);
+//     if (!data)
+//         return FALSE;
+//
+//     rfbBool ok = ReadFromRFBServer(c, data, length);
+//
+//     client_t *client = get_client(c);
+//     if (ok && client->audio && client->handle)
+//         vncAudioReceived(client->handle, data, length);
+//
+//     free(data);
+//     return ok;
+// }
+//
+// static int audio_encodings[] = { QEMU_AUDIO_ENCODING, 0 };
+//
+// static rfbClientProtocolExtension audio_extension = {
+//     .encodings = audio_encodings,
+//     .handleEncoding = handle_audio_encoding,
+//     .handleMessage = handle_audio_message,
+// };
+//
+// static void register_audio_extension(void) {
+//     rfbClientRegisterExtension(&audio_extension);
+// }
+//
+// // enable_audio has the client advertise QEMU audio, extensions are global
+// // to libvncclient so it's only registered once and clients that didn't
+// // ask for audio ignore it
+// static void enable_audio(rfbClient *c, int rate, int channels) {
+//     static pthread_once_t registered = PTHREAD_ONCE_INIT;
+//     pthread_once(&registered, register_audio_extension);
+//
+//     client_t *client = get_client(c);
+//     client->audio = 1;
+//     client->audio_rate = rate;
+//     client->audio_channels = channels;
+// }
+//
+// typedef struct {
+//     char *ca_file, *crl_file, *cert_file, *key_file;
+//     char *username, *password;
+// } credentials_t;
+//
+// static int credentials_tag;
+//
+// static char *strdup_or_null(const char *s) {
+//     return s ? strdup(s) : NULL;
+// }
+//
+// // unverified tells whether a CA was given but the server wasn't
+// // authenticated with it, so nothing must be sent to it
+// static rfbBool unverified(rfbClient *c, credentials_t *creds) {
+//     if (!creds->ca_file)
+//         return FALSE;
+//
+//     switch (c->subAuthScheme) {
+//     case rfbVeNCryptX509None:
+//     case rfbVeNCryptX509VNC:
+//     case rfbVeNCryptX509Plain:
+//         return FALSE;
+//     default:
+//         return TRUE;
+//     }
+// }
+//
+// // get_credential answers libvncclient, which frees the credential
+// static rfbCredential *get_credential(rfbClient *c, int type) {
+//     credentials_t *creds = rfbClientGetClientData(c, &credentials_tag);
+//     if (!creds || unverified(c, creds))
+//         return NULL;
+//
+//     rfbCredential *cred = calloc(1, sizeof(rfbCredential));
+//     if (!cred)
+//         return NULL;
+//
+//     switch (type) {
+//     case rfbCredentialTypeX509:
+//         cred->x509Credential.x509CACertFile = strdup_or_null(creds->ca_file);
+//         cred->x509Credential.x509CACrlFile = strdup_or_null(creds->crl_file);
+//         cred->x509Credential.x509ClientCertFile = strdup_or_null(creds->cert_file);
+//         cred->x509Credential.x509ClientKeyFile = strdup_or_null(creds->key_file);
+//         cred->x509Credential.x509CrlVerifyMode = creds->crl_file ? rfbX509CrlVerifyAll : rfbX509CrlVerifyNone;
+//         break;
+//     case rfbCredentialTypeUser:
+//         cred->userCredential.username = strdup_or_null(creds->username);
+//         cred->userCredential.password = strdup_or_null(creds->password);
+//         break;
+//     default:
+//         free(cred);
+//         return NULL;
+//     }
+//
+//     return cred;
+// }
+//
+// static char *get_password(rfbClient *c) {
+//     credentials_t *creds = rfbClientGetClientData(c, &credentials_tag);
+//     return creds && !unverified(c, creds) ? strdup_or_null(creds->password) : NULL;
+// }
+//
+// // only TLS and VeNCrypt are offered when TLS is required, libvncclient
+// // then negotiates the authentication inside them. AnonTLS and the TLS*
+// // VeNCrypt subtypes encrypt without authenticating the server, so with a
+// // CA only VeNCrypt is offered and its X509* subtypes are checked for.
+// static uint32_t tls_auth_schemes[] = { rfbVeNCrypt, rfbTLS };
+// static uint32_t x509_auth_schemes[] = { rfbVeNCrypt };
+//
+// static rfbClient *rfb_get_client(client_t *client) {
+//     rfbClient *c = rfbGetClient(8, 3, 4);
+//     rfbClientSetClientData(c, &client_tag, client);
+//     c->MallocFrameBuffer = malloc_fb;
+//     c->GotFrameBufferUpdate = got_fb_update;
+//     c->FinishedFrameBufferUpdate = finished_fb_update;
+//     return c;
+// }
+//
+// #define VNC_TARGET_TCP 0
+// #define VNC_TARGET_UNIX 1
+// #define VNC_TARGET_LISTEN 2
+//
+// // creds only has to outlive rfb_init_client, authentication is over when
+// // it returns
+// static rfbClient *rfb_init_client(char addr[], int target, int listen_port, rfbBool remote_cursor, rfbBool audio, int audio_rate, int audio_channels, credentials_t *creds, rfbBool require_tls) {
 //     static char zero[] = "";
 //
 //     rfbClient *c = NULL;
@@ -78,37 +364,109 @@ package main
 //     argv[0] = zero;
 //     argv[1] = addr;
 //
-//     c = rfbGetClient(8, 3, 4);
-//     c->MallocFrameBuffer = malloc_fb;
-//     c->GotFrameBufferUpdate = got_fb_update;
+//     client_t *client = new_client();
+//     if (!client)
+//         return NULL;
+//
+//     c = rfb_get_client(client);
+//     c->appData.useRemoteCursor = remote_cursor;
+//     if (remote_cursor) {
+//         c->GotCursorShape = got_cursor_shape;
+//         c->HandleCursorPos = handle_cursor_pos;
+//     }
+//     if (audio)
+//         enable_audio(c, audio_rate, audio_channels);
+//
+//     rfbClientSetClientData(c, &credentials_tag, creds);
+//     c->GetCredential = get_credential;
+//     if (creds->password)
+//         c->GetPassword = get_password;
+//     if (creds->ca_file)
+//         SetClientAuthSchemes(c, x509_auth_schemes, sizeof(x509_auth_schemes) / sizeof(x509_auth_schemes[0]));
+//     else if (require_tls)
+//         SetClientAuthSchemes(c, tls_auth_schemes, sizeof(tls_auth_schemes) / sizeof(tls_auth_schemes[0]));
 //
-//     if (!rfbInitClient(c, &argc, argv))
-//         goto fail;
+//     switch (target) {
+//     case VNC_TARGET_UNIX:
+//         // libvncclient connects to UNIX sockets given as the server host
+//         c->serverHost = strdup(addr);
+//         argc = 0;
+//         break;
+//     case VNC_TARGET_LISTEN:
+//         if (strchr(addr, ':'))
+//             c->listen6Address = addr;
+//         else if (addr[0])
+//             c->listenAddress = addr;
+//         c->listenPort = listen_port;
+//         c->listen6Port = listen_port;
+//         if (listenForIncomingConnectionsNoFork(c, -1) <= 0) {
+//             rfbClientCleanup(c);
+//             free_client(client);
+//             return NULL;
+//         }
+//         argc = 0;
+//         break;
+//     }
+//
+//     // rfbInitClient cleans the client up itself when it fails
+//     if (!rfbInitClient(c, argc ? &argc : NULL, argc ? argv : NULL)) {
+//         free_client(client);
+//         return NULL;
+//     }
 //
+//     if (unverified(c, creds)) {
+//         rfbClientCleanup(c);
+//         free_client(client);
+//         return NULL;
+//     }
+//
+//     rfbClientSetClientData(c, &credentials_tag, NULL);
 //     return c;
+// }
 //
-// fail:
+// // rfb_shutdown wakes the thread waiting on the server up, its reads fail
+// // from then on
+// static void rfb_shutdown(rfbClient *c) {
+//     if (c->sock >= 0)
+//         shutdown(c->sock, SHUT_RDWR);
+// }
+//
+// static void rfb_client_cleanup(rfbClient *c) {
+//     client_t *client = get_client(c);
 //     rfbClientCleanup(c);
-//     return NULL;
+//     free_client(client);
 // }
 //
-// static void handle_rfb_server_message(rfbClient *c) {
-//     int i;
-//     for (;;) {
-//         i = WaitForMessage(c, 500);
-//         if (i < 0)
-//             break;
-//         if (i && !HandleRFBServerMessage(c))
-//             break;
+// // rfb_new_fb_client sets a client up around a blank framebuffer without
+// // connecting it, for benchmarks
+// static rfbClient *rfb_new_fb_client(int width, int height) {
+//     client_t *client = new_client();
+//     if (!client)
+//         return NULL;
+//
+//     rfbClient *c = rfb_get_client(client);
+//     c->sock = -1;
+//     c->width = width;
+//     c->height = height;
+//     if (!c->MallocFrameBuffer(c)) {
+//         rfb_client_cleanup(c);
+//         return NULL;
 //     }
+//
+//     return c;
 // }
 //
-// static rfbBool send_fb_update_request(rfbClient *c) {
-//     return SendFramebufferUpdateRequest(c, 0, 0, get_fb_width(c), get_fb_height(c), FALSE);
+// static void rfb_fill_fb(rfbClient *c, int x, int y, int w, int h, uint32_t pixel) {
+//     for (int row = y; row < y + h; ++row)
+//         for (int col = x; col < x + w; ++col)
+//             memcpy(c->frameBuffer + ((size_t)row * get_fb_width(c) + col) * 4, &pixel, 4);
 // }
 //
-// static void rfb_client_cleanup(rfbClient *c) {
-//     rfbClientCleanup(c);
+// // rfb_update_fb goes through what libvncclient calls for an update
+// // touching the given rectangle
+// static void rfb_update_fb(rfbClient *c, int x, int y, int w, int h) {
+//     c->GotFrameBufferUpdate(c, x, y, w, h);
+//     c->FinishedFrameBufferUpdate(c);
 // }
 //
 import "C"
@@ -116,26 +474,95 @@ import "C"
 import (
 	"errors"
 	"image"
+	"image/color"
+	"net"
+	"runtime/cgo"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unsafe"
 )
 
+const (
+	defaultSource = "vnc"
+	// vncWaitTimeout bounds how long Loop waits on the server before it
+	// checks whether the client was destroyed
+	vncWaitTimeout = 100 * time.Millisecond
+)
+
 type VNCClient struct {
-	destroyed bool
+	destroyed uint32
+	audio     *VNCAudio
 	destroy   sync.Once
 	loop      sync.Once
 	addr      *C.char
 	rfbClient *C.rfbClient
+	handle    cgo.Handle
+	serial    uint64
+	updates   chan FrameUpdate
+	done      chan struct{}
+
+	// mutex guards the frames handed from Loop to RequestFrame and the
+	// cursor, and keeps Destroy from freeing the client under them
+	mutex sync.Mutex
+	// decoded is signaled whenever Loop is done with a message
+	decoded  sync.Cond
+	decoding bool
+	// front is the last complete update, until RequestFrame hands it out
+	front  *image.RGBA
+	frames FramePool
+	cursor *Cursor
+}
+
+func cStringOrNil(s string) *C.char {
+	if s == "" {
+		return nil
+	}
+	return C.CString(s)
 }
 
-func NewVNCClient(addr string) (*VNCClient, error) {
-	if addr == "" {
-		addr = "127.0.0.1:5901"
+// NewVNCClient connects to the server, or waits for it to connect for
+// listen: addresses.
+func NewVNCClient(options VNCOptions) (*VNCClient, error) {
+	target, err := parseVNCAddr(options.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// libvncclient dials the local end of SSH and WebSocket tunnels
+	var tunnel net.Conn
+	switch {
+	case target.sshHost != "":
+		tunnel, err = dialSSHTunnel(target, options.SSH)
+	case target.network == "ws":
+		tunnel, err = dialWebSocket(target.address, options.WebSocket)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if tunnel != nil {
+		local, err := forwardConn(tunnel)
+		if err != nil {
+			return nil, err
+		}
+		if target, err = parseVNCAddr(local); err != nil {
+			return nil, err
+		}
+	}
+
+	// libvncclient keeps using the listen address, so it's only freed along
+	// with the client
+	cTarget, cAddr := C.int(C.VNC_TARGET_TCP), target.address
+	switch {
+	case target.network == "unix":
+		cTarget = C.VNC_TARGET_UNIX
+	case target.listen:
+		cTarget, cAddr = C.VNC_TARGET_LISTEN, target.host
 	}
 
 	var vncClient VNCClient
 
-	vncClient.addr = C.CString(addr)
+	vncClient.addr = C.CString(cAddr)
 	if vncClient.addr == nil {
 		return nil, errors.New("CString")
 	}
@@ -147,63 +574,289 @@ func NewVNCClient(addr string) (*VNCClient, error) {
 		}
 	}()
 
-	rfbClient := C.rfb_init_client(vncClient.addr)
+	cRemoteCursor := C.rfbBool(C.FALSE)
+	if options.RemoteCursor {
+		cRemoteCursor = C.TRUE
+	}
+
+	cAudio := C.rfbBool(C.FALSE)
+	if options.Audio {
+		cAudio = C.TRUE
+		vncClient.audio = newVNCAudio(vncAudioFormat)
+	}
+
+	cRequireTLS := C.rfbBool(C.FALSE)
+	if options.TLS.Required {
+		cRequireTLS = C.TRUE
+	}
+
+	// libvncclient keeps a pointer to creds, so it can't be Go memory
+	creds := (*C.credentials_t)(C.calloc(1, C.sizeof_credentials_t))
+	if creds == nil {
+		return nil, errors.New("calloc")
+	}
+	defer C.free(unsafe.Pointer(creds))
+	creds.ca_file = cStringOrNil(options.TLS.CAFile)
+	creds.crl_file = cStringOrNil(options.TLS.CRLFile)
+	creds.cert_file = cStringOrNil(options.TLS.CertFile)
+	creds.key_file = cStringOrNil(options.TLS.KeyFile)
+	creds.username = cStringOrNil(options.TLS.Username)
+	creds.password = cStringOrNil(options.Password)
+	for _, s := range []*C.char{creds.ca_file, creds.crl_file, creds.cert_file, creds.key_file, creds.username, creds.password} {
+		defer C.free(unsafe.Pointer(s))
+	}
+
+	rfbClient := C.rfb_init_client(vncClient.addr, cTarget, C.int(target.port), cRemoteCursor, cAudio, C.int(vncAudioFormat.SampleRate), C.int(vncAudioFormat.Channels), creds, cRequireTLS)
 	if rfbClient == nil {
 		return nil, errors.New("rfb_init_client")
 	}
-	vncClient.rfbClient = rfbClient
+	vncClient.attach(rfbClient)
 
 	ok = true
 	return &vncClient, nil
 }
 
+// newVNCClientFramebuffer sets a client up around a blank framebuffer of
+// the given size without connecting it, so the framebuffer handoff can be
+// benchmarked.
+func newVNCClientFramebuffer(size image.Point) (*VNCClient, error) {
+	rfbClient := C.rfb_new_fb_client(C.int(size.X), C.int(size.Y))
+	if rfbClient == nil {
+		return nil, errors.New("rfb_new_fb_client")
+	}
+
+	var vncClient VNCClient
+	vncClient.attach(rfbClient)
+
+	return &vncClient, nil
+}
+
+func (c *VNCClient) attach(rfbClient *C.rfbClient) {
+	c.rfbClient = rfbClient
+	c.updates = make(chan FrameUpdate, 1)
+	c.done = make(chan struct{})
+	c.decoded.L = &c.mutex
+	c.handle = cgo.NewHandle(c)
+	C.set_client_handle(rfbClient, C.uintptr_t(c.handle))
+}
+
+// fillFramebuffer paints rect like a server update would, without
+// publishing it.
+func (c *VNCClient) fillFramebuffer(rect image.Rectangle, color color.RGBA) {
+	pixel := uint32(color.R) | uint32(color.G)<<8 | uint32(color.B)<<16 | uint32(color.A)<<24
+	C.rfb_fill_fb(c.rfbClient, C.int(rect.Min.X), C.int(rect.Min.Y), C.int(rect.Dx()), C.int(rect.Dy()), C.uint32_t(pixel))
+}
+
+// updateFramebuffer runs the callbacks libvncclient would for an update of
+// rect, on the calling goroutine as if it were running Loop.
+func (c *VNCClient) updateFramebuffer(rect image.Rectangle) {
+	c.decode(func() bool {
+		C.rfb_update_fb(c.rfbClient, C.int(rect.Min.X), C.int(rect.Min.Y), C.int(rect.Dx()), C.int(rect.Dy()))
+		return true
+	})
+}
+
+// Loop handles the server messages until the connection is lost or the
+// client destroyed.
 func (c *VNCClient) Loop() {
 	c.loop.Do(func() {
-		C.handle_rfb_server_message(c.rfbClient)
+		defer close(c.done)
+
+		for atomic.LoadUint32(&c.destroyed) == 0 {
+			ready := C.WaitForMessage(c.rfbClient, C.uint(vncWaitTimeout/time.Microsecond))
+			if ready < 0 {
+				return
+			}
+			if ready == 0 {
+				continue
+			}
+
+			if !c.decode(func() bool { return C.HandleRFBServerMessage(c.rfbClient) != 0 }) {
+				return
+			}
+		}
 	})
 }
 
+// decode runs handle, which writes the framebuffer, keeping RequestFrame
+// from copying it meanwhile.
+func (c *VNCClient) decode(handle func() bool) bool {
+	c.mutex.Lock()
+	c.decoding = true
+	c.mutex.Unlock()
+
+	ok := handle()
+
+	c.mutex.Lock()
+	c.decoding = false
+	c.decoded.Broadcast()
+	c.mutex.Unlock()
+	return ok
+}
+
+// Done is closed once Loop lost the connection.
+func (c *VNCClient) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *VNCClient) Err() error {
+	select {
+	case <-c.done:
+		return errors.New("vnc connection closed")
+	default:
+		return nil
+	}
+}
+
 func (c *VNCClient) Destroy() {
-	c.destroyed = true
 	c.destroy.Do(func() {
+		atomic.StoreUint32(&c.destroyed, 1)
+
+		// the client can only be freed once Loop is done with it, claiming
+		// the loop waits for a running one and keeps it from starting
+		C.rfb_shutdown(c.rfbClient)
+		c.loop.Do(func() {
+			close(c.done)
+		})
+
+		C.set_client_handle(c.rfbClient, 0)
+		c.handle.Delete()
+
+		if c.audio != nil {
+			c.audio.Close()
+		}
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
 		C.rfb_client_cleanup(c.rfbClient)
 		C.free(unsafe.Pointer(c.addr))
 	})
 }
 
+// RequestFrame returns the last complete framebuffer update as a frame,
+// which can be handed back with Recycle once it isn't used anymore.
+// Updates are copied into a pooled frame as they complete and handed out
+// as is. Asked again without a new update, the framebuffer is copied once
+// Loop isn't writing it.
 func (c *VNCClient) RequestFrame() (*image.RGBA, error) {
-	if c.destroyed {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for c.front == nil && c.decoding {
+		c.decoded.Wait()
+	}
+	if atomic.LoadUint32(&c.destroyed) != 0 {
 		return nil, errors.New("destroyed")
 	}
 
-	if C.send_fb_update_request(c.rfbClient) == C.FALSE {
-		return nil, errors.New("send_fb_update_request")
+	if frame := c.front; frame != nil {
+		c.front = nil
+		return frame, nil
 	}
 
-	fbSnapshot := unsafe.Pointer(C.get_fb_snapshot())
-	if fbSnapshot == nil {
-		return nil, errors.New("get_fb_snapshot")
+	fb := C.get_fb(c.rfbClient)
+	width, height := int(C.get_fb_width(c.rfbClient)), int(C.get_fb_height(c.rfbClient))
+	if fb == nil || width <= 0 || height <= 0 {
+		return nil, errors.New("get_fb")
 	}
 
-	fbWidth := int(C.get_fb_width(c.rfbClient))
-	if fbWidth < 0 {
-		return nil, errors.New("get_fb_width")
+	frame := c.frames.Get(image.Rect(0, 0, width, height))
+	copy(frame.Pix, unsafe.Slice((*byte)(unsafe.Pointer(fb)), len(frame.Pix)))
+	return frame, nil
+}
+
+func (c *VNCClient) Recycle(frame *image.RGBA) {
+	c.frames.Put(frame)
+}
+
+func (c *VNCClient) Cursor() (*Cursor, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if atomic.LoadUint32(&c.destroyed) != 0 {
+		return nil, false
 	}
 
-	fbHeight := int(C.get_fb_height(c.rfbClient))
-	if fbHeight < 0 {
-		return nil, errors.New("get_fb_height")
+	var knownSerial C.uint
+	if c.cursor != nil {
+		knownSerial = C.uint(c.cursor.Serial)
 	}
 
-	fbSize := C.calc_fb_size(c.rfbClient)
-	if int(fbSize) < 0 {
-		return nil, errors.New("calc_fb_size")
+	snapshot := C.get_cursor(c.rfbClient, knownSerial)
+	if snapshot.serial == 0 {
+		return nil, false
 	}
 
-	frame := image.NewRGBA(image.Rect(0, 0, fbWidth, fbHeight))
-	copy(frame.Pix, C.GoBytes(fbSnapshot, fbSize))
+	cursor := Cursor{
+		Hotspot:  image.Pt(int(snapshot.xhot), int(snapshot.yhot)),
+		Position: image.Pt(int(snapshot.x), int(snapshot.y)),
+		Serial:   uint(snapshot.serial),
+	}
 
-	return frame, nil
+	if snapshot.rgba != nil {
+		defer C.free(unsafe.Pointer(snapshot.rgba))
+
+		cursor.Image = image.NewRGBA(image.Rect(0, 0, int(snapshot.width), int(snapshot.height)))
+		copy(cursor.Image.Pix, C.GoBytes(unsafe.Pointer(snapshot.rgba), C.int(len(cursor.Image.Pix))))
+	} else if c.cursor != nil && c.cursor.Serial == cursor.Serial {
+		cursor.Image = c.cursor.Image
+	} else {
+		return nil, false
+	}
+
+	c.cursor = &cursor
+	return &cursor, true
+}
+
+// frameUpdated runs on Loop with the framebuffer fb complete, copying what
+// changed into the front frame. A front frame that was handed out since is
+// the receiver's, so a new one starts as a full copy. Only the latest
+// update is kept for slow receivers.
+func (c *VNCClient) frameUpdated(fb []byte, size image.Point, dirty image.Rectangle) {
+	if fb != nil {
+		c.mutex.Lock()
+		if c.front == nil || c.front.Rect.Size() != size {
+			if c.front != nil {
+				c.frames.Put(c.front)
+			}
+			c.front = c.frames.Get(image.Rectangle{Max: size})
+			dirty = c.front.Rect
+		}
+		dirty = dirty.Intersect(c.front.Rect)
+		for y := dirty.Min.Y; y < dirty.Max.Y; y++ {
+			offset := c.front.PixOffset(dirty.Min.X, y)
+			copy(c.front.Pix[offset:offset+dirty.Dx()*4], fb[offset:])
+		}
+		c.mutex.Unlock()
+	}
+
+	notifyFrameUpdate(c.updates, FrameUpdate{
+		Serial: atomic.AddUint64(&c.serial, 1),
+		Time:   time.Now(),
+	})
+}
+
+// audioReceived runs on Loop.
+func (c *VNCClient) audioReceived(data []byte) {
+	if c.audio != nil {
+		c.audio.write(data)
+	}
+}
+
+// Audio returns the audio sent by the server, or nil when it wasn't asked
+// for. It stays silent with servers not supporting QEMU's extension.
+func (c *VNCClient) Audio() *VNCAudio {
+	return c.audio
+}
+
+func (c *VNCClient) FrameUpdates() <-chan FrameUpdate {
+	return c.updates
+}
+
+// FrameSerial counts the framebuffer updates received from the server.
+func (c *VNCClient) FrameSerial() uint64 {
+	return atomic.LoadUint64(&c.serial)
 }
 
 type VNCFrameProvider struct {
@@ -211,9 +864,15 @@ type VNCFrameProvider struct {
 }
 
 var _ FrameProvider = (*VNCFrameProvider)(nil)
+var _ CursorProvider = (*VNCFrameProvider)(nil)
+var _ FrameSerialProvider = (*VNCFrameProvider)(nil)
+var _ FrameRecycler = (*VNCFrameProvider)(nil)
+var _ FrameNotifier = (*VNCFrameProvider)(nil)
+var _ FrameAudioProvider = (*VNCFrameProvider)(nil)
+var _ FrameFailureNotifier = (*VNCFrameProvider)(nil)
 
-func NewVNCFrameProvider(addr string) (*VNCFrameProvider, error) {
-	client, err := NewVNCClient(addr)
+func NewVNCFrameProvider(options VNCOptions) (*VNCFrameProvider, error) {
+	client, err := NewVNCClient(options)
 	if err != nil {
 		return nil, err
 	}
@@ -229,17 +888,44 @@ func (p *VNCFrameProvider) Frame() (*image.RGBA, error) {
 	return p.client.RequestFrame()
 }
 
-func (p *VNCFrameProvider) Close() error {
-	p.client.Destroy()
-	return nil
+func (p *VNCFrameProvider) Recycle(frame *image.RGBA) {
+	p.client.Recycle(frame)
+}
+
+func (p *VNCFrameProvider) FrameUpdates() <-chan FrameUpdate {
+	return p.client.FrameUpdates()
+}
+
+func (p *VNCFrameProvider) FrameSerial() uint64 {
+	return p.client.FrameSerial()
 }
 
-type VNCFrameProviderFactory struct {
-	Addr string
+func (p *VNCFrameProvider) Cursor() (*Cursor, bool) {
+	return p.client.Cursor()
 }
 
-var _ FrameProviderFactory = (*VNCFrameProviderFactory)(nil)
+func (p *VNCFrameProvider) AudioProvider() (AudioProvider, error) {
+	audio := p.client.Audio()
+	if audio == nil {
+		return nil, errors.New("QEMU audio wasn't negotiated")
+	}
+
+	return audio, nil
+}
+
+func (p *VNCFrameProvider) Done() <-chan struct{} {
+	return p.client.Done()
+}
+
+func (p *VNCFrameProvider) Err() error {
+	return p.client.Err()
+}
+
+func (p *VNCFrameProvider) Close() error {
+	p.client.Destroy()
+	return nil
+}
 
 func (f *VNCFrameProviderFactory) NewFrameProvider() (FrameProvider, error) {
-	return NewVNCFrameProvider(f.Addr)
+	return NewVNCFrameProvider(f.Options)
 }
@@ -0,0 +1,15 @@
+//go:build novnc
+
+package main
+
+import (
+	"errors"
+)
+
+// without libvncclient the native client is the default. libvpx and opus
+// are still linked with cgo, see the README.
+const defaultSource = "rfb"
+
+func (f *VNCFrameProviderFactory) NewFrameProvider() (FrameProvider, error) {
+	return nil, errors.New("built without libvncclient, use -source rfb")
+}
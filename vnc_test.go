@@ -0,0 +1,490 @@
+//go:build !novnc
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVNCClientFramebuffer(t *testing.T) {
+	client, err := newVNCClientFramebuffer(image.Pt(64, 48))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	checkFrame := func(want func(x, y int) color.RGBA) {
+		t.Helper()
+
+		frame, err := client.RequestFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Recycle(frame)
+
+		if frame.Rect != image.Rect(0, 0, 64, 48) {
+			t.Fatalf("Rect = %v", frame.Rect)
+		}
+		for y := 0; y < 48; y++ {
+			for x := 0; x < 64; x++ {
+				if got := frame.RGBAAt(x, y); got != want(x, y) {
+					t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, want(x, y))
+				}
+			}
+		}
+	}
+
+	checkFrame(func(x, y int) color.RGBA {
+		return color.RGBA{}
+	})
+
+	first := image.Rect(8, 8, 24, 16)
+	client.fillFramebuffer(first, red)
+	client.updateFramebuffer(first)
+	second := image.Rect(40, 30, 64, 48)
+	client.fillFramebuffer(second, blue)
+	client.updateFramebuffer(second)
+
+	// pixels painted outside of an update aren't published
+	client.fillFramebuffer(image.Rect(0, 0, 4, 4), green)
+	client.updateFramebuffer(image.Rect(0, 0, 0, 0))
+
+	checkFrame(func(x, y int) color.RGBA {
+		switch p := image.Pt(x, y); {
+		case p.In(second):
+			return blue
+		case p.In(first):
+			return red
+		default:
+			return color.RGBA{}
+		}
+	})
+
+	if serial := client.FrameSerial(); serial != 3 {
+		t.Errorf("FrameSerial = %d, want 3", serial)
+	}
+	select {
+	case update := <-client.FrameUpdates():
+		if update.Serial != 3 {
+			t.Errorf("update serial = %d, want 3", update.Serial)
+		}
+	default:
+		t.Error("no update notified")
+	}
+}
+
+func TestVNCClientRequestFrameWhileDecoding(t *testing.T) {
+	client, err := newVNCClientFramebuffer(image.Pt(64, 48))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	release := make(chan struct{})
+	decoding := make(chan struct{})
+	go client.decode(func() bool {
+		close(decoding)
+		<-release
+		client.fillFramebuffer(image.Rect(0, 0, 64, 48), red)
+		return true
+	})
+	<-decoding
+
+	// without a new update the framebuffer is only copied between messages
+	requested := make(chan *image.RGBA, 1)
+	go func() {
+		frame, err := client.RequestFrame()
+		if err != nil {
+			t.Error(err)
+		}
+		requested <- frame
+	}()
+
+	select {
+	case <-requested:
+		t.Fatal("RequestFrame copied the framebuffer while it was written")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case frame := <-requested:
+		if frame != nil && frame.RGBAAt(32, 24) != red {
+			t.Errorf("pixel = %v, want %v", frame.RGBAAt(32, 24), red)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RequestFrame didn't return")
+	}
+}
+
+func TestVNCClientHandsFramesOver(t *testing.T) {
+	client, err := newVNCClientFramebuffer(image.Pt(64, 48))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+
+	client.fillFramebuffer(image.Rect(0, 0, 64, 48), red)
+	client.updateFramebuffer(image.Rect(0, 0, 64, 48))
+
+	first, err := client.RequestFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// frames are the receiver's, drawing on one doesn't change the next
+	first.SetRGBA(0, 0, blue)
+	second, err := client.RequestFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first {
+		t.Fatal("the same frame was handed out twice")
+	}
+	if got := second.RGBAAt(0, 0); got != red {
+		t.Errorf("pixel = %v, want %v", got, red)
+	}
+
+	client.updateFramebuffer(image.Rect(0, 0, 8, 8))
+	third, err := client.RequestFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third == first || third == second {
+		t.Fatal("a frame still in use was handed out again")
+	}
+	if got := third.RGBAAt(0, 0); got != red {
+		t.Errorf("pixel = %v, want %v", got, red)
+	}
+}
+
+func TestVNCClientDestroy(t *testing.T) {
+	client, err := newVNCClientFramebuffer(image.Pt(64, 48))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go client.Loop()
+	client.Destroy()
+
+	select {
+	case <-client.Done():
+	default:
+		t.Error("Destroy returned before Loop")
+	}
+	if _, err := client.RequestFrame(); err == nil {
+		t.Error("RequestFrame after Destroy succeeded")
+	}
+	if _, ok := client.Cursor(); ok {
+		t.Error("Cursor after Destroy returned a cursor")
+	}
+
+	// Loop can't start on a destroyed client
+	client.Loop()
+}
+
+// QEMU's audio extension, as sent by the server.
+const (
+	qemuAudioEncoding = -259
+	qemuMessage       = 255
+	qemuAudio         = 1
+	qemuAudioEnd      = 0
+	qemuAudioBegin    = 1
+	qemuAudioData     = 2
+	qemuAudioMaxData  = 1 << 20
+)
+
+// clientMessage reads a message from a libvncclient client, QEMU ones are
+// only expected for audio.
+func (s *fakeRFBServer) clientMessage() ([]byte, bool) {
+	message, ok := s.read(1)
+	if !ok {
+		return nil, false
+	}
+
+	var body []byte
+	switch message[0] {
+	case rfbSetPixelFormat:
+		body, ok = s.read(19)
+	case rfbSetEncodings:
+		if body, ok = s.read(3); ok {
+			var encodings []byte
+			encodings, ok = s.read(4 * int(binary.BigEndian.Uint16(body[1:])))
+			body = append(body, encodings...)
+		}
+	case rfbFramebufferUpdateReq:
+		body, ok = s.read(9)
+	case qemuMessage:
+		if body, ok = s.read(3); ok && body[0] == qemuAudio && body[2] == 2 {
+			var format []byte
+			format, ok = s.read(6)
+			body = append(body, format...)
+		}
+	default:
+		s.t.Errorf("unexpected client message %d", message[0])
+		return nil, false
+	}
+	return append(message, body...), ok
+}
+
+func TestVNCClientAudio(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	pcm := stereoFrames(0, 99)
+	checked := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serveFakeRFB(t, conn, func(s *fakeRFBServer) bool {
+			if !fakeRFBNoAuth(image.Pt(64, 48))(s) {
+				return false
+			}
+
+			// the client asks for audio without enabling it yet
+			for {
+				message, ok := s.clientMessage()
+				if !ok {
+					return false
+				}
+				if message[0] == qemuMessage {
+					t.Errorf("QEMU message %v before the pseudo-encoding was acknowledged", message)
+					return false
+				}
+				if message[0] != rfbSetEncodings {
+					continue
+				}
+
+				advertised := false
+				for i := 4; i < len(message); i += 4 {
+					if int32(binary.BigEndian.Uint32(message[i:])) == qemuAudioEncoding {
+						advertised = true
+					}
+				}
+				if !advertised {
+					t.Error("QEMU audio encoding not advertised")
+					return false
+				}
+				break
+			}
+
+			if !s.write(uint8(rfbFramebufferUpdate), uint8(0), uint16(1), [4]uint16{}, int32(qemuAudioEncoding)) {
+				return false
+			}
+
+			var set []byte
+			for set == nil {
+				message, ok := s.clientMessage()
+				if !ok {
+					return false
+				}
+				if message[0] == qemuMessage {
+					set = message
+				}
+			}
+			// S16 stereo at 48kHz, then enabled
+			want := []byte{qemuMessage, qemuAudio, 0, 2, 3, 2, 0, 0, 0xBB, 0x80}
+			if !bytes.Equal(set, want) {
+				t.Errorf("set format = %v, want %v", set, want)
+			}
+			enable, ok := s.clientMessage()
+			if !ok {
+				return false
+			}
+			if want := []byte{qemuMessage, qemuAudio, 0, 0}; !bytes.Equal(enable, want) {
+				t.Errorf("enable = %v, want %v", enable, want)
+			}
+
+			// the data is split mid frame and framed by begin and end
+			if !s.write(uint8(qemuMessage), uint8(qemuAudio), uint16(qemuAudioBegin)) ||
+				!s.write(uint8(qemuMessage), uint8(qemuAudio), uint16(qemuAudioData), uint32(150), pcm[:150]) ||
+				!s.write(uint8(qemuMessage), uint8(qemuAudio), uint16(qemuAudioData), uint32(len(pcm)-150), pcm[150:]) ||
+				!s.write(uint8(qemuMessage), uint8(qemuAudio), uint16(qemuAudioEnd)) {
+				return false
+			}
+
+			select {
+			case <-checked:
+			case <-time.After(5 * time.Second):
+				return false
+			}
+			// too much data at once drops the connection
+			return s.write(uint8(qemuMessage), uint8(qemuAudio), uint16(qemuAudioData), uint32(qemuAudioMaxData+1))
+		})
+	}()
+
+	client, err := NewVNCClient(VNCOptions{Addr: listener.Addr().String(), Audio: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Destroy()
+	go client.Loop()
+
+	audio := client.Audio()
+	if audio == nil {
+		t.Fatal("Audio = nil")
+	}
+
+	read := make(chan error, 1)
+	samples := make([]int16, len(pcm)/2)
+	go func() {
+		read <- audio.ReadAudio(samples)
+	}()
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStereoFrames(t, samples, 0)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no audio received")
+	}
+	close(checked)
+
+	select {
+	case <-client.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("oversized audio data was accepted")
+	}
+}
+
+func benchmarkVNCClient(b *testing.B) *VNCClient {
+	client, err := newVNCClientFramebuffer(image.Pt(1920, 1080))
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(client.Destroy)
+
+	client.fillFramebuffer(image.Rect(0, 0, 1920, 1080), gray)
+	client.updateFramebuffer(image.Rect(0, 0, 1920, 1080))
+	return client
+}
+
+// BenchmarkCopyFrame asks for frames without updates in between, so each
+// is a single copy out of the framebuffer into a pooled frame.
+func BenchmarkCopyFrame(b *testing.B) {
+	client := benchmarkVNCClient(b)
+
+	b.SetBytes(1920 * 1080 * 4)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		frame, err := client.RequestFrame()
+		if err != nil {
+			b.Fatal(err)
+		}
+		client.Recycle(frame)
+	}
+}
+
+// BenchmarkCopyFrameDuringUpdates asks for frames while full screen updates
+// keep being published, a thousand a second.
+func BenchmarkCopyFrameDuringUpdates(b *testing.B) {
+	client := benchmarkVNCClient(b)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(done)
+		<-stopped
+	}()
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				client.updateFramebuffer(image.Rect(0, 0, 1920, 1080))
+			}
+		}
+	}()
+
+	b.SetBytes(1920 * 1080 * 4)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		frame, err := client.RequestFrame()
+		if err != nil {
+			b.Fatal(err)
+		}
+		client.Recycle(frame)
+	}
+}
+
+// BenchmarkCopyFrameAllocating is how frames used to be copied, through a
+// fresh buffer and again into a new image, for comparison.
+func BenchmarkCopyFrameAllocating(b *testing.B) {
+	fb := make([]byte, 1920*1080*4)
+
+	b.SetBytes(int64(len(fb)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		snapshot := append([]byte(nil), fb...)
+		frame := image.NewRGBA(image.Rect(0, 0, 1920, 1080))
+		copy(frame.Pix, snapshot)
+	}
+}
+
+// BenchmarkFrame is an update followed by asking for the frame, one copy
+// whatever the size of the update.
+func BenchmarkFrame(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		rect image.Rectangle
+	}{
+		{"full", image.Rect(0, 0, 1920, 1080)},
+		{"64x64", image.Rect(100, 100, 164, 164)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			client := benchmarkVNCClient(b)
+
+			b.SetBytes(1920 * 1080 * 4)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.updateFramebuffer(bench.rect)
+				frame, err := client.RequestFrame()
+				if err != nil {
+					b.Fatal(err)
+				}
+				client.Recycle(frame)
+			}
+		})
+	}
+}
+
+// BenchmarkPublishUpdate publishes updates nobody asks for, which only copy
+// what changed.
+func BenchmarkPublishUpdate(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		rect image.Rectangle
+	}{
+		{"full", image.Rect(0, 0, 1920, 1080)},
+		{"64x64", image.Rect(100, 100, 164, 164)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			client := benchmarkVNCClient(b)
+
+			b.SetBytes(int64(bench.rect.Dx() * bench.rect.Dy() * 4))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				client.updateFramebuffer(bench.rect)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultVNCAddr       = "127.0.0.1:5901"
+	vncDisplayPortOffset = 5900
+	// VNC servers make reverse connections to port 5500 by default
+	defaultVNCListenPort = 5500
+	// vncForwardTimeout is how long libvncclient has to connect to the
+	// local end of a tunnel.
+	vncForwardTimeout = 30 * time.Second
+)
+
+// vncAddr is where a VNC server is reached, parsed from HOST[:PORT] to dial
+// it, unix:PATH for a UNIX socket, listen:[HOST:]PORT to wait for the
+// server to connect, as servers behind NAT do with reverse connections, or
+// ssh://[USER@]BASTION[:PORT]/ADDR to tunnel to a server only listening on
+// the bastion's side. ws:// and wss:// URLs are websockify endpoints, kept
+// whole as the address.
+type vncAddr struct {
+	network string
+	address string
+	listen  bool
+	host    string
+	port    int
+	sshUser string
+	sshHost string
+}
+
+func parseVNCAddr(addr string) (vncAddr, error) {
+	if addr == "" {
+		addr = defaultVNCAddr
+	}
+
+	if strings.HasPrefix(addr, "ssh://") {
+		return parseSSHVNCAddr(addr)
+	}
+
+	if strings.HasPrefix(addr, "ws://") || strings.HasPrefix(addr, "wss://") {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return vncAddr{}, fmt.Errorf("invalid VNC address %q: %w", addr, err)
+		}
+		if u.Host == "" {
+			return vncAddr{}, fmt.Errorf("invalid VNC address %q: missing host", addr)
+		}
+
+		return vncAddr{network: "ws", address: addr}, nil
+	}
+
+	if path, ok := cutPrefix(addr, "unix:"); ok {
+		if path == "" {
+			return vncAddr{}, fmt.Errorf("invalid VNC address %q", addr)
+		}
+
+		return vncAddr{network: "unix", address: path}, nil
+	}
+
+	listen, isListen := cutPrefix(addr, "listen:")
+	if isListen {
+		addr = listen
+		if addr == "" {
+			addr = strconv.Itoa(defaultVNCListenPort)
+		}
+		if !strings.Contains(addr, ":") {
+			addr = ":" + addr
+		}
+	}
+
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil && !isListen {
+		host, portString, err = addr, "0", nil
+	}
+	if err != nil {
+		return vncAddr{}, fmt.Errorf("invalid VNC address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return vncAddr{}, fmt.Errorf("invalid VNC port %q", portString)
+	}
+
+	// like vncviewer, ports below 100 are display numbers
+	if !isListen && port < 100 {
+		port += vncDisplayPortOffset
+		addr = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+
+	parsed := vncAddr{
+		network: "tcp",
+		address: addr,
+		listen:  isListen,
+		host:    host,
+		port:    port,
+	}
+	return parsed, nil
+}
+
+func parseSSHVNCAddr(addr string) (vncAddr, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return vncAddr{}, fmt.Errorf("invalid VNC address %q: %w", addr, err)
+	}
+	if u.Hostname() == "" {
+		return vncAddr{}, fmt.Errorf("invalid VNC address %q: missing SSH host", addr)
+	}
+
+	target, err := parseVNCAddr(strings.TrimPrefix(u.Path, "/"))
+	if err != nil {
+		return vncAddr{}, err
+	}
+	if target.listen || target.sshHost != "" || target.network == "ws" {
+		return vncAddr{}, fmt.Errorf("invalid VNC address %q: only servers can be tunneled to", addr)
+	}
+
+	target.sshUser = u.User.Username()
+	if target.sshUser == "" {
+		target.sshUser = os.Getenv("USER")
+		if current, err := user.Current(); err == nil {
+			target.sshUser = current.Username
+		}
+	}
+
+	target.sshHost = u.Host
+	if u.Port() == "" {
+		target.sshHost = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	return target, nil
+}
+
+// cutPrefix is strings.CutPrefix, which needs Go 1.20.
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// accept waits for a single reverse connection.
+func (a vncAddr) accept() (net.Conn, error) {
+	listener, err := net.Listen(a.network, a.address)
+	if err != nil {
+		return nil, err
+	}
+	defer listener.Close()
+
+	return listener.Accept()
+}
+
+// forwardConn relays the first connection to a local UNIX socket through
+// conn, for libvncclient, which can only dial addresses itself. The socket
+// lives in a private directory, so other local users can't connect first.
+func forwardConn(conn net.Conn) (string, error) {
+	dir, err := os.MkdirTemp("", "vnc2webrtc")
+	if err != nil {
+		conn.Close()
+		return "", err
+	}
+
+	path := filepath.Join(dir, "vnc.sock")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		os.RemoveAll(dir)
+		conn.Close()
+		return "", err
+	}
+
+	go func() {
+		defer conn.Close()
+		defer os.RemoveAll(dir)
+		defer listener.Close()
+
+		listener.SetDeadline(time.Now().Add(vncForwardTimeout))
+		local, err := listener.Accept()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		defer local.Close()
+		listener.Close()
+		os.RemoveAll(dir)
+
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(conn, local)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(local, conn)
+			done <- struct{}{}
+		}()
+		<-done
+	}()
+
+	return "unix:" + path, nil
+}
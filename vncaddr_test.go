@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseVNCAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want vncAddr
+		ok   bool
+	}{
+		{"", vncAddr{network: "tcp", address: "127.0.0.1:5901", host: "127.0.0.1", port: 5901}, true},
+		{"example.com", vncAddr{network: "tcp", address: "example.com:5900", host: "example.com", port: 5900}, true},
+		// ports below 100 are display numbers
+		{"example.com:1", vncAddr{network: "tcp", address: "example.com:5901", host: "example.com", port: 5901}, true},
+		{"example.com:5999", vncAddr{network: "tcp", address: "example.com:5999", host: "example.com", port: 5999}, true},
+		{"[::1]:5901", vncAddr{network: "tcp", address: "[::1]:5901", host: "::1", port: 5901}, true},
+		{"example.com:99999", vncAddr{}, false},
+
+		{"unix:/run/vnc.sock", vncAddr{network: "unix", address: "/run/vnc.sock"}, true},
+		{"unix:", vncAddr{}, false},
+
+		{"listen:", vncAddr{network: "tcp", address: ":5500", listen: true, port: 5500}, true},
+		{"listen:5600", vncAddr{network: "tcp", address: ":5600", listen: true, port: 5600}, true},
+		// listen ports aren't display numbers
+		{"listen:1", vncAddr{network: "tcp", address: ":1", listen: true, port: 1}, true},
+		{"listen:127.0.0.1:5600", vncAddr{network: "tcp", address: "127.0.0.1:5600", listen: true, host: "127.0.0.1", port: 5600}, true},
+		{"listen:[::1]:5600", vncAddr{network: "tcp", address: "[::1]:5600", listen: true, host: "::1", port: 5600}, true},
+		{"listen:port", vncAddr{}, false},
+
+		{"ssh://admin@bastion/10.0.0.2:1", vncAddr{network: "tcp", address: "10.0.0.2:5901", host: "10.0.0.2", port: 5901, sshUser: "admin", sshHost: "bastion:22"}, true},
+		{"ssh://admin@bastion:2222/unix:/run/vnc.sock", vncAddr{network: "unix", address: "/run/vnc.sock", sshUser: "admin", sshHost: "bastion:2222"}, true},
+		{"ssh://admin@bastion/listen:5500", vncAddr{}, false},
+		{"ssh:///10.0.0.2:1", vncAddr{}, false},
+
+		{"wss://pve.example.com:8006/websockify?port=5900", vncAddr{network: "ws", address: "wss://pve.example.com:8006/websockify?port=5900"}, true},
+		{"ws:///websockify", vncAddr{}, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseVNCAddr(test.addr)
+		if (err == nil) != test.ok {
+			t.Errorf("parseVNCAddr(%q) error = %v", test.addr, err)
+			continue
+		}
+		if test.ok && got != test.want {
+			t.Errorf("parseVNCAddr(%q) = %+v, want %+v", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestRFBUnixAddr(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vnc.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		serveFakeRFB(t, conn, fakeRFBNoAuth(image.Pt(64, 48)))
+	}()
+
+	client, err := NewRFBClient(RFBOptions{Addr: "unix:" + path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if client.name != "desktop" {
+		t.Errorf("name = %q, want %q", client.name, "desktop")
+	}
+}
+
+// dialBack connects to addr like a VNC server making a reverse connection,
+// retrying until the client listens.
+func dialBack(t *testing.T, addr string) {
+	go func() {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			serveFakeRFB(t, conn, fakeRFBNoAuth(image.Pt(64, 48)))
+			return
+		}
+	}()
+}
+
+func TestRFBReverseConnection(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	factory := RFBFrameProviderFactory{
+		Options: RFBOptions{Addr: "listen:" + addr},
+	}
+
+	for i := 0; i < 2; i++ {
+		dialBack(t, addr)
+		provider, err := factory.NewFrameProvider()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		frame, err := provider.Frame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := frame.Rect.Size(); size != image.Pt(64, 48) {
+			t.Errorf("frame size = %v, want %v", size, image.Pt(64, 48))
+		}
+		provider.(FrameRecycler).Recycle(frame)
+
+		// the port is only held while waiting, the next viewer listens again
+		provider.Close()
+	}
+}
+
+func TestForwardConn(t *testing.T) {
+	remote, tunnel := net.Pipe()
+	defer remote.Close()
+
+	local, err := forwardConn(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr, err := parseVNCAddr(local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr.network != "unix" {
+		t.Fatalf("forwarded to %q, want a UNIX socket", local)
+	}
+
+	dir := filepath.Dir(addr.address)
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("socket directory mode = %v, want 0700", perm)
+	}
+
+	conn, err := net.Dial("unix", addr.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(remote, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Errorf("relayed %q, want %q", buf, "ping")
+	}
+
+	go remote.Write([]byte("pong"))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "pong" {
+		t.Errorf("relayed %q, want %q", buf, "pong")
+	}
+
+	// only the first connection is relayed, the socket is gone after it
+	timeout := time.After(5 * time.Second)
+	for {
+		if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		select {
+		case <-timeout:
+			t.Fatal("socket directory wasn't removed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
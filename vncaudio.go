@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+const (
+	// vncAudioBufferSeconds bounds the audio waiting to be encoded, older
+	// samples are dropped when the encoder falls behind.
+	vncAudioBufferSeconds = 1
+)
+
+// vncAudioFormat is what QEMU is asked to resample the guest audio to.
+var vncAudioFormat = defaultAudioFormat
+
+// VNCAudio buffers the PCM audio received through QEMU's audio extension
+// until it's read by the encoder.
+type VNCAudio struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	format  AudioFormat
+	samples []int16
+	closed  bool
+}
+
+var _ AudioProvider = (*VNCAudio)(nil)
+
+func newVNCAudio(format AudioFormat) *VNCAudio {
+	audio := VNCAudio{
+		format: format,
+	}
+	audio.cond = sync.NewCond(&audio.mutex)
+	return &audio
+}
+
+// write must not block, it runs on the libvncclient thread. QEMU sends
+// samples in its host byte order, little endian on every host it's
+// practically run on.
+func (a *VNCAudio) write(data []byte) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.closed {
+		return
+	}
+
+	for i := 0; i+2 <= len(data); i += 2 {
+		a.samples = append(a.samples, int16(binary.LittleEndian.Uint16(data[i:])))
+	}
+
+	limit := vncAudioBufferSeconds * a.format.SampleRate * a.format.Channels
+	if excess := len(a.samples) - limit; excess > 0 {
+		// whole frames are dropped so channels stay interleaved in order
+		excess += (a.format.Channels - excess%a.format.Channels) % a.format.Channels
+		a.samples = append(a.samples[:0], a.samples[excess:]...)
+	}
+
+	a.cond.Broadcast()
+}
+
+func (a *VNCAudio) AudioFormat() AudioFormat {
+	return a.format
+}
+
+func (a *VNCAudio) ReadAudio(pcm []int16) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for !a.closed && len(a.samples) < len(pcm) {
+		a.cond.Wait()
+	}
+	if a.closed {
+		return io.EOF
+	}
+
+	n := copy(pcm, a.samples)
+	a.samples = append(a.samples[:0], a.samples[n:]...)
+	return nil
+}
+
+func (a *VNCAudio) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.closed = true
+	a.samples = nil
+	a.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// stereoFrames encodes frames first to last as QEMU does, with the frame
+// number on the left channel and its negation on the right one.
+func stereoFrames(first, last int) []byte {
+	data := make([]byte, 4*(last-first+1))
+	for i := first; i <= last; i++ {
+		binary.LittleEndian.PutUint16(data[4*(i-first):], uint16(int16(i)))
+		binary.LittleEndian.PutUint16(data[4*(i-first)+2:], uint16(-int16(i)))
+	}
+	return data
+}
+
+func checkStereoFrames(t *testing.T, pcm []int16, first int) {
+	t.Helper()
+
+	for i := 0; i < len(pcm)/2; i++ {
+		frame := int16(first + i)
+		if pcm[2*i] != frame || pcm[2*i+1] != -frame {
+			t.Fatalf("frame %d = %v, want [%d %d]", i, pcm[2*i:2*i+2], frame, -frame)
+		}
+	}
+}
+
+func TestVNCAudioReadAudio(t *testing.T) {
+	audio := newVNCAudio(AudioFormat{SampleRate: 48000, Channels: 2})
+	defer audio.Close()
+
+	// the odd byte at the end isn't a sample
+	audio.write(append(stereoFrames(0, 2), 0xFF))
+	audio.write(stereoFrames(3, 5))
+
+	pcm := make([]int16, 4)
+	for first := 0; first < 6; first += 2 {
+		if err := audio.ReadAudio(pcm); err != nil {
+			t.Fatal(err)
+		}
+		checkStereoFrames(t, pcm, first)
+	}
+
+	// reads wait for enough samples
+	read := make(chan error, 1)
+	go func() {
+		read <- audio.ReadAudio(pcm)
+	}()
+
+	audio.write(stereoFrames(6, 6))
+	select {
+	case err := <-read:
+		t.Fatalf("ReadAudio returned %v with half the samples", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	audio.write(stereoFrames(7, 7))
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkStereoFrames(t, pcm, 6)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadAudio didn't return")
+	}
+}
+
+func TestVNCAudioOverflow(t *testing.T) {
+	// a second is 10 frames, 20 samples
+	audio := newVNCAudio(AudioFormat{SampleRate: 10, Channels: 2})
+	defer audio.Close()
+
+	// 12 frames, the 2 oldest are dropped
+	audio.write(stereoFrames(0, 11))
+	pcm := make([]int16, 20)
+	if err := audio.ReadAudio(pcm); err != nil {
+		t.Fatal(err)
+	}
+	checkStereoFrames(t, pcm, 2)
+
+	// with a frame split across writes, one sample over the limit drops a
+	// whole frame, leaving the right channel of frame 10 to come
+	data := stereoFrames(0, 10)
+	audio.write(data[:len(data)-2])
+	audio.write(data[len(data)-2:])
+	if err := audio.ReadAudio(pcm); err != nil {
+		t.Fatal(err)
+	}
+	checkStereoFrames(t, pcm, 1)
+}
+
+func TestVNCAudioClose(t *testing.T) {
+	audio := newVNCAudio(AudioFormat{SampleRate: 48000, Channels: 2})
+
+	read := make(chan error, 1)
+	go func() {
+		read <- audio.ReadAudio(make([]int16, 4))
+	}()
+
+	audio.write(stereoFrames(0, 0))
+	audio.Close()
+
+	select {
+	case err := <-read:
+		if !errors.Is(err, io.EOF) {
+			t.Errorf("ReadAudio = %v, want io.EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't wake ReadAudio up")
+	}
+
+	audio.write(stereoFrames(1, 2))
+	if err := audio.ReadAudio(make([]int16, 2)); !errors.Is(err, io.EOF) {
+		t.Errorf("ReadAudio after Close = %v, want io.EOF", err)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build !novnc
+
+package main
+
+// #include <stdint.h>
+import "C"
+
+import (
+	"image"
+	"runtime/cgo"
+	"unsafe"
+)
+
+//export vncFrameUpdated
+func vncFrameUpdated(handle C.uintptr_t, fb *C.uchar, width, height, x1, y1, x2, y2 C.int) {
+	client, ok := cgo.Handle(handle).Value().(*VNCClient)
+	if !ok {
+		return
+	}
+
+	var pix []byte
+	if fb != nil {
+		pix = unsafe.Slice((*byte)(unsafe.Pointer(fb)), int(width)*int(height)*4)
+	}
+	client.frameUpdated(pix, image.Pt(int(width), int(height)), image.Rectangle{Min: image.Pt(int(x1), int(y1)), Max: image.Pt(int(x2), int(y2))})
+}
+
+//export vncAudioReceived
+func vncAudioReceived(handle C.uintptr_t, data unsafe.Pointer, length C.int) {
+	client, ok := cgo.Handle(handle).Value().(*VNCClient)
+	if !ok {
+		return
+	}
+
+	client.audioReceived(unsafe.Slice((*byte)(data), int(length)))
+}
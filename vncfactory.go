@@ -0,0 +1,44 @@
+package main
+
+type VNCOptions struct {
+	// Addr is the HOST[:PORT] of the VNC server, unix:PATH for a UNIX
+	// socket, listen:[HOST:]PORT to wait for a reverse connection,
+	// ssh://[USER@]BASTION[:PORT]/ADDR to tunnel through SSH or a ws:// or
+	// wss:// websockify URL.
+	Addr string
+	// Password is used by VNC authentication and VeNCrypt Plain, which also
+	// sends TLS.Username.
+	Password string
+	// RemoteCursor asks the server to send the cursor separately instead of
+	// painting it in the framebuffer.
+	RemoteCursor bool
+	// Audio negotiates QEMU's audio extension, for FrameProviderAudio.
+	Audio     bool
+	TLS       VNCTLSOptions
+	SSH       SSHOptions
+	WebSocket WebSocketOptions
+}
+
+// VNCTLSOptions configures the TLS based security types, VeNCrypt and
+// AnonTLS, when libvncclient is built with GnuTLS or OpenSSL. AnonTLS and
+// the TLS* VeNCrypt subtypes only encrypt, they don't authenticate the
+// server and are open to man-in-the-middle attacks.
+type VNCTLSOptions struct {
+	// Required refuses servers that don't offer a TLS security type.
+	Required bool
+	// CAFile verifies the certificate of VeNCrypt X509 servers, which
+	// libvncclient refuses without one. With it, only the X509 VeNCrypt
+	// subtypes are accepted.
+	CAFile  string
+	CRLFile string
+	// CertFile and KeyFile authenticate the client to servers asking for it.
+	CertFile string
+	KeyFile  string
+	Username string
+}
+
+type VNCFrameProviderFactory struct {
+	Options VNCOptions
+}
+
+var _ FrameProviderFactory = (*VNCFrameProviderFactory)(nil)
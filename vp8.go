@@ -2,85 +2,21 @@ package main
 
 // #cgo pkg-config: vpx
 //
-// #include <string.h>
 // #include <vpx/vp8cx.h>
 // #include <vpx/vpx_encoder.h>
 //
-// void rgba2yuv(uint8_t *yuv, uint8_t *rgba, size_t width, size_t height) {
-//     size_t i = 0;
-//
-//     size_t upos = width * height;
-//     size_t vpos = upos + upos / 4;
-//
-//     for (size_t line = 0; line < height; ++line)
-//         if (line % 2)
-//             for (size_t column = 0; column < width; column += 1) {
-//                 uint8_t r = rgba[4 * i];
-//                 uint8_t g = rgba[4 * i + 1];
-//                 uint8_t b = rgba[4 * i + 2];
-//
-//                 yuv[i++] = ((66 * r + 129 * g + 25 * b) >> 8) + 16;
-//             }
-//         else
-//             for (size_t column = 0; column < width; column += 2) {
-//                 uint8_t r = rgba[4 * i];
-//                 uint8_t g = rgba[4 * i + 1];
-//                 uint8_t b = rgba[4 * i + 2];
-//
-//                 yuv[i++] = ((66 * r + 129 * g + 25 * b) >> 8) + 16;
-//
-//                 yuv[upos++] = ((-38 * r + -74 * g + 112 * b) >> 8) + 128;
-//                 yuv[vpos++] = ((112 * r + -94 * g + -18 * b) >> 8) + 128;
-//
-//                 r = rgba[4 * i];
-//                 g = rgba[4 * i + 1];
-//                 b = rgba[4 * i + 2];
-//
-//                 yuv[i++] = ((66 * r + 129 * g + 25 * b) >> 8) + 16;
-//             }
-// }
-//
-// int vpx_width(const vpx_image_t *img, int plane) {
-//     if (plane <= 0 || img->x_chroma_shift <= 0)
-//         return img->d_w;
-//
-//     return (img->d_w + 1) >> img->x_chroma_shift;
+// vpx_codec_err_t encode(vpx_codec_ctx_t *ctx, vpx_image_t *img, vpx_codec_pts_t pts, unsigned long duration, uint64_t flags) {
+//     return vpx_codec_encode(ctx, img, pts, duration, flags, VPX_DL_REALTIME);
 // }
 //
-// int vpx_height(const vpx_image_t *img, int plane) {
-//     if (plane <= 0 || img->y_chroma_shift <= 0)
-//         return img->d_h;
-//
-//     return (img->d_h + 1) >> img->y_chroma_shift;
-// }
-//
-// void yuv2vpx(vpx_image_t *img, uint8_t *yuv) {
-//     for (int plane = 0; plane < 3; ++plane) {
-//         const int h = vpx_height(img, plane);
-//         const int w = vpx_width(img, plane) * ((img->fmt & VPX_IMG_FMT_HIGHBITDEPTH) ? 2 : 1);
-//         const int stride = img->stride[plane];
-//         unsigned char *buf = img->planes[plane];
-//
-//         for (int i = 0; i < h; ++i) {
-//             memcpy(buf, yuv, w);
-//             buf += stride;
-//             yuv += w;
-//         }
-//     }
-// }
-//
-// size_t encode(vpx_codec_ctx_t *ctx, vpx_image_t *img, vpx_codec_pts_t pts, uint64_t flags, void *rgba, void *yuv, size_t w, size_t h, void **fb) {
-//     rgba2yuv(yuv, rgba, w, h);
-//     yuv2vpx(img, yuv);
-//     if (vpx_codec_encode(ctx, img, pts, 1, flags, VPX_DL_REALTIME) != 0)
-//         return 0;
-//
+// int next_frame_pkt(vpx_codec_ctx_t *ctx, vpx_codec_iter_t *iter, void **buf, size_t *sz, vpx_codec_frame_flags_t *flags) {
 //     const vpx_codec_cx_pkt_t *pkt = NULL;
-//     vpx_codec_iter_t iter = NULL;
-//     while ((pkt = vpx_codec_get_cx_data(ctx, &iter)))
+//     while ((pkt = vpx_codec_get_cx_data(ctx, iter)))
 //         if (pkt->kind == VPX_CODEC_CX_FRAME_PKT) {
-//             *fb = pkt->data.frame.buf;
-//             return pkt->data.frame.sz;
+//             *buf = pkt->data.frame.buf;
+//             *sz = pkt->data.frame.sz;
+//             *flags = pkt->data.frame.flags;
+//             return 1;
 //         }
 //
 //     return 0;
@@ -94,29 +30,124 @@ package main
 //     return vpx_codec_enc_init(codec, vpx_codec_vp8_cx(), cfg, 0);
 // }
 //
+// vpx_codec_err_t codec_set_temporal_layer_id(vpx_codec_ctx_t *codec, int layer_id) {
+//     return vpx_codec_control(codec, VP8E_SET_TEMPORAL_LAYER_ID, layer_id);
+// }
+//
 import "C"
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"image"
+	"time"
 	"unsafe"
 )
 
 const (
-	keyFrameInterval = 10
+	vp8ClockRate    = 90000
+	defaultBitrate  = 90000
+	maxVP8Dimension = 16383
 )
 
+var ErrFrameDropped = errors.New("frame dropped by encoder")
+
+// vp8ColorSpace is limited range BT.601, the only one VP8 decoders know.
+// Unlike VP9, the bitstream can't signal another one.
+var vp8ColorSpace = ColorSpace{Matrix: ColorMatrixBT601}
+
+// fitVP8Size scales sizes over the VP8 maximum down, keeping their aspect
+// ratio. The limit is kept even so padding odd sizes can't go over it.
+func fitVP8Size(size image.Point) image.Point {
+	const limit = maxVP8Dimension &^ 1
+
+	if size.X > limit || size.Y > limit {
+		if size.X >= size.Y {
+			size = image.Pt(limit, size.Y*limit/size.X)
+		} else {
+			size = image.Pt(size.X*limit/size.Y, limit)
+		}
+	}
+
+	if size.X < 1 {
+		size.X = 1
+	}
+	if size.Y < 1 {
+		size.Y = 1
+	}
+	return size
+}
+
+type vp8TemporalPattern struct {
+	// bitrate share of each layer and the ones below it, in percent
+	bitrateShares  []uint
+	rateDecimators []uint
+	layerIDs       []uint
+	flags          []C.uint64_t
+}
+
+// patterns from libvpx's examples/vpx_temporal_svc_encoder.c, indexed by
+// number of layers; only TL0 frames update the last reference, so a layer
+// frame referencing nothing else is a sync point for that layer
+var vp8TemporalPatterns = map[uint]vp8TemporalPattern{
+	2: {
+		bitrateShares:  []uint{60, 100},
+		rateDecimators: []uint{2, 1},
+		layerIDs:       []uint{0, 1},
+		flags: []C.uint64_t{
+			C.VP8_EFLAG_NO_REF_GF | C.VP8_EFLAG_NO_REF_ARF | C.VP8_EFLAG_NO_UPD_GF | C.VP8_EFLAG_NO_UPD_ARF,
+			C.VP8_EFLAG_NO_REF_ARF | C.VP8_EFLAG_NO_UPD_LAST | C.VP8_EFLAG_NO_UPD_ARF,
+		},
+	},
+	3: {
+		bitrateShares:  []uint{40, 60, 100},
+		rateDecimators: []uint{4, 2, 1},
+		layerIDs:       []uint{0, 2, 1, 2},
+		flags: []C.uint64_t{
+			C.VP8_EFLAG_NO_REF_GF | C.VP8_EFLAG_NO_REF_ARF | C.VP8_EFLAG_NO_UPD_GF | C.VP8_EFLAG_NO_UPD_ARF,
+			C.VP8_EFLAG_NO_REF_GF | C.VP8_EFLAG_NO_REF_ARF | C.VP8_EFLAG_NO_UPD_LAST | C.VP8_EFLAG_NO_UPD_GF | C.VP8_EFLAG_NO_UPD_ARF | C.VP8_EFLAG_NO_UPD_ENTROPY,
+			C.VP8_EFLAG_NO_REF_GF | C.VP8_EFLAG_NO_REF_ARF | C.VP8_EFLAG_NO_UPD_LAST | C.VP8_EFLAG_NO_UPD_GF,
+			C.VP8_EFLAG_NO_REF_GF | C.VP8_EFLAG_NO_UPD_LAST | C.VP8_EFLAG_NO_UPD_GF | C.VP8_EFLAG_NO_UPD_ARF | C.VP8_EFLAG_NO_UPD_ENTROPY,
+		},
+	},
+}
+
+type VP8EncoderOptions struct {
+	// KeyFrameInterval forces a key frame every N frames, zero disables it.
+	KeyFrameInterval uint
+	// TemporalLayers splits the stream in up to 3 temporal layers.
+	TemporalLayers uint
+	// Bitrate is the target bitrate in kbps, zero means defaultBitrate.
+	Bitrate uint
+}
+
+type VP8Frame struct {
+	Data       []byte
+	KeyFrame   bool
+	Droppable  bool
+	TemporalID uint8
+	LayerSync  bool
+}
+
 type VP8Encoder struct {
-	buffer     *bytes.Buffer
-	realSize   image.Point
-	codecCtx   C.vpx_codec_ctx_t
-	vpxImage   C.vpx_image_t
-	yuvBuffer  []byte
-	frameCount uint
+	buffer            *bytes.Buffer
+	realSize          image.Point
+	codecCtx          C.vpx_codec_ctx_t
+	vpxImage          C.vpx_image_t
+	frameCount        uint
+	keyFrameInterval  uint
+	keyFrameRequested bool
+	temporalPattern   *vp8TemporalPattern
+	temporalIndex     int
 }
 
-func NewVP8Encoder(size image.Point, frameRate int) (*VP8Encoder, error) {
+func NewVP8Encoder(size image.Point, options VP8EncoderOptions) (*VP8Encoder, error) {
+	// odd sizes are fine, libvpx rounds the chroma planes up
+	if size.X <= 0 || size.Y <= 0 || size.X > maxVP8Dimension || size.Y > maxVP8Dimension {
+		return nil, fmt.Errorf("unsupported frame size: %v", size)
+	}
+
 	var codecEncCfg C.vpx_codec_enc_cfg_t
 	if C.codec_enc_config_default(&codecEncCfg) != 0 {
 		return nil, fmt.Errorf("can't init default enc. config")
@@ -125,13 +156,37 @@ func NewVP8Encoder(size image.Point, frameRate int) (*VP8Encoder, error) {
 	codecEncCfg.g_w = C.uint(size.X)
 	codecEncCfg.g_h = C.uint(size.Y)
 	codecEncCfg.g_timebase.num = 1
-	codecEncCfg.g_timebase.den = C.int(frameRate)
+	codecEncCfg.g_timebase.den = vp8ClockRate
 	codecEncCfg.g_error_resilient = 1
-	codecEncCfg.rc_target_bitrate = 90000
+	codecEncCfg.rc_target_bitrate = defaultBitrate
+	if options.Bitrate > 0 {
+		codecEncCfg.rc_target_bitrate = C.uint(options.Bitrate)
+	}
+
+	var temporalPattern *vp8TemporalPattern
+	if options.TemporalLayers > 1 {
+		pattern, ok := vp8TemporalPatterns[options.TemporalLayers]
+		if !ok {
+			return nil, fmt.Errorf("unsupported number of temporal layers: %d", options.TemporalLayers)
+		}
+		temporalPattern = &pattern
+
+		// key frames must land on TL0, so they are only emitted when forced
+		codecEncCfg.kf_mode = C.VPX_KF_DISABLED
+		codecEncCfg.ts_number_layers = C.uint(options.TemporalLayers)
+		codecEncCfg.ts_periodicity = C.uint(len(pattern.layerIDs))
+		for i, share := range pattern.bitrateShares {
+			codecEncCfg.ts_target_bitrate[i] = codecEncCfg.rc_target_bitrate * C.uint(share) / 100
+			codecEncCfg.ts_rate_decimator[i] = C.uint(pattern.rateDecimators[i])
+		}
+		for i, layerID := range pattern.layerIDs {
+			codecEncCfg.ts_layer_id[i] = C.uint(layerID)
+		}
+	}
 
 	var vpxCodecCtx C.vpx_codec_ctx_t
 	if C.codec_enc_init(&vpxCodecCtx, &codecEncCfg) != 0 {
-		return nil, fmt.Errorf("failed to initialize enc ctx")
+		return nil, fmt.Errorf("failed to initialize enc ctx: %w", codecError(&vpxCodecCtx))
 	}
 
 	var vpxImage C.vpx_image_t
@@ -139,43 +194,130 @@ func NewVP8Encoder(size image.Point, frameRate int) (*VP8Encoder, error) {
 		return nil, fmt.Errorf("can't alloc. vpx image")
 	}
 
+	vpxImage.cs = C.VPX_CS_BT_601
+	vpxImage._range = C.VPX_CR_STUDIO_RANGE
+
 	encoder := &VP8Encoder{
-		buffer:     bytes.NewBuffer(make([]byte, 0)),
-		realSize:   size,
-		codecCtx:   vpxCodecCtx,
-		vpxImage:   vpxImage,
-		yuvBuffer:  make([]byte, size.X*size.Y*2),
-		frameCount: 0,
+		buffer:           bytes.NewBuffer(make([]byte, 0)),
+		realSize:         size,
+		codecCtx:         vpxCodecCtx,
+		vpxImage:         vpxImage,
+		frameCount:       0,
+		keyFrameInterval: options.KeyFrameInterval,
+		temporalPattern:  temporalPattern,
 	}
 	return encoder, nil
 }
 
-func (e *VP8Encoder) Encode(frame *image.RGBA) ([]byte, error) {
+func (e *VP8Encoder) Encode(frame *image.RGBA, timestamp, duration time.Duration) ([]VP8Frame, error) {
+	if size := frame.Rect.Size(); size != e.realSize {
+		return nil, fmt.Errorf("frame size %v doesn't match encoder size %v", size, e.realSize)
+	}
+
+	planes := [3]unsafe.Pointer{
+		unsafe.Pointer(e.vpxImage.planes[0]),
+		unsafe.Pointer(e.vpxImage.planes[1]),
+		unsafe.Pointer(e.vpxImage.planes[2]),
+	}
+	strides := [3]int{
+		int(e.vpxImage.stride[0]),
+		int(e.vpxImage.stride[1]),
+		int(e.vpxImage.stride[2]),
+	}
+	rgbaToI420(frame, planes, strides, vp8ColorSpace)
+
+	return e.encodeImage(timestamp, duration)
+}
+
+// EncodeRepeat encodes the last frame again, skipping the color conversion.
+// Mostly unchanged content makes it a very cheap frame for libvpx.
+func (e *VP8Encoder) EncodeRepeat(timestamp, duration time.Duration) ([]VP8Frame, error) {
+	if e.frameCount == 0 {
+		return nil, errors.New("no frame to repeat")
+	}
+
+	return e.encodeImage(timestamp, duration)
+}
+
+func (e *VP8Encoder) encodeImage(timestamp, duration time.Duration) ([]VP8Frame, error) {
 	var flags C.uint64_t
-	if e.frameCount%keyFrameInterval == 0 {
+	if e.keyFrameRequested || e.keyFrameInterval > 0 && e.frameCount%e.keyFrameInterval == 0 {
 		flags |= C.VPX_EFLAG_FORCE_KF
+		e.keyFrameRequested = false
+		e.temporalIndex = 0
+	}
+
+	var temporalID uint8
+	var layerSync bool
+	if pattern := e.temporalPattern; pattern != nil {
+		i := e.temporalIndex % len(pattern.layerIDs)
+		e.temporalIndex++
+
+		layerID := pattern.layerIDs[i]
+		if C.codec_set_temporal_layer_id(&e.codecCtx, C.int(layerID)) != C.VPX_CODEC_OK {
+			return nil, codecError(&e.codecCtx)
+		}
+
+		flags |= pattern.flags[i]
+		temporalID = uint8(layerID)
+		noRef := C.uint64_t(C.VP8_EFLAG_NO_REF_GF | C.VP8_EFLAG_NO_REF_ARF)
+		layerSync = layerID > 0 && pattern.flags[i]&noRef == noRef
 	}
 
-	encodedData := unsafe.Pointer(nil)
-	frameSize := C.encode(
+	res := C.encode(
 		&e.codecCtx,
 		&e.vpxImage,
-		C.vpx_codec_pts_t(e.frameCount),
+		C.vpx_codec_pts_t(durationToTicks(timestamp)),
+		C.ulong(durationToTicks(duration)),
 		flags,
-		unsafe.Pointer(&frame.Pix[0]),
-		unsafe.Pointer(&e.yuvBuffer[0]),
-		C.size_t(e.realSize.X),
-		C.size_t(e.realSize.Y),
-		&encodedData,
 	)
+	if res != C.VPX_CODEC_OK {
+		return nil, codecError(&e.codecCtx)
+	}
 
 	e.frameCount++
 
-	if int(frameSize) <= 0 {
-		return nil, nil
+	var frames []VP8Frame
+	var iter C.vpx_codec_iter_t
+	for {
+		var buf unsafe.Pointer
+		var sz C.size_t
+		var pktFlags C.vpx_codec_frame_flags_t
+		if C.next_frame_pkt(&e.codecCtx, &iter, &buf, &sz, &pktFlags) == 0 {
+			break
+		}
+
+		frames = append(frames, VP8Frame{
+			Data:       C.GoBytes(buf, C.int(sz)),
+			KeyFrame:   pktFlags&C.VPX_FRAME_IS_KEY != 0,
+			Droppable:  pktFlags&C.VPX_FRAME_IS_DROPPABLE != 0,
+			TemporalID: temporalID,
+			LayerSync:  layerSync,
+		})
+	}
+
+	if len(frames) == 0 {
+		return nil, ErrFrameDropped
 	}
 
-	return C.GoBytes(encodedData, C.int(frameSize)), nil
+	return frames, nil
+}
+
+func (e *VP8Encoder) RequestKeyFrame() {
+	e.keyFrameRequested = true
+}
+
+func codecError(ctx *C.vpx_codec_ctx_t) error {
+	msg := C.GoString(C.vpx_codec_error(ctx))
+	if detail := C.vpx_codec_error_detail(ctx); detail != nil {
+		return fmt.Errorf("%s: %s", msg, C.GoString(detail))
+	}
+
+	return errors.New(msg)
+}
+
+func durationToTicks(d time.Duration) int64 {
+	return int64(d) * vp8ClockRate / int64(time.Second)
 }
 
 func (e *VP8Encoder) VideoSize() (image.Point, error) {
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestFitVP8Size(t *testing.T) {
+	tests := []struct {
+		size image.Point
+		want image.Point
+	}{
+		{image.Pt(1920, 1080), image.Pt(1920, 1080)},
+		{image.Pt(1366, 767), image.Pt(1366, 767)},
+		{image.Pt(16382, 16382), image.Pt(16382, 16382)},
+		{image.Pt(16383, 100), image.Pt(16382, 99)},
+		{image.Pt(32768, 1080), image.Pt(16382, 539)},
+		{image.Pt(1080, 32768), image.Pt(539, 16382)},
+		{image.Pt(40000, 40000), image.Pt(16382, 16382)},
+		{image.Pt(100000, 1), image.Pt(16382, 1)},
+		{image.Pt(0, 0), image.Pt(1, 1)},
+		{image.Pt(5, 0), image.Pt(5, 1)},
+	}
+
+	for _, test := range tests {
+		if got := fitVP8Size(test.size); got != test.want {
+			t.Errorf("fitVP8Size(%v) = %v, want %v", test.size, got, test.want)
+		}
+	}
+}
+
+func TestFitVP8SizePadded(t *testing.T) {
+	// padding odd sizes after fitting must stay within the VP8 maximum
+	for _, size := range []image.Point{image.Pt(16383, 16383), image.Pt(33001, 17001)} {
+		fitted := fitVP8Size(size)
+		if fitted.X+fitted.X%2 > maxVP8Dimension || fitted.Y+fitted.Y%2 > maxVP8Dimension {
+			t.Errorf("%v fitted to %v, which padding takes over the maximum", size, fitted)
+		}
+	}
+}
+
+func TestNewVP8EncoderSize(t *testing.T) {
+	for _, size := range []image.Point{
+		image.Pt(0, 720),
+		image.Pt(1280, 0),
+		image.Pt(-1, -1),
+		image.Pt(maxVP8Dimension+1, 720),
+		image.Pt(1280, maxVP8Dimension+1),
+	} {
+		if encoder, err := NewVP8Encoder(size, VP8EncoderOptions{}); err == nil {
+			encoder.Close()
+			t.Errorf("NewVP8Encoder(%v) succeeded", size)
+		}
+	}
+}
+
+func TestVP8ColorSpace(t *testing.T) {
+	// 2x2 blocks of mixed primaries, gray, black and white, and arbitrary
+	// colors, so the matrix, the range and the chroma averaging all show
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i, c := range []color.RGBA{
+		red, red, gray, gray,
+		blue, green, gray, gray,
+		black, white, {10, 20, 30, 255}, {200, 100, 50, 255},
+		white, black, {0, 128, 255, 255}, {255, 255, 0, 255},
+	} {
+		src.SetRGBA(i%4, i/4, c)
+	}
+
+	// limited range BT.601, as VP8 decoders convert back, computed in
+	// floating point
+	wantY := []uint8{
+		81, 81, 126, 126,
+		41, 145, 126, 126,
+		16, 235, 32, 123,
+		235, 16, 105, 210,
+	}
+	wantCb := []uint8{119, 128, 128, 111}
+	wantCr := []uint8{156, 128, 128, 127}
+
+	got := RGBAToYCbCr(src, vp8ColorSpace)
+	for _, plane := range []struct {
+		name      string
+		got, want []uint8
+	}{
+		{"Y", got.Y, wantY},
+		{"Cb", got.Cb, wantCb},
+		{"Cr", got.Cr, wantCr},
+	} {
+		for i := range plane.want {
+			if absDiff(plane.got[i], plane.want[i]) > 1 {
+				t.Errorf("%s = %v, want %v", plane.name, plane.got, plane.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+)
+
+const (
+	rtpOutboundMTU = 1200
+)
+
+// vp8Payloader writes RFC 7741 descriptors carrying the temporal layer of each frame
+type vp8Payloader struct {
+	layered    bool
+	pictureID  uint16
+	tl0PicIdx  uint8
+	temporalID uint8
+	layerSync  bool
+	droppable  bool
+}
+
+var _ rtp.Payloader = (*vp8Payloader)(nil)
+
+func (p *vp8Payloader) setFrame(frame VP8Frame) {
+	if frame.TemporalID == 0 {
+		p.tl0PicIdx++
+	}
+	p.temporalID = frame.TemporalID
+	p.layerSync = frame.LayerSync
+	p.droppable = frame.Droppable
+}
+
+func (p *vp8Payloader) Payload(mtu uint16, payload []byte) [][]byte {
+	header := []byte{
+		0x80,
+		0x80,
+		0x80 | byte(p.pictureID>>8),
+		byte(p.pictureID),
+	}
+	if p.droppable {
+		header[0] |= 0x20
+	}
+	if p.layered {
+		header[1] |= 0x40 | 0x20
+		tid := p.temporalID << 6
+		if p.layerSync {
+			tid |= 0x20
+		}
+		header = append(header, p.tl0PicIdx, tid)
+	}
+
+	p.pictureID = (p.pictureID + 1) & 0x7FFF
+
+	maxFragmentSize := int(mtu) - len(header)
+	if maxFragmentSize <= 0 {
+		return nil
+	}
+
+	var payloads [][]byte
+	for i := 0; i < len(payload); i += maxFragmentSize {
+		end := i + maxFragmentSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		out := make([]byte, len(header), len(header)+end-i)
+		copy(out, header)
+		if i == 0 {
+			out[0] |= 0x10
+		}
+
+		payloads = append(payloads, append(out, payload[i:end]...))
+	}
+
+	return payloads
+}
+
+// VP8Track is one encoding of the video, simulcast senders carry one track
+// per RID.
+type VP8Track struct {
+	id             string
+	rid            string
+	streamID       string
+	layered        bool
+	payloader      *vp8Payloader
+	packetizer     rtp.Packetizer
+	mutex          sync.RWMutex
+	writeStream    webrtc.TrackLocalWriter
+	ridExtensionID uint8
+}
+
+var _ webrtc.TrackLocal = (*VP8Track)(nil)
+
+func NewVP8Track(id, streamID, rid string, layered bool) (*VP8Track, error) {
+	track := VP8Track{
+		id:       id,
+		rid:      rid,
+		streamID: streamID,
+		layered:  layered,
+	}
+	return &track, nil
+}
+
+func (t *VP8Track) ID() string {
+	return t.id
+}
+
+func (t *VP8Track) RID() string {
+	return t.rid
+}
+
+func (t *VP8Track) StreamID() string {
+	return t.streamID
+}
+
+func (t *VP8Track) Kind() webrtc.RTPCodecType {
+	return webrtc.RTPCodecTypeVideo
+}
+
+func (t *VP8Track) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.writeStream != nil {
+		return webrtc.RTPCodecParameters{}, errors.New("track already bound")
+	}
+
+	for _, codec := range ctx.CodecParameters() {
+		if !strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8) {
+			continue
+		}
+
+		if t.rid != "" {
+			for _, extension := range ctx.HeaderExtensions() {
+				if extension.URI == sdp.SDESRTPStreamIDURI {
+					t.ridExtensionID = uint8(extension.ID)
+				}
+			}
+		}
+
+		t.payloader = &vp8Payloader{
+			layered: t.layered,
+		}
+		t.packetizer = rtp.NewPacketizer(rtpOutboundMTU, uint8(codec.PayloadType), uint32(ctx.SSRC()), t.payloader, rtp.NewRandomSequencer(), vp8ClockRate)
+
+		t.writeStream = ctx.WriteStream()
+		return codec, nil
+	}
+
+	return webrtc.RTPCodecParameters{}, webrtc.ErrUnsupportedCodec
+}
+
+func (t *VP8Track) Unbind(ctx webrtc.TrackLocalContext) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.writeStream = nil
+	return nil
+}
+
+func (t *VP8Track) WriteFrame(frame VP8Frame, duration time.Duration) error {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	if t.writeStream == nil {
+		return nil
+	}
+
+	t.payloader.setFrame(frame)
+
+	for _, packet := range t.packetizer.Packetize(frame.Data, uint32(durationToTicks(duration))) {
+		if t.ridExtensionID != 0 {
+			if err := packet.SetExtension(t.ridExtensionID, []byte(t.rid)); err != nil {
+				return err
+			}
+		}
+
+		if _, err := t.writeStream.WriteRTP(&packet.Header, packet.Payload); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -4,38 +4,103 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"image"
+	"io"
 	"log"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
-	"github.com/pion/webrtc/v3/pkg/media"
 )
 
 const (
-	frameRate = 30
+	frameRate             = 30
+	idleKeepAliveInterval = time.Second
 )
 
+type simulcastLayer struct {
+	rid   string
+	scale int
+}
+
+var simulcastLayers = []simulcastLayer{
+	{rid: "f", scale: 1},
+	{rid: "h", scale: 2},
+	{rid: "q", scale: 4},
+}
+
+type PeerOptions struct {
+	Encoder VP8EncoderOptions
+	Crop    *Crop
+	// Masks are redacted before anything else touches the frames.
+	Masks *Masks
+	Scale ScaleOptions
+	// EvenSize rounds frame sizes for decoders that can't handle odd ones.
+	// Padding sends the size of the content on the control channel.
+	EvenSize EvenSizeMode
+	Cursor   CursorMode
+	// Overlay is drawn over the frames after cropping and scaling.
+	Overlay *Overlay
+	// Simulcast publishes full, half and quarter resolution encodings on one
+	// transceiver, told apart by their RIDs.
+	Simulcast bool
+	// Audio adds an Opus track in the same stream as the video, nil for none.
+	Audio        AudioProviderFactory
+	AudioEncoder OpusEncoderOptions
+}
+
 type Peer struct {
 	frameProviderFactory           FrameProviderFactory
 	frameProvider                  FrameProvider
+	options                        PeerOptions
 	webrtcConn                     *webrtc.PeerConnection
 	gatheringComplete              <-chan struct{}
-	videoTrack                     *webrtc.TrackLocalStaticSample
+	videoTracks                    []*VP8Track
+	audioProvider                  AudioProvider
+	audioTrack                     *webrtc.TrackLocalStaticSample
+	controlChannel                 *webrtc.DataChannel
+	keyFrameRequests               []chan struct{}
 	iceCandidates                  []webrtc.ICECandidateInit
 	iceConnectionStateConnected    sync.Once
 	iceConnectionStateDisconnected sync.Once
+	// providersMutex guards setting the providers up against the viewer
+	// disconnecting meanwhile
+	providersMutex sync.Mutex
+	disconnected   bool
 }
 
-func NewPeer(frameProviderFactory FrameProviderFactory, webrtcConfig *webrtc.Configuration) (*Peer, error) {
-	conn, err := webrtc.NewPeerConnection(*webrtcConfig)
+func NewPeer(frameProviderFactory FrameProviderFactory, webrtcConfig *webrtc.Configuration, options PeerOptions) (*Peer, error) {
+	if options.Crop == nil {
+		options.Crop = &Crop{}
+	}
+	if options.Masks == nil {
+		options.Masks = &Masks{}
+	}
+	if options.Overlay == nil {
+		overlay, err := NewOverlay(OverlayOptions{})
+		if err != nil {
+			return nil, err
+		}
+		options.Overlay = overlay
+	}
+
+	api, err := newWebRTCAPI(options.Simulcast)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := api.NewPeerConnection(*webrtcConfig)
 	if err != nil {
 		return nil, err
 	}
 
 	peer := Peer{
 		frameProviderFactory: frameProviderFactory,
+		options:              options,
 		webrtcConn:           conn,
 		gatheringComplete:    webrtc.GatheringCompletePromise(conn),
 	}
@@ -47,19 +112,92 @@ func NewPeer(frameProviderFactory FrameProviderFactory, webrtcConfig *webrtc.Con
 	return &peer, nil
 }
 
+func newWebRTCAPI(simulcast bool) (*webrtc.API, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	if simulcast {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.SDESRTPStreamIDURI}, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
+	}
+
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	return webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry)), nil
+}
+
 func (p *Peer) Open() error {
-	capability := webrtc.RTPCodecCapability{
-		MimeType: webrtc.MimeTypeVP8,
+	rids := []string{""}
+	if p.options.Simulcast {
+		rids = nil
+		for _, layer := range simulcastLayers {
+			rids = append(rids, layer.rid)
+		}
 	}
-	videoTrack, err := webrtc.NewTrackLocalStaticSample(capability, "video", "pion")
-	if err != nil {
-		return err
+
+	// simulcast encodings share one sender, each with its own SSRC and RTCP
+	// so receivers can ask for key frames of a single encoding
+	var videoSender *webrtc.RTPSender
+	for _, rid := range rids {
+		videoTrack, err := NewVP8Track("video", "pion", rid, p.options.Encoder.TemporalLayers > 1)
+		if err != nil {
+			return err
+		}
+
+		if videoSender == nil {
+			videoSender, err = p.webrtcConn.AddTrack(videoTrack)
+		} else {
+			err = videoSender.AddEncoding(videoTrack)
+		}
+		if err != nil {
+			return err
+		}
+
+		keyFrameRequests := make(chan struct{}, 1)
+		p.videoTracks = append(p.videoTracks, videoTrack)
+		p.keyFrameRequests = append(p.keyFrameRequests, keyFrameRequests)
+
+		readRTCP := videoSender.ReadRTCP
+		if rid != "" {
+			sender, rid := videoSender, rid
+			readRTCP = func() ([]rtcp.Packet, interceptor.Attributes, error) {
+				return sender.ReadSimulcastRTCP(rid)
+			}
+		}
+		go p.readRTCP(readRTCP, keyFrameRequests)
 	}
-	p.videoTrack = videoTrack
 
-	if _, err := p.webrtcConn.AddTrack(videoTrack); err != nil {
+	if p.options.Audio != nil {
+		// sharing the stream id has browsers play both tracks in sync
+		audioTrack, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{
+			MimeType:  webrtc.MimeTypeOpus,
+			ClockRate: opusClockRate,
+			Channels:  2,
+		}, "audio", "pion")
+		if err != nil {
+			return err
+		}
+		p.audioTrack = audioTrack
+
+		rtpSender, err := p.webrtcConn.AddTrack(audioTrack)
+		if err != nil {
+			return err
+		}
+		go p.readRTCP(rtpSender.ReadRTCP, nil)
+	}
+
+	controlChannel, err := p.webrtcConn.CreateDataChannel("control", nil)
+	if err != nil {
 		return err
 	}
+	controlChannel.OnMessage(p.onControlMessage)
+	p.controlChannel = controlChannel
 
 	offer, err := p.webrtcConn.CreateOffer(nil)
 	if err != nil {
@@ -113,59 +251,374 @@ func (p *Peer) onICEConnectionStateChange(connectionState webrtc.ICEConnectionSt
 
 	switch connectionState {
 	case webrtc.ICEConnectionStateConnected:
+		// listen: addresses wait for the server to connect back, which
+		// mustn't hold up pion's callbacks
 		p.iceConnectionStateConnected.Do(func() {
-			frameProvider, err := p.frameProviderFactory.NewFrameProvider()
-			if err != nil {
-				log.Panic(err)
-			}
-			p.frameProvider = frameProvider
-
-			go func() {
-				if err := p.writeSamples(); err != nil {
-					log.Print(err)
-				}
-			}()
+			go p.startProviders()
 		})
 
 	case webrtc.ICEConnectionStateDisconnected:
 		p.iceConnectionStateDisconnected.Do(func() {
+			p.providersMutex.Lock()
+			defer p.providersMutex.Unlock()
+
+			p.disconnected = true
+			if p.frameProvider == nil {
+				return
+			}
+
 			if err := p.frameProvider.Close(); err != nil {
 				log.Print(err)
 			}
+
+			if p.audioProvider != nil {
+				if err := p.audioProvider.Close(); err != nil {
+					log.Print(err)
+				}
+			}
 		})
 	}
 }
 
-func (p *Peer) writeSamples() error {
+func (p *Peer) startProviders() {
+	frameProvider, err := p.frameProviderFactory.NewFrameProvider()
+	if err != nil {
+		// only this viewer goes away
+		log.Print(err)
+		p.Close()
+		return
+	}
+
+	p.providersMutex.Lock()
+	defer p.providersMutex.Unlock()
+
+	if p.disconnected {
+		if err := frameProvider.Close(); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+	p.frameProvider = frameProvider
+
+	go func() {
+		if err := p.writeSamples(); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	if p.audioTrack == nil {
+		return
+	}
+
+	// the video goes on without audio when it can't be captured
+	audioProvider, err := p.newAudioProvider()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	p.audioProvider = audioProvider
+
+	go func() {
+		if err := p.writeAudioSamples(); err != nil {
+			log.Print(err)
+		}
+	}()
+}
+
+// readRTCP answers PLI and FIR with a key frame on keyFrameRequests, nil for
+// senders without video.
+func (p *Peer) readRTCP(read func() ([]rtcp.Packet, interceptor.Attributes, error), keyFrameRequests chan<- struct{}) {
 	for {
-		frame, err := p.frameProvider.Frame()
+		packets, _, err := read()
 		if err != nil {
-			return err
+			if !errors.Is(err, io.EOF) {
+				log.Print(err)
+			}
+			return
 		}
 
-		encoder, err := NewVP8Encoder(frame.Rect.Size(), frameRate)
-		if err != nil {
-			return err
+		for _, packet := range packets {
+			switch packet.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				requestKeyFrame(keyFrameRequests)
+			}
 		}
+	}
+}
 
-		data, err := encoder.Encode(frame)
+func requestKeyFrame(keyFrameRequests chan<- struct{}) {
+	select {
+	case keyFrameRequests <- struct{}{}:
+	default:
+	}
+}
+
+type videoEncoding struct {
+	scale      int
+	scaler     *Scaler
+	evenSize   EvenSizeMode
+	options    VP8EncoderOptions
+	encoder    *VP8Encoder
+	lastSample time.Time
+	track      *VP8Track
+
+	keyFrameRequests  <-chan struct{}
+	keyFrameRequested bool
+}
+
+func (p *Peer) newVideoEncodings(start time.Time) []*videoEncoding {
+	scales := []int{1}
+	if p.options.Simulcast {
+		scales = nil
+		for _, layer := range simulcastLayers {
+			scales = append(scales, layer.scale)
+		}
+	}
+
+	var encodings []*videoEncoding
+	for i, scale := range scales {
+		options := p.options.Encoder
+		if options.Bitrate == 0 {
+			options.Bitrate = defaultBitrate
+		}
+		options.Bitrate /= uint(scale * scale)
+
+		encodings = append(encodings, &videoEncoding{
+			scale:      scale,
+			scaler:     NewScaler(p.options.Scale.Filter),
+			evenSize:   p.options.EvenSize,
+			options:    options,
+			lastSample: start,
+			track:      p.videoTracks[i],
+
+			keyFrameRequests: p.keyFrameRequests[i],
+		})
+	}
+	return encodings
+}
+
+func (e *videoEncoding) encode(frame *image.RGBA, timestamp, duration time.Duration, keyFrame bool) ([]VP8Frame, error) {
+	size := fitVP8Size(frame.Rect.Size().Div(e.scale))
+	frame = e.evenSize.Apply(e.scaler.Scale(frame, size))
+
+	if e.encoder == nil || e.encoder.realSize != frame.Rect.Size() {
+		e.close()
+
+		encoder, err := NewVP8Encoder(frame.Rect.Size(), e.options)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		e.encoder = encoder
+	}
+
+	if keyFrame {
+		e.encoder.RequestKeyFrame()
+	}
 
-		sample := media.Sample{
-			Data:     data,
-			Duration: time.Second / time.Duration(frameRate),
+	return e.encoder.Encode(frame, timestamp, duration)
+}
+
+func (e *videoEncoding) repeat(timestamp, duration time.Duration) ([]VP8Frame, error) {
+	if e.encoder == nil {
+		return nil, ErrFrameDropped
+	}
+
+	return e.encoder.EncodeRepeat(timestamp, duration)
+}
+
+func (e *videoEncoding) close() {
+	if e.encoder != nil {
+		e.encoder.Close()
+		e.encoder = nil
+	}
+}
+
+// frameState sums up what the next frame depends on, so an unchanged state
+// means an unchanged frame
+type frameState struct {
+	valid          bool
+	serial         uint64
+	cursorSerial   uint
+	cursorPosition image.Point
+	crop           image.Rectangle
+	masks          uint
+	overlay        string
+}
+
+func (p *Peer) frameState(cursor *Cursor, now time.Time) frameState {
+	provider, ok := p.frameProvider.(FrameSerialProvider)
+	if !ok {
+		return frameState{}
+	}
+
+	state := frameState{
+		valid:  true,
+		serial: provider.FrameSerial(),
+		crop:   p.options.Crop.Rect(),
+		masks:  p.options.Masks.Revision(),
+	}
+	if cursor != nil {
+		state.cursorSerial = cursor.Serial
+		state.cursorPosition = cursor.Position
+	}
+	state.overlay = p.options.Overlay.State(now)
+	return state
+}
+
+func (p *Peer) writeSamples() error {
+	// a time.Ticker drops ticks for slow receivers, so frames are skipped
+	// instead of queued whenever capture and encoding fall behind
+	ticker := time.NewTicker(time.Second / frameRate)
+	defer ticker.Stop()
+
+	// providers that announce updates get them encoded as soon as they
+	// arrive, the ticker still bounds the frame rate and picks up cursor,
+	// overlay and keep-alive changes
+	var updates <-chan FrameUpdate
+	if notifier, ok := p.frameProvider.(FrameNotifier); ok {
+		updates = notifier.FrameUpdates()
+	}
+
+	start := time.Now()
+	lastFrame := start
+	var lastState frameState
+
+	scaler := NewScaler(p.options.Scale.Filter)
+	cursors := cursorSender{
+		channel: p.controlChannel,
+	}
+	sizes := sizeSender{
+		channel: p.controlChannel,
+	}
+	encodings := p.newVideoEncodings(start)
+	defer func() {
+		for _, encoding := range encodings {
+			encoding.close()
 		}
+	}()
 
-		if err := p.videoTrack.WriteSample(sample); err != nil {
-			return err
+	for {
+		select {
+		case <-ticker.C:
+		case <-updates:
+			if time.Since(lastFrame) < time.Second/frameRate {
+				continue
+			}
+		}
+
+		now := time.Now()
+
+		var keyFrameRequested bool
+		for _, encoding := range encodings {
+			select {
+			case <-encoding.keyFrameRequests:
+				encoding.keyFrameRequested = true
+				keyFrameRequested = true
+			default:
+			}
+		}
+
+		cursor, hasCursor := p.cursor()
+
+		// while the screen is static nothing is captured or converted, and
+		// the last frame is only encoded again at idleKeepAliveInterval
+		state := p.frameState(cursor, now)
+		idle := state.valid && state == lastState && !keyFrameRequested
+		if idle && now.Sub(lastFrame) < idleKeepAliveInterval {
+			continue
 		}
+		lastState = state
+
+		var frame, captured *image.RGBA
+		if !idle {
+			var err error
+			captured, err = p.frameProvider.Frame()
+			if err != nil {
+				return err
+			}
+			frame = captured
+
+			p.options.Masks.Apply(frame)
 
-		time.Sleep(sample.Duration)
+			if hasCursor && p.options.Cursor == CursorModeComposite {
+				drawCursor(frame, cursor)
+			}
+
+			frame = p.options.Crop.Apply(frame)
+			region := frame.Rect
+			frame = scaler.Scale(frame, p.options.Scale.Size(frame.Rect.Size()))
+
+			if hasCursor && p.options.Cursor == CursorModeChannel {
+				scale := float64(frame.Rect.Dx()) / float64(region.Dx())
+				if err := cursors.send(cursor, region, scale); err != nil {
+					log.Print(err)
+				}
+			}
+
+			if p.options.EvenSize == EvenSizePad {
+				if err := sizes.send(frame.Rect.Size()); err != nil {
+					log.Print(err)
+				}
+			}
+
+			if err := p.options.Overlay.Apply(frame, now); err != nil {
+				return err
+			}
+		}
+
+		for _, encoding := range encodings {
+			var encoded []VP8Frame
+			var err error
+			if idle {
+				encoded, err = encoding.repeat(now.Sub(start), now.Sub(lastFrame))
+			} else {
+				encoded, err = encoding.encode(frame, now.Sub(start), now.Sub(lastFrame), encoding.keyFrameRequested)
+				encoding.keyFrameRequested = false
+			}
+			if errors.Is(err, ErrFrameDropped) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			// the time since the last written sample, dropped frames included,
+			// is spread over the frames so the RTP clock keeps up with the wall clock
+			duration := now.Sub(encoding.lastSample) / time.Duration(len(encoded))
+			encoding.lastSample = now
+
+			for _, vp8Frame := range encoded {
+				if len(vp8Frame.Data) == 0 {
+					continue
+				}
+
+				if err := encoding.track.WriteFrame(vp8Frame, duration); err != nil {
+					return err
+				}
+			}
+		}
+
+		if recycler, ok := p.frameProvider.(FrameRecycler); ok && captured != nil {
+			recycler.Recycle(captured)
+		}
+
+		lastFrame = now
 	}
 }
 
+func (p *Peer) cursor() (*Cursor, bool) {
+	if p.options.Cursor == CursorModeNone {
+		return nil, false
+	}
+
+	provider, ok := p.frameProvider.(CursorProvider)
+	if !ok {
+		return nil, false
+	}
+
+	return provider.Cursor()
+}
+
 type WebRTCConfigurationProvider interface {
 	WebRTCConfiguration() (*webrtc.Configuration, error)
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	webSocketHandshakeTimeout = 10 * time.Second
+)
+
+// HTTPHeader is a repeatable "Name: value" command line value.
+type HTTPHeader http.Header
+
+func (h HTTPHeader) String() string {
+	var headers []string
+	for name, values := range h {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+func (h HTTPHeader) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("invalid header %q", v)
+	}
+
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+type WebSocketOptions struct {
+	// Header is sent with the handshake, for the cookies or tokens the
+	// proxy authenticates with.
+	Header http.Header
+	// CAFile verifies wss:// servers instead of the system roots.
+	CAFile             string
+	InsecureSkipVerify bool
+}
+
+func (o WebSocketOptions) tlsConfig() (*tls.Config, error) {
+	config := tls.Config{
+		InsecureSkipVerify: o.InsecureSkipVerify,
+	}
+
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", o.CAFile)
+		}
+	}
+
+	return &config, nil
+}
+
+// dialWebSocket connects to a websockify style endpoint, which carries the
+// RFB byte stream in binary messages.
+func dialWebSocket(url string, options WebSocketOptions) (net.Conn, error) {
+	tlsConfig, err := options.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: webSocketHandshakeTimeout,
+		TLSClientConfig:  tlsConfig,
+		Subprotocols:     []string{"binary"},
+	}
+
+	conn, response, err := dialer.Dial(url, options.Header)
+	if err != nil {
+		if response != nil {
+			return nil, fmt.Errorf("websocket %s: %s: %w", url, response.Status, err)
+		}
+		return nil, fmt.Errorf("websocket %s: %w", url, err)
+	}
+
+	return &webSocketConn{conn: conn}, nil
+}
+
+// webSocketConn reads and writes the WebSocket as a stream, message
+// boundaries mean nothing to RFB.
+type webSocketConn struct {
+	conn       *websocket.Conn
+	reader     io.Reader
+	writeMutex sync.Mutex
+}
+
+var _ net.Conn = (*webSocketConn)(nil)
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			kind, reader, err := c.conn.NextReader()
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				return 0, io.EOF
+			}
+			if err != nil {
+				return 0, err
+			}
+			if kind != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+		if errors.Is(err, io.EOF) {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if err := c.conn.WriteMessage(websocket.BinaryMessage, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *webSocketConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.conn.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.conn.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
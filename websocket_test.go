@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveWebSocket runs serve on the server end of a WebSocket, as
+// websockify would, and returns its ws:// URL.
+func serveWebSocket(t *testing.T, serve func(conn *websocket.Conn, r *http.Request)) string {
+	t.Helper()
+
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"binary"},
+	}
+	served := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(served)
+
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		serve(conn, r)
+	}))
+	t.Cleanup(func() {
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Error("WebSocket handler didn't return")
+		}
+		server.Close()
+	})
+
+	return "ws" + strings.TrimPrefix(server.URL, "http")
+}
+
+func TestWebSocketConn(t *testing.T) {
+	written := make(chan string, 1)
+	url := serveWebSocket(t, func(conn *websocket.Conn, r *http.Request) {
+		if token := r.Header.Get("Authorization"); token != "Bearer token" {
+			t.Errorf("Authorization = %q, want %q", token, "Bearer token")
+		}
+
+		for _, message := range []struct {
+			kind int
+			data string
+		}{
+			{websocket.BinaryMessage, "RFB 003"},
+			// text messages aren't part of the stream
+			{websocket.TextMessage, "ignored"},
+			{websocket.BinaryMessage, ".008"},
+			{websocket.BinaryMessage, ""},
+			{websocket.BinaryMessage, "\n"},
+		} {
+			if err := conn.WriteMessage(message.kind, []byte(message.data)); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if kind != websocket.BinaryMessage {
+			t.Errorf("message type = %d, want binary", kind)
+		}
+		written <- string(data)
+
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	})
+
+	header := make(http.Header)
+	if err := HTTPHeader(header).Set("Authorization: Bearer token"); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dialWebSocket(url, WebSocketOptions{Header: header})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// reads split messages and span them
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, buf[4:]); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf); got != "RFB 003.008\n" {
+		t.Errorf("read %q, want %q", got, "RFB 003.008\n")
+	}
+
+	if _, err := conn.Write([]byte("RFB 003.008\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-written:
+		if data != "RFB 003.008\n" {
+			t.Errorf("wrote %q, want %q", data, "RFB 003.008\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("write not received")
+	}
+
+	if n, err := conn.Read(buf); !errors.Is(err, io.EOF) {
+		t.Errorf("Read after close = %d, %v, want io.EOF", n, err)
+	}
+}
+
+func TestWebSocketConnAbnormalClose(t *testing.T) {
+	url := serveWebSocket(t, func(conn *websocket.Conn, r *http.Request) {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "oops"))
+	})
+
+	conn, err := dialWebSocket(url, WebSocketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// only clean closes end the stream, anything else is an error
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, io.EOF) {
+		t.Errorf("Read = %v, want a close error", err)
+	}
+}
@@ -0,0 +1,414 @@
+//go:build linux && !nocapture
+
+package main
+
+// #cgo pkg-config: x11 xext xdamage
+//
+// #include <pthread.h>
+// #include <stdint.h>
+// #include <stdlib.h>
+// #include <string.h>
+// #include <sys/ipc.h>
+// #include <sys/select.h>
+// #include <sys/shm.h>
+// #include <X11/Xlib.h>
+// #include <X11/Xutil.h>
+// #include <X11/extensions/XShm.h>
+// #include <X11/extensions/Xdamage.h>
+//
+// typedef struct {
+//     Display *dpy;
+//     Window root;
+//     int width, height;
+//     int use_shm;
+//     XShmSegmentInfo shm;
+//     XImage *image;
+//     int has_damage, damage_event_base;
+//     Damage damage;
+// } x11_capture_t;
+//
+// // Xlib error handlers are process wide, trap_mutex keeps displays from
+// // swapping them under each other
+// static pthread_mutex_t trap_mutex = PTHREAD_MUTEX_INITIALIZER;
+// static int trapped_error;
+// static XErrorHandler untrapped_handler;
+//
+// static int x11_trapped_error(Display *dpy, XErrorEvent *event) {
+//     trapped_error = 1;
+//     return 0;
+// }
+//
+// // x11_trap_errors makes the errors until x11_untrap_errors non fatal, the
+// // default handler exits the process on them
+// static void x11_trap_errors(void) {
+//     pthread_mutex_lock(&trap_mutex);
+//     trapped_error = 0;
+//     untrapped_handler = XSetErrorHandler(x11_trapped_error);
+// }
+//
+// // x11_untrap_errors waits for the replies to the requests made since
+// // x11_trap_errors and tells whether one of them failed
+// static int x11_untrap_errors(x11_capture_t *c) {
+//     XSync(c->dpy, False);
+//     int failed = trapped_error;
+//
+//     XSetErrorHandler(untrapped_handler);
+//     pthread_mutex_unlock(&trap_mutex);
+//     return failed;
+// }
+//
+// // x11_attach attaches the segment, trapping the error a server that can't
+// // reach it (BadAccess from another user or a container) replies with
+// static int x11_attach(x11_capture_t *c) {
+//     x11_trap_errors();
+//     int ok = XShmAttach(c->dpy, &c->shm);
+//     return !x11_untrap_errors(c) && ok;
+// }
+//
+// static void x11_destroy_image(x11_capture_t *c) {
+//     if (!c->image)
+//         return;
+//
+//     XShmDetach(c->dpy, &c->shm);
+//     XDestroyImage(c->image);
+//     shmdt(c->shm.shmaddr);
+//     c->image = NULL;
+// }
+//
+// static int x11_create_image(x11_capture_t *c) {
+//     XWindowAttributes attrs;
+//     if (!XGetWindowAttributes(c->dpy, c->root, &attrs))
+//         return -1;
+//     c->width = attrs.width;
+//     c->height = attrs.height;
+//
+//     if (!c->use_shm)
+//         return 0;
+//
+//     c->image = XShmCreateImage(c->dpy, attrs.visual, attrs.depth, ZPixmap, NULL, &c->shm, c->width, c->height);
+//     if (!c->image)
+//         goto fallback;
+//
+//     c->shm.shmid = shmget(IPC_PRIVATE, c->image->bytes_per_line * c->image->height, IPC_CREAT | 0600);
+//     if (c->shm.shmid < 0)
+//         goto fail;
+//
+//     c->shm.shmaddr = c->image->data = shmat(c->shm.shmid, NULL, 0);
+//     if (c->shm.shmaddr == (char *)-1) {
+//         shmctl(c->shm.shmid, IPC_RMID, NULL);
+//         goto fail;
+//     }
+//     c->shm.readOnly = False;
+//
+//     if (!x11_attach(c)) {
+//         shmdt(c->shm.shmaddr);
+//         shmctl(c->shm.shmid, IPC_RMID, NULL);
+//         goto fail;
+//     }
+//
+//     // the segment goes away once both sides detach
+//     shmctl(c->shm.shmid, IPC_RMID, NULL);
+//     return 0;
+//
+// fail:
+//     c->image->data = NULL;
+//     XDestroyImage(c->image);
+//     c->image = NULL;
+//
+// fallback:
+//     // remote displays can't share memory, plain XGetImage works everywhere
+//     c->use_shm = 0;
+//     return 0;
+// }
+//
+// static x11_capture_t *x11_open(const char *name) {
+//     x11_capture_t *c = calloc(1, sizeof(x11_capture_t));
+//     if (!c)
+//         return NULL;
+//
+//     c->dpy = XOpenDisplay(name);
+//     if (!c->dpy)
+//         goto fail;
+//
+//     c->root = DefaultRootWindow(c->dpy);
+//     XSelectInput(c->dpy, c->root, StructureNotifyMask);
+//
+//     c->use_shm = XShmQueryExtension(c->dpy);
+//     if (x11_create_image(c) < 0)
+//         goto fail;
+//
+//     int damage_error_base;
+//     c->has_damage = XDamageQueryExtension(c->dpy, &c->damage_event_base, &damage_error_base);
+//     if (c->has_damage)
+//         c->damage = XDamageCreate(c->dpy, c->root, XDamageReportNonEmpty);
+//
+//     return c;
+//
+// fail:
+//     if (c->dpy)
+//         XCloseDisplay(c->dpy);
+//     free(c);
+//     return NULL;
+// }
+//
+// static void x11_close(x11_capture_t *c) {
+//     if (c->has_damage)
+//         XDamageDestroy(c->dpy, c->damage);
+//     x11_destroy_image(c);
+//     XCloseDisplay(c->dpy);
+//     free(c);
+// }
+//
+// static int x11_has_damage(x11_capture_t *c) {
+//     return c->has_damage;
+// }
+//
+// static void x11_get_size(x11_capture_t *c, int *width, int *height) {
+//     *width = c->width;
+//     *height = c->height;
+// }
+//
+// static int mask_shift(unsigned long mask) {
+//     int shift = 0;
+//     while (mask && !(mask & 1)) {
+//         mask >>= 1;
+//         shift++;
+//     }
+//     return shift;
+// }
+//
+// // x11_capture copies the root window into dst as RGBA, returning -1 when
+// // the size doesn't match anymore and -2 when the capture failed. Getting
+// // more than the root window has, after it shrank but before x11_poll saw
+// // it, fails with BadMatch.
+// static int x11_capture(x11_capture_t *c, unsigned char *dst, int width, int height) {
+//     if (width != c->width || height != c->height)
+//         return -1;
+//
+//     XImage *image = c->image;
+//     x11_trap_errors();
+//     if (c->use_shm) {
+//         if (!XShmGetImage(c->dpy, c->root, image, 0, 0, AllPlanes))
+//             image = NULL;
+//     } else {
+//         image = XGetImage(c->dpy, c->root, 0, 0, width, height, AllPlanes, ZPixmap);
+//     }
+//     if (x11_untrap_errors(c) || !image) {
+//         if (image && !c->use_shm)
+//             XDestroyImage(image);
+//         return -2;
+//     }
+//
+//     int ok = image->bits_per_pixel == 32;
+//     if (ok) {
+//         int r = mask_shift(image->red_mask), g = mask_shift(image->green_mask), b = mask_shift(image->blue_mask);
+//         for (int y = 0; y < height; ++y) {
+//             const uint32_t *src = (const uint32_t *)(image->data + y * image->bytes_per_line);
+//             unsigned char *out = dst + y * width * 4;
+//             for (int x = 0; x < width; ++x, out += 4) {
+//                 out[0] = src[x] >> r;
+//                 out[1] = src[x] >> g;
+//                 out[2] = src[x] >> b;
+//                 out[3] = 255;
+//             }
+//         }
+//     }
+//
+//     if (!c->use_shm)
+//         XDestroyImage(image);
+//
+//     return ok ? 0 : -2;
+// }
+//
+// // x11_poll handles the queued events and returns how many damage
+// // notifications there were, or -1 when the image couldn't be resized
+// static int x11_poll(x11_capture_t *c) {
+//     int damaged = 0, resized = 0;
+//
+//     while (XPending(c->dpy)) {
+//         XEvent event;
+//         XNextEvent(c->dpy, &event);
+//
+//         if (event.type == ConfigureNotify && event.xconfigure.window == c->root) {
+//             resized = event.xconfigure.width != c->width || event.xconfigure.height != c->height;
+//         } else if (c->has_damage && event.type == c->damage_event_base + XDamageNotify) {
+//             damaged++;
+//         }
+//     }
+//
+//     if (damaged)
+//         XDamageSubtract(c->dpy, c->damage, None, None);
+//
+//     if (resized) {
+//         x11_destroy_image(c);
+//         c->use_shm = XShmQueryExtension(c->dpy);
+//         if (x11_create_image(c) < 0)
+//             return -1;
+//         damaged++;
+//     }
+//
+//     return damaged;
+// }
+//
+// // x11_wait waits up to timeout_ms for the X server to send something,
+// // without touching Xlib so it can run unlocked
+// static void x11_wait(x11_capture_t *c, int timeout_ms) {
+//     int fd = ConnectionNumber(c->dpy);
+//
+//     fd_set fds;
+//     FD_ZERO(&fds);
+//     FD_SET(fd, &fds);
+//
+//     struct timeval tv = {0, timeout_ms * 1000};
+//     select(fd + 1, &fds, NULL, NULL, &tv);
+// }
+//
+import "C"
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	x11PollInterval = 10 * time.Millisecond
+)
+
+// X11FrameProvider captures the root window of an X11 display, using MIT-SHM
+// when the display is local and DAMAGE to tell when the screen changed.
+type X11FrameProvider struct {
+	// mutex guards every Xlib call, the display is shared by Frame and the
+	// event loop
+	mutex   sync.Mutex
+	capture *C.x11_capture_t
+	frames  FramePool
+	serial  uint64
+	updates chan FrameUpdate
+	done    chan struct{}
+	stopped chan struct{}
+	close   sync.Once
+}
+
+var _ FrameProvider = (*X11FrameProvider)(nil)
+var _ FrameSerialProvider = (*X11FrameProvider)(nil)
+var _ FrameNotifier = (*X11FrameProvider)(nil)
+var _ FrameRecycler = (*X11FrameProvider)(nil)
+
+func NewX11FrameProvider(display string) (*X11FrameProvider, error) {
+	var name *C.char
+	if display != "" {
+		name = C.CString(display)
+		defer C.free(unsafe.Pointer(name))
+	}
+
+	capture := C.x11_open(name)
+	if capture == nil {
+		return nil, errors.New("x11_open")
+	}
+
+	provider := X11FrameProvider{
+		capture: capture,
+		updates: make(chan FrameUpdate, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go provider.loop()
+
+	return &provider, nil
+}
+
+func (p *X11FrameProvider) loop() {
+	defer close(p.stopped)
+
+	for {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		C.x11_wait(p.capture, C.int(x11PollInterval/time.Millisecond))
+
+		p.mutex.Lock()
+		damaged := C.x11_poll(p.capture)
+		p.mutex.Unlock()
+
+		if damaged != 0 {
+			notifyFrameUpdate(p.updates, FrameUpdate{
+				Serial: atomic.AddUint64(&p.serial, 1),
+				Time:   time.Now(),
+			})
+		}
+	}
+}
+
+func (p *X11FrameProvider) Frame() (*image.RGBA, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.capture == nil {
+		return nil, errors.New("x11 display closed")
+	}
+
+	// without DAMAGE every frame counts as a new one
+	if C.x11_has_damage(p.capture) == 0 {
+		atomic.AddUint64(&p.serial, 1)
+	}
+
+	// the root window can be resized between polling and capturing it
+	for attempt := 0; attempt < 3; attempt++ {
+		var width, height C.int
+		C.x11_get_size(p.capture, &width, &height)
+		if width <= 0 || height <= 0 {
+			return nil, errors.New("x11_get_size")
+		}
+
+		frame := p.frames.Get(image.Rect(0, 0, int(width), int(height)))
+		if C.x11_capture(p.capture, (*C.uchar)(unsafe.Pointer(&frame.Pix[0])), width, height) == 0 {
+			return frame, nil
+		}
+		p.frames.Put(frame)
+
+		// picks the new size up, the event loop won't see it anymore
+		damaged := C.x11_poll(p.capture)
+		if damaged < 0 {
+			return nil, errors.New("x11_poll")
+		}
+		if damaged > 0 {
+			atomic.AddUint64(&p.serial, 1)
+		}
+	}
+
+	return nil, errors.New("x11_capture")
+}
+
+func (p *X11FrameProvider) Recycle(frame *image.RGBA) {
+	p.frames.Put(frame)
+}
+
+func (p *X11FrameProvider) FrameSerial() uint64 {
+	return atomic.LoadUint64(&p.serial)
+}
+
+func (p *X11FrameProvider) FrameUpdates() <-chan FrameUpdate {
+	return p.updates
+}
+
+func (p *X11FrameProvider) Close() error {
+	p.close.Do(func() {
+		close(p.done)
+		<-p.stopped
+
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		C.x11_close(p.capture)
+		p.capture = nil
+	})
+
+	return nil
+}
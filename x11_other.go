@@ -0,0 +1,11 @@
+//go:build !linux || nocapture
+
+package main
+
+import (
+	"errors"
+)
+
+func NewX11FrameProvider(display string) (FrameProvider, error) {
+	return nil, errors.New("X11 capture is only supported on Linux, without the nocapture tag")
+}
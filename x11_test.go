@@ -0,0 +1,104 @@
+//go:build linux && !nocapture
+
+package main
+
+import (
+	"bufio"
+	"image"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startXvfb runs a black 320x240 Xvfb with extra arguments and returns its
+// display name.
+func startXvfb(t *testing.T, args ...string) string {
+	t.Helper()
+
+	path, err := exec.LookPath("Xvfb")
+	if err != nil {
+		t.Skip("Xvfb not available")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// -displayfd picks a free display and writes its number to fd 3
+	cmd := exec.Command(path, append([]string{"-displayfd", "3", "-screen", "0", "320x240x24", "-br", "-nolisten", "tcp"}, args...)...)
+	cmd.ExtraFiles = []*os.File{w}
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		t.Fatal(err)
+	}
+	w.Close()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	display := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(r).ReadString('\n')
+		display <- strings.TrimSpace(line)
+	}()
+
+	select {
+	case number := <-display:
+		if number == "" {
+			t.Fatal("Xvfb exited without a display")
+		}
+		return ":" + number
+	case <-time.After(10 * time.Second):
+		t.Fatal("Xvfb didn't start")
+		return ""
+	}
+}
+
+func TestX11FrameProvider(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"shm", nil},
+		// without MIT-SHM the capture falls back to XGetImage, like it does
+		// when attaching the segment fails
+		{"no shm", []string{"-extension", "MIT-SHM"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			provider, err := NewX11FrameProvider(startXvfb(t, test.args...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer provider.Close()
+
+			for i := 0; i < 2; i++ {
+				frame, err := provider.Frame()
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if frame.Rect != image.Rect(0, 0, 320, 240) {
+					t.Fatalf("Rect = %v, want %v", frame.Rect, image.Rect(0, 0, 320, 240))
+				}
+				if got := frame.RGBAAt(160, 120); got != black {
+					t.Errorf("pixel = %v, want %v", got, black)
+				}
+
+				provider.Recycle(frame)
+			}
+
+			// viewers can still ask for a frame after disconnecting
+			provider.Close()
+			if _, err := provider.Frame(); err == nil {
+				t.Error("Frame after Close succeeded")
+			}
+		})
+	}
+}
@@ -0,0 +1,12 @@
+package main
+
+type X11FrameProviderFactory struct {
+	// Display is the X11 display to capture, empty for $DISPLAY.
+	Display string
+}
+
+var _ FrameProviderFactory = (*X11FrameProviderFactory)(nil)
+
+func (f *X11FrameProviderFactory) NewFrameProvider() (FrameProvider, error) {
+	return NewX11FrameProvider(f.Display)
+}
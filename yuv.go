@@ -0,0 +1,219 @@
+package main
+
+// #include <stdint.h>
+//
+// static inline uint8_t clamp_u8(int v) {
+//     return v < 0 ? 0 : v > 255 ? 255 : v;
+// }
+//
+// void rgba_to_i420(const uint8_t *rgba, int rgba_stride, int width, int height,
+//                   uint8_t *y_plane, int y_stride, uint8_t *u_plane, int u_stride, uint8_t *v_plane, int v_stride,
+//                   const int *coef, int y_offset, int uv_offset) {
+//     for (int row = 0; row < height; ++row) {
+//         const uint8_t *p = rgba + row * rgba_stride;
+//         uint8_t *y = y_plane + row * y_stride;
+//
+//         for (int col = 0; col < width; ++col, p += 4)
+//             y[col] = clamp_u8((coef[0] * p[0] + coef[1] * p[1] + coef[2] * p[2] + (y_offset << 14) + (1 << 13)) >> 14);
+//     }
+//
+//     for (int row = 0; row < height; row += 2) {
+//         const uint8_t *p0 = rgba + row * rgba_stride;
+//         const uint8_t *p1 = row + 1 < height ? p0 + rgba_stride : p0;
+//         uint8_t *u = u_plane + row / 2 * u_stride;
+//         uint8_t *v = v_plane + row / 2 * v_stride;
+//
+//         for (int col = 0; col < width; col += 2) {
+//             const uint8_t *a = p0 + 4 * col;
+//             const uint8_t *b = p1 + 4 * col;
+//             const int next = col + 1 < width ? 4 : 0;
+//
+//             int r = a[0] + a[next] + b[0] + b[next];
+//             int g = a[1] + a[next + 1] + b[1] + b[next + 1];
+//             int bl = a[2] + a[next + 2] + b[2] + b[next + 2];
+//
+//             u[col / 2] = clamp_u8((coef[3] * r + coef[4] * g + coef[5] * bl + (uv_offset << 16) + (1 << 15)) >> 16);
+//             v[col / 2] = clamp_u8((coef[6] * r + coef[7] * g + coef[8] * bl + (uv_offset << 16) + (1 << 15)) >> 16);
+//         }
+//     }
+// }
+//
+import "C"
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"unsafe"
+)
+
+type ColorMatrix int
+
+const (
+	ColorMatrixBT601 ColorMatrix = iota
+	ColorMatrixBT709
+)
+
+func (m ColorMatrix) String() string {
+	switch m {
+	case ColorMatrixBT601:
+		return "bt601"
+	case ColorMatrixBT709:
+		return "bt709"
+	default:
+		return fmt.Sprintf("ColorMatrix(%d)", int(m))
+	}
+}
+
+func (m *ColorMatrix) Set(s string) error {
+	switch s {
+	case "bt601":
+		*m = ColorMatrixBT601
+	case "bt709":
+		*m = ColorMatrixBT709
+	default:
+		return fmt.Errorf("unknown color matrix: %s", s)
+	}
+
+	return nil
+}
+
+func (m ColorMatrix) weights() (kr, kb float64) {
+	if m == ColorMatrixBT709 {
+		return 0.2126, 0.0722
+	}
+
+	return 0.299, 0.114
+}
+
+type ColorSpace struct {
+	Matrix    ColorMatrix
+	FullRange bool
+}
+
+// coefficients returns the luma row in 2.14 fixed point followed by the two
+// chroma rows, which are applied to the sum of 2x2 pixels and so carry two
+// extra bits of scale.
+func (c ColorSpace) coefficients() (coef [9]C.int, yOffset, uvOffset C.int) {
+	kr, kb := c.Matrix.weights()
+	kg := 1 - kr - kb
+
+	yScale, uvScale := 219.0/255, 224.0/255
+	yOffset, uvOffset = 16, 128
+	if c.FullRange {
+		yScale, uvScale = 1, 1
+		yOffset = 0
+	}
+
+	rows := [9]float64{
+		kr, kg, kb,
+		-kr / (2 * (1 - kb)), -kg / (2 * (1 - kb)), 0.5,
+		0.5, -kg / (2 * (1 - kr)), -kb / (2 * (1 - kr)),
+	}
+	for i, v := range rows {
+		if i < 3 {
+			coef[i] = C.int(math.Round(v * yScale * (1 << 14)))
+		} else {
+			coef[i] = C.int(math.Round(v * uvScale * (1 << 14)))
+		}
+	}
+
+	return coef, yOffset, uvOffset
+}
+
+func rgbaToI420(src *image.RGBA, planes [3]unsafe.Pointer, strides [3]int, colorSpace ColorSpace) {
+	size := src.Rect.Size()
+	if size.X <= 0 || size.Y <= 0 {
+		return
+	}
+
+	coef, yOffset, uvOffset := colorSpace.coefficients()
+	C.rgba_to_i420(
+		(*C.uint8_t)(unsafe.Pointer(&src.Pix[src.PixOffset(src.Rect.Min.X, src.Rect.Min.Y)])),
+		C.int(src.Stride),
+		C.int(size.X),
+		C.int(size.Y),
+		(*C.uint8_t)(planes[0]),
+		C.int(strides[0]),
+		(*C.uint8_t)(planes[1]),
+		C.int(strides[1]),
+		(*C.uint8_t)(planes[2]),
+		C.int(strides[2]),
+		&coef[0],
+		yOffset,
+		uvOffset,
+	)
+}
+
+// RGBAToYCbCr converts src into a new 4:2:0 image, averaging each 2x2 block
+// for chroma.
+func RGBAToYCbCr(src *image.RGBA, colorSpace ColorSpace) *image.YCbCr {
+	dst := image.NewYCbCr(image.Rect(0, 0, src.Rect.Dx(), src.Rect.Dy()), image.YCbCrSubsampleRatio420)
+	if len(dst.Y) == 0 {
+		return dst
+	}
+
+	planes := [3]unsafe.Pointer{
+		unsafe.Pointer(&dst.Y[0]),
+		unsafe.Pointer(&dst.Cb[0]),
+		unsafe.Pointer(&dst.Cr[0]),
+	}
+	strides := [3]int{
+		dst.YStride,
+		dst.CStride,
+		dst.CStride,
+	}
+	rgbaToI420(src, planes, strides, colorSpace)
+
+	return dst
+}
+
+// ycbcrToRGBA converts src back into dst, which must be the same size, for
+// sources that hand out YUV.
+func ycbcrToRGBA(src *image.YCbCr, dst *image.RGBA, colorSpace ColorSpace) {
+	kr, kb := colorSpace.Matrix.weights()
+	kg := 1 - kr - kb
+
+	yScale, uvScale := 255.0/219, 255.0/224
+	yOffset := 16
+	if colorSpace.FullRange {
+		yScale, uvScale = 1, 1
+		yOffset = 0
+	}
+
+	fixed := func(v float64) int {
+		return int(math.Round(v * (1 << 16)))
+	}
+	ky := fixed(yScale)
+	rv := fixed(2 * (1 - kr) * uvScale)
+	gu := fixed(2 * (1 - kb) * kb / kg * uvScale)
+	gv := fixed(2 * (1 - kr) * kr / kg * uvScale)
+	bu := fixed(2 * (1 - kb) * uvScale)
+
+	clamp := func(v int) uint8 {
+		v = (v + 1<<15) >> 16
+		if v < 0 {
+			return 0
+		}
+		if v > 255 {
+			return 255
+		}
+		return uint8(v)
+	}
+
+	rect := src.Rect
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		out := dst.Pix[dst.PixOffset(dst.Rect.Min.X, dst.Rect.Min.Y+y-rect.Min.Y):]
+		for x := rect.Min.X; x < rect.Max.X; x, out = x+1, out[4:] {
+			l := ky * (int(src.Y[src.YOffset(x, y)]) - yOffset)
+			c := src.COffset(x, y)
+			u := int(src.Cb[c]) - 128
+			v := int(src.Cr[c]) - 128
+
+			out[0] = clamp(l + rv*v)
+			out[1] = clamp(l - gu*u - gv*v)
+			out[2] = clamp(l + bu*u)
+			out[3] = 255
+		}
+	}
+}
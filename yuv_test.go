@@ -0,0 +1,151 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+var (
+	black = color.RGBA{0, 0, 0, 255}
+	white = color.RGBA{255, 255, 255, 255}
+	red   = color.RGBA{255, 0, 0, 255}
+	green = color.RGBA{0, 255, 0, 255}
+	blue  = color.RGBA{0, 0, 255, 255}
+	gray  = color.RGBA{128, 128, 128, 255}
+)
+
+func uniformRGBA(size image.Point, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rectangle{Max: size})
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestRGBAToYCbCr(t *testing.T) {
+	bt601 := ColorSpace{Matrix: ColorMatrixBT601}
+	bt601Full := ColorSpace{Matrix: ColorMatrixBT601, FullRange: true}
+	bt709 := ColorSpace{Matrix: ColorMatrixBT709}
+	bt709Full := ColorSpace{Matrix: ColorMatrixBT709, FullRange: true}
+
+	tests := []struct {
+		colorSpace ColorSpace
+		rgb        color.RGBA
+		want       color.YCbCr
+	}{
+		{bt601, black, color.YCbCr{16, 128, 128}},
+		{bt601, white, color.YCbCr{235, 128, 128}},
+		{bt601, red, color.YCbCr{81, 90, 240}},
+		{bt601, green, color.YCbCr{145, 54, 34}},
+		{bt601, blue, color.YCbCr{41, 240, 110}},
+		{bt601, gray, color.YCbCr{126, 128, 128}},
+
+		{bt601Full, black, color.YCbCr{0, 128, 128}},
+		{bt601Full, white, color.YCbCr{255, 128, 128}},
+		{bt601Full, red, color.YCbCr{76, 85, 255}},
+		{bt601Full, green, color.YCbCr{150, 44, 21}},
+		{bt601Full, blue, color.YCbCr{29, 255, 107}},
+		{bt601Full, gray, color.YCbCr{128, 128, 128}},
+
+		{bt709, black, color.YCbCr{16, 128, 128}},
+		{bt709, white, color.YCbCr{235, 128, 128}},
+		{bt709, red, color.YCbCr{63, 102, 240}},
+		{bt709, green, color.YCbCr{173, 42, 26}},
+		{bt709, blue, color.YCbCr{32, 240, 118}},
+		{bt709, gray, color.YCbCr{126, 128, 128}},
+
+		{bt709Full, black, color.YCbCr{0, 128, 128}},
+		{bt709Full, white, color.YCbCr{255, 128, 128}},
+		{bt709Full, red, color.YCbCr{54, 99, 255}},
+		{bt709Full, green, color.YCbCr{182, 30, 12}},
+		{bt709Full, blue, color.YCbCr{18, 255, 116}},
+		{bt709Full, gray, color.YCbCr{128, 128, 128}},
+	}
+
+	for _, test := range tests {
+		dst := RGBAToYCbCr(uniformRGBA(image.Pt(2, 2), test.rgb), test.colorSpace)
+
+		for _, y := range dst.Y {
+			if y != test.want.Y {
+				t.Errorf("%v full range %t, %v: Y = %d, want %d", test.colorSpace.Matrix, test.colorSpace.FullRange, test.rgb, y, test.want.Y)
+			}
+		}
+		if got := dst.Cb[0]; got != test.want.Cb {
+			t.Errorf("%v full range %t, %v: Cb = %d, want %d", test.colorSpace.Matrix, test.colorSpace.FullRange, test.rgb, got, test.want.Cb)
+		}
+		if got := dst.Cr[0]; got != test.want.Cr {
+			t.Errorf("%v full range %t, %v: Cr = %d, want %d", test.colorSpace.Matrix, test.colorSpace.FullRange, test.rgb, got, test.want.Cr)
+		}
+	}
+}
+
+func TestRGBAToYCbCrChromaAveraging(t *testing.T) {
+	// red and blue columns average to (127.5, 0, 127.5), the last column of
+	// an odd width image only has green to average
+	src := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		src.SetRGBA(0, y, red)
+		src.SetRGBA(1, y, blue)
+		src.SetRGBA(2, y, green)
+	}
+
+	dst := RGBAToYCbCr(src, ColorSpace{Matrix: ColorMatrixBT601})
+
+	if want := []uint8{81, 41, 145}; string(dst.Y[:3]) != string(want) {
+		t.Errorf("Y = %v, want %v", dst.Y[:3], want)
+	}
+	if want := []uint8{165, 54}; string(dst.Cb) != string(want) {
+		t.Errorf("Cb = %v, want %v", dst.Cb, want)
+	}
+	if want := []uint8{175, 34}; string(dst.Cr) != string(want) {
+		t.Errorf("Cr = %v, want %v", dst.Cr, want)
+	}
+}
+
+func TestRGBAToYCbCrSubImage(t *testing.T) {
+	src := uniformRGBA(image.Pt(4, 4), black)
+	for y := 2; y < 4; y++ {
+		for x := 2; x < 4; x++ {
+			src.SetRGBA(x, y, white)
+		}
+	}
+
+	dst := RGBAToYCbCr(src.SubImage(image.Rect(2, 2, 4, 4)).(*image.RGBA), ColorSpace{Matrix: ColorMatrixBT709})
+
+	if dst.Rect != image.Rect(0, 0, 2, 2) {
+		t.Fatalf("Rect = %v, want %v", dst.Rect, image.Rect(0, 0, 2, 2))
+	}
+	for _, y := range dst.Y {
+		if y != 235 {
+			t.Errorf("Y = %d, want 235", y)
+		}
+	}
+}
+
+func TestYCbCrToRGBARoundTrip(t *testing.T) {
+	for _, colorSpace := range []ColorSpace{
+		{Matrix: ColorMatrixBT601},
+		{Matrix: ColorMatrixBT601, FullRange: true},
+		{Matrix: ColorMatrixBT709},
+		{Matrix: ColorMatrixBT709, FullRange: true},
+	} {
+		for _, c := range []color.RGBA{black, white, red, green, blue, gray} {
+			ycbcr := RGBAToYCbCr(uniformRGBA(image.Pt(2, 2), c), colorSpace)
+			rgba := image.NewRGBA(ycbcr.Rect)
+			ycbcrToRGBA(ycbcr, rgba, colorSpace)
+
+			got := rgba.RGBAAt(0, 0)
+			if absDiff(got.R, c.R) > 2 || absDiff(got.G, c.G) > 2 || absDiff(got.B, c.B) > 2 || got.A != 255 {
+				t.Errorf("%v full range %t: %v came back as %v", colorSpace.Matrix, colorSpace.FullRange, c, got)
+			}
+		}
+	}
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}